@@ -0,0 +1,530 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The x86-64 backend writes GNU assembler (AT&T syntax) for the System V
+// ABI, it doesn't need the C compiler until it's time to link.
+//
+// Code is generated the simple way: every expression leaves its value in
+// %rax, and operands wait on the stack while the other side is worked
+// out. Every local gets its own 8 byte slot in the frame, ints are kept
+// sign extended from 32 bits so they behave the same as C ints do with
+// the C backend.
+
+// argRegs are the registers the first six arguments of a call go in
+var argRegs = []string{"%rdi", "%rsi", "%rdx", "%rcx", "%r8", "%r9"}
+
+type asmGen struct {
+	res *Resolution
+	out *strings.Builder
+
+	// The string literals used so far, they go in .rodata at the end
+	strings []string
+	labels  int
+
+	// Functions waiting to be generated, nested functions are generated
+	// after the one they're in
+	fns     []*AstFnDecl
+	fnNames map[*AstFnDecl]string
+
+	// State for the function being generated
+	fn      *AstFnDecl
+	slots   map[*Symbol]int
+	frame   int
+	depth   int
+	loops   []asmLoop
+	retLbl  string
+	globals map[*Symbol]string
+}
+
+type asmLoop struct {
+	label     *AstIdent
+	brk, cont string
+}
+
+// AsmBackend generates x86-64 assembly, which is assembled with the
+// system's assembler
+type AsmBackend struct{}
+
+func (AsmBackend) Name() string {
+	return "asm"
+}
+
+func (AsmBackend) Ext() string {
+	return ".s"
+}
+
+func (AsmBackend) Generate(mod *AstModule, res *Resolution, info *TypeInfo) (string, error) {
+	return GenerateAsm(mod, res)
+}
+
+// GenerateAsm turns a checked module into assembly
+func GenerateAsm(mod *AstModule, res *Resolution) (string, error) {
+	g := &asmGen{
+		res:     res,
+		out:     &strings.Builder{},
+		fnNames: map[*AstFnDecl]string{},
+		globals: map[*Symbol]string{},
+	}
+	g.emit("  /* Module: %s */", mod.Name.Name)
+
+	inits := []AstStatement{}
+	for _, st := range mod.Statements {
+		switch n := st.(type) {
+		case *AstFnDecl:
+			g.fnNames[n] = n.Name.Name
+			g.fns = append(g.fns, n)
+		case *AstConstAssign:
+			g.global(n.Ident)
+			inits = append(inits, n)
+		case *AstVarDecl:
+			g.global(n.Ident)
+			inits = append(inits, n)
+		}
+	}
+
+	g.emit("  .text")
+	for len(g.fns) > 0 {
+		fn := g.fns[0]
+		g.fns = g.fns[1:]
+		g.function(fn)
+	}
+	if len(inits) > 0 {
+		g.initFunction(inits)
+	}
+
+	if len(g.strings) > 0 {
+		g.emit("  .section .rodata")
+		for i, s := range g.strings {
+			g.emit(".L.str.%d:", i)
+			g.emit("  .string %s", asmStringLiteral(s))
+		}
+	}
+	g.emit("  .section .note.GNU-stack,\"\",@progbits")
+	return g.out.String(), nil
+}
+
+func (g *asmGen) emit(format string, a ...any) {
+	fmt.Fprintf(g.out, format, a...)
+	g.out.WriteByte('\n')
+}
+
+func (g *asmGen) label() int {
+	g.labels++
+	return g.labels
+}
+
+func (g *asmGen) push() {
+	g.emit("  push %%rax")
+	g.depth++
+}
+
+func (g *asmGen) pop(reg string) {
+	g.emit("  pop %s", reg)
+	g.depth--
+}
+
+// global lays out a module level let or var in .data, it's zero until
+// the init function sets it
+func (g *asmGen) global(id *AstIdent) {
+	sym := g.res.SymbolOf(id)
+	g.globals[sym] = id.Name
+	g.emit("  .data")
+	g.emit("  .globl %s", id.Name)
+	g.emit("  .align 8")
+	g.emit("%s:", id.Name)
+	g.emit("  .quad 0")
+}
+
+// initFunction works out the values of the module level declarations.
+// It's listed in .init_array so it runs before main.
+func (g *asmGen) initFunction(inits []AstStatement) {
+	g.emit("  .text")
+	g.frameFor(nil, ".L.init", func() {
+		for _, st := range inits {
+			g.stmt(st)
+		}
+	})
+	g.emit("  .section .init_array,\"aw\"")
+	g.emit("  .align 8")
+	g.emit("  .quad .L.init")
+}
+
+// frameFor generates a function called name, with body generating its
+// code. The frame is only laid out once the body has been generated and
+// every local has a slot.
+func (g *asmGen) frameFor(fn *AstFnDecl, name string, body func()) {
+	g.fn = fn
+	g.slots = map[*Symbol]int{}
+	g.frame = 0
+	g.depth = 0
+	g.loops = nil
+	g.retLbl = fmt.Sprintf(".L.return.%d", g.label())
+
+	out := g.out
+	g.out = &strings.Builder{}
+	body()
+	code := g.out.String()
+	g.out = out
+
+	g.emit("%s:", name)
+	g.emit("  push %%rbp")
+	g.emit("  mov %%rsp, %%rbp")
+	// Keep the stack 16 byte aligned at calls
+	if size := (g.frame + 15) &^ 15; size > 0 {
+		g.emit("  sub $%d, %%rsp", size)
+	}
+	g.out.WriteString(code)
+	g.emit("%s:", g.retLbl)
+	g.emit("  mov %%rbp, %%rsp")
+	g.emit("  pop %%rbp")
+	g.emit("  ret")
+}
+
+// slot gives a local a place in the frame, returning its offset from %rbp
+func (g *asmGen) slot() int {
+	g.frame += 8
+	return -g.frame
+}
+
+func (g *asmGen) function(fn *AstFnDecl) {
+	name := g.fnNames[fn]
+	g.emit("  .globl %s", name)
+	g.frameFor(fn, name, func() {
+		for i, p := range fn.Params {
+			sym := g.res.SymbolOf(p.Name)
+			if i < len(argRegs) {
+				off := g.slot()
+				g.slots[sym] = off
+				g.emit("  mov %s, %d(%%rbp)", argRegs[i], off)
+			} else {
+				// The rest were pushed by the caller, above the return
+				// address
+				g.slots[sym] = 16 + 8*(i-len(argRegs))
+			}
+		}
+		g.block(fn.Body)
+		// Only void functions can get here, and main which returns 0
+		// like it does in C
+		g.emit("  mov $0, %%rax")
+	})
+}
+
+func (g *asmGen) block(b *AstBlock) {
+	for _, st := range b.Body {
+		g.stmt(st)
+	}
+}
+
+// store saves %rax in the variable id refers to
+func (g *asmGen) store(id *AstIdent) {
+	sym := g.res.SymbolOf(id)
+	if name, ok := g.globals[sym]; ok {
+		g.emit("  mov %%rax, %s(%%rip)", name)
+		return
+	}
+	off, ok := g.slots[sym]
+	if !ok {
+		off = g.slot()
+		g.slots[sym] = off
+	}
+	g.emit("  mov %%rax, %d(%%rbp)", off)
+}
+
+func (g *asmGen) load(id *AstIdent) {
+	sym := g.res.SymbolOf(id)
+	if name, ok := g.globals[sym]; ok {
+		g.emit("  mov %s(%%rip), %%rax", name)
+		return
+	}
+	off, ok := g.slots[sym]
+	if !ok {
+		// The resolver makes sure functions only use their own locals
+		panic(fmt.Sprintf("asm: %s isn't a local of the function", id.Name))
+	}
+	g.emit("  mov %d(%%rbp), %%rax", off)
+}
+
+func (g *asmGen) stmt(st AstStatement) {
+	switch n := st.(type) {
+	case *AstConstAssign:
+		g.expr(n.Value)
+		g.store(n.Ident)
+	case *AstVarDecl:
+		g.expr(n.Value)
+		g.store(n.Ident)
+	case *AstAssign:
+		if n.Op == TokAssign {
+			g.expr(n.Value)
+		} else {
+			g.expr(n.Value)
+			g.push()
+			g.load(n.Target)
+			g.pop("%rcx")
+			g.arith(compoundOps[n.Op])
+		}
+		g.store(n.Target)
+	case *AstFnDecl:
+		// Nested functions are generated on their own after this one,
+		// with a name that can't clash with anything else
+		g.fnNames[n] = fmt.Sprintf("%s.%s.%d", g.fnNames[g.fn], n.Name.Name, g.label())
+		g.fns = append(g.fns, n)
+	case *AstFnCall:
+		g.call(n)
+	case *AstBlock:
+		g.block(n)
+	case *AstIf:
+		n1 := g.label()
+		g.expr(n.Cond)
+		g.emit("  cmp $0, %%rax")
+		g.emit("  je .L.else.%d", n1)
+		g.block(n.Then)
+		g.emit("  jmp .L.done.%d", n1)
+		g.emit(".L.else.%d:", n1)
+		if n.Else != nil {
+			g.stmt(n.Else)
+		}
+		g.emit(".L.done.%d:", n1)
+	case *AstWhile:
+		n1 := g.label()
+		loop := asmLoop{n.Label, fmt.Sprintf(".L.while.end.%d", n1), fmt.Sprintf(".L.while.top.%d", n1)}
+		g.emit("%s:", loop.cont)
+		g.expr(n.Cond)
+		g.emit("  cmp $0, %%rax")
+		g.emit("  je %s", loop.brk)
+		g.loopBody(loop, n.Body)
+		g.emit("  jmp %s", loop.cont)
+		g.emit("%s:", loop.brk)
+	case *AstFor:
+		n1 := g.label()
+		loop := asmLoop{n.Label, fmt.Sprintf(".L.for.end.%d", n1), fmt.Sprintf(".L.for.step.%d", n1)}
+		if n.Init != nil {
+			g.stmt(n.Init)
+		}
+		g.emit(".L.for.top.%d:", n1)
+		if n.Cond != nil {
+			g.expr(n.Cond)
+			g.emit("  cmp $0, %%rax")
+			g.emit("  je %s", loop.brk)
+		}
+		g.loopBody(loop, n.Body)
+		g.emit("%s:", loop.cont)
+		if n.Step != nil {
+			g.stmt(n.Step)
+		}
+		g.emit("  jmp .L.for.top.%d", n1)
+		g.emit("%s:", loop.brk)
+	case *AstRangeFor:
+		n1 := g.label()
+		loop := asmLoop{n.Label, fmt.Sprintf(".L.for.end.%d", n1), fmt.Sprintf(".L.for.step.%d", n1)}
+		// The upper bound is only evaluated once
+		g.expr(n.Lo)
+		g.store(n.Var)
+		g.expr(n.Hi)
+		end := g.slot()
+		g.emit("  mov %%rax, %d(%%rbp)", end)
+		g.emit(".L.for.top.%d:", n1)
+		g.load(n.Var)
+		g.emit("  cmp %d(%%rbp), %%rax", end)
+		g.emit("  jge %s", loop.brk)
+		g.loopBody(loop, n.Body)
+		g.emit("%s:", loop.cont)
+		g.load(n.Var)
+		g.emit("  add $1, %%rax")
+		g.emit("  cltq")
+		g.store(n.Var)
+		g.emit("  jmp .L.for.top.%d", n1)
+		g.emit("%s:", loop.brk)
+	case *AstBreak:
+		g.emit("  jmp %s", g.loopTarget(n.Label).brk)
+	case *AstContinue:
+		g.emit("  jmp %s", g.loopTarget(n.Label).cont)
+	case *AstReturn:
+		if n.Value != nil {
+			g.expr(n.Value)
+		}
+		g.emit("  jmp %s", g.retLbl)
+	default:
+		panic(fmt.Sprintf("asm: unhandled statement %T", st))
+	}
+}
+
+func (g *asmGen) loopBody(loop asmLoop, body *AstBlock) {
+	g.loops = append(g.loops, loop)
+	g.block(body)
+	g.loops = g.loops[:len(g.loops)-1]
+}
+
+// loopTarget finds the loop a break or continue refers to, the parser
+// has already made sure there is one
+func (g *asmGen) loopTarget(label *AstIdent) asmLoop {
+	for i := len(g.loops) - 1; i >= 0; i-- {
+		if label == nil || (g.loops[i].label != nil && g.loops[i].label.Name == label.Name) {
+			return g.loops[i]
+		}
+	}
+	panic("asm: break or continue outside of a loop")
+}
+
+// compoundOps are the operators used by each compound assignment
+var compoundOps = map[TokenKind]TokenKind{
+	TokPlusAssign:    TokPlus,
+	TokMinusAssign:   TokMinus,
+	TokStarAssign:    TokStar,
+	TokDivAssign:     TokDiv,
+	TokPercentAssign: TokPercent,
+}
+
+// arith works out %rax op %rcx into %rax
+func (g *asmGen) arith(op TokenKind) {
+	switch op {
+	case TokPlus:
+		g.emit("  add %%rcx, %%rax")
+	case TokMinus:
+		g.emit("  sub %%rcx, %%rax")
+	case TokStar:
+		g.emit("  imul %%rcx, %%rax")
+	case TokDiv, TokPercent:
+		g.emit("  cqo")
+		g.emit("  idiv %%rcx")
+		if op == TokPercent {
+			g.emit("  mov %%rdx, %%rax")
+		}
+	default:
+		panic(fmt.Sprintf("asm: unhandled operator %v", op))
+	}
+	// Wrap around like a 32 bit int
+	g.emit("  cltq")
+}
+
+var setInstructions = map[TokenKind]string{
+	TokEq:  "sete",
+	TokNeq: "setne",
+	TokLt:  "setl",
+	TokLte: "setle",
+	TokGt:  "setg",
+	TokGte: "setge",
+}
+
+func (g *asmGen) expr(e AstExpr) {
+	switch n := e.(type) {
+	case *AstIntLitExpr:
+		g.emit("  mov $%d, %%rax", n.Value)
+	case *AstBoolLitExpr:
+		if n.Value {
+			g.emit("  mov $1, %%rax")
+		} else {
+			g.emit("  mov $0, %%rax")
+		}
+	case *AstStringLitExpr:
+		g.emit("  lea .L.str.%d(%%rip), %%rax", len(g.strings))
+		g.strings = append(g.strings, n.Value)
+	case *AstIdent:
+		g.load(n)
+	case *AstFnCall:
+		g.call(n)
+	case *AstUnaryExpr:
+		g.expr(n.Expr)
+		if n.Op == TokNot {
+			g.emit("  xor $1, %%rax")
+		} else {
+			g.emit("  neg %%rax")
+			g.emit("  cltq")
+		}
+	case *AstBinaryExpr:
+		if n.Op == TokAnd || n.Op == TokOr {
+			g.logical(n)
+			return
+		}
+		g.expr(n.Right)
+		g.push()
+		g.expr(n.Left)
+		g.pop("%rcx")
+		if set, ok := setInstructions[n.Op]; ok {
+			g.emit("  cmp %%rcx, %%rax")
+			g.emit("  %s %%al", set)
+			g.emit("  movzb %%al, %%rax")
+		} else {
+			g.arith(n.Op)
+		}
+	default:
+		panic(fmt.Sprintf("asm: unhandled expression %T", e))
+	}
+}
+
+// logical generates && and ||, the right side is only evaluated if the
+// left doesn't decide the answer
+func (g *asmGen) logical(n *AstBinaryExpr) {
+	n1 := g.label()
+	g.expr(n.Left)
+	g.emit("  cmp $0, %%rax")
+	if n.Op == TokAnd {
+		g.emit("  je .L.logic.%d", n1)
+	} else {
+		g.emit("  jne .L.logic.%d", n1)
+	}
+	g.expr(n.Right)
+	g.emit(".L.logic.%d:", n1)
+}
+
+func (g *asmGen) call(n *AstFnCall) {
+	sym := g.res.SymbolOf(n.Name)
+	name := n.Name.Name
+	if sym != nil && sym.Kind == SymFn {
+		name = g.fnNames[sym.Decl.(*AstFnDecl)]
+	} else {
+		// Builtins come from the C library
+		name += "@PLT"
+	}
+
+	// Arguments after the sixth go on the stack, which has to be 16 byte
+	// aligned at the call
+	onStack := max(len(n.Args)-len(argRegs), 0)
+	pad := (g.depth + onStack) % 2
+	if pad == 1 {
+		g.emit("  sub $8, %%rsp")
+		g.depth++
+	}
+	for i := len(n.Args) - 1; i >= 0; i-- {
+		g.expr(n.Args[i])
+		g.push()
+	}
+	for i := 0; i < len(n.Args) && i < len(argRegs); i++ {
+		g.pop(argRegs[i])
+	}
+	// Variadic functions are told how many vector registers are used
+	g.emit("  mov $0, %%al")
+	g.emit("  call %s", name)
+	if sym == nil || sym.Kind != SymFn {
+		// The C library only sets the 32 bits of an int
+		g.emit("  cltq")
+	}
+	if drop := onStack + pad; drop > 0 {
+		g.emit("  add $%d, %%rsp", 8*drop)
+		g.depth -= drop
+	}
+}
+
+// asmStringLiteral quotes s for the assembler's .string directive, which
+// understands the same octal escapes as C
+func asmStringLiteral(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c >= 0x20 && c < 0x7f:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "\\%03o", c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
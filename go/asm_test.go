@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// buildAndRun compiles src with the given backend and any other build
+// flags and runs it, returning its output and exit status
+func buildAndRun(t *testing.T, src string, backend string, flags ...string) (string, int) {
+	t.Helper()
+	filename := writeSource(t, src)
+	exe := filepath.Join(filepath.Dir(filename), "test_"+backend)
+	args := append([]string{"build", "--backend=" + backend, "-o", exe}, flags...)
+	if code := runCommand(append(args, filename)); code != 0 {
+		t.Fatalf("building %q with the %s backend %v failed with status %d", src, backend, flags, code)
+	}
+	out := bytes.Buffer{}
+	cmd := exec.Command(exe)
+	cmd.Stdout = &out
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return out.String(), exitErr.ExitCode()
+	} else if err != nil {
+		t.Fatalf("running %q: %v", src, err)
+	}
+	return out.String(), 0
+}
+
+// backendCases are main function bodies, run after backendPrelude, with
+// the output and exit status every way of running them should give
+var backendCases = []struct {
+	body string
+	out  string
+	code int
+}{
+	{"return 42;", "", 42},
+	{"return 5 + 20 - 4;", "", 21},
+	{"return 5 + 6 * 7;", "", 47},
+	{"return 5 * (9 - 6);", "", 15},
+	{"return (3 + 10) / 3 + 17 % 5;", "", 6},
+	{"return -10 + 20 - -1;", "", 11},
+	{"return -7 / 2 + 10;", "", 7},
+	{"if 1 < 2 && 2 <= 2 && 3 > 2 && 3 >= 3 && 1 == 1 && 1 != 2 { return 1; } return 0;", "", 1},
+	{"if 2 < 1 || !true || false { return 1; } return 2;", "", 2},
+	{"var i = 0; var j = 0; while i < 5 { i += 1; j += 3; } return j;", "", 15},
+	{"var j = 0; for var i = 0; i <= 10; i += 1 { j = i + j; } return j;", "", 55},
+	{"var j = 0; for i in 0..10 { if i == 3 { continue; } if i == 6 { break; } j += i; } return j;", "", 12},
+	{"var n = 0; outer: for i in 0..5 { for j in 0..5 { if j == 2 { continue outer; } if i == 3 { break outer; } n += 1; } } return n;", "", 6},
+	{"var x = 100; x -= 1; x *= 2; x /= 3; x %= 50; return x;", "", 16},
+	{"return add(1, 2) * 2;", "", 6},
+	{"return many(1, 2, 3, 4, 5, 6, 7, 8);", "", 36},
+	{"return fact(5) - 100;", "", 20},
+	{"count += base; return count;", "", 7},
+	{`printf("%d %s %d\n", 1, "two", 3); puts("a \"quoted\"\tstring"); putchar(65); putchar(10); return 0;`, "1 two 3\na \"quoted\"\tstring\nA\n", 0},
+	{`let a = 1; if true { let a = 2; printf("%d ", a); } printf("%d\n", a); return 0;`, "2 1\n", 0},
+	{`printf("%d %d %d %d %d %d %d\n", 1, 2, 3, 4, 5, 6, 7); return 0;`, "1 2 3 4 5 6 7\n", 0},
+	{"say(); return 3;", "hi\n", 3},
+	{"if 2147483647 + 1 == -2147483647 - 1 { return 1; } return 0;", "", 1},
+	{`printf("%d %d\n", true, 2 > 3); return 0;`, "1 0\n", 0},
+	{"var x = 10; x -= add(x, 1); return x + 100;", "", 99},
+	{`puts(greeting + ", " + "world"); return big / 2;`, "hello, world\n", 100},
+	{`printf("%d %d %d\n", quot(-2147483647 - 1, -1), rem(-2147483647 - 1, -1), quot(-7, 2)); return 0;`, "-2147483648 0 -3\n", 0},
+	{"var int = 3; let index = 2; fn exit(n: int): int { return n * 2; } return remove(int + index) + exit(1);", "", 6},
+	{"var n = 0; again: for i in 0..3 { if i == 2 { break again; } n += 1; } again: while n < 10 { n += 5; continue again; } return n;", "", 12},
+}
+
+var backendPrelude = `module m;
+let base = 3;
+let greeting = "hel" + "lo";
+let big = (base + 47) * 4;
+var count = 4;
+fn add(a: int, b: int): int { return a + b; }
+fn many(a: int, b: int, c: int, d: int, e: int, f: int, g: int, h: int): int {
+	return a + b + c + d + e + f + g + h;
+}
+fn fact(n: int): int {
+	if n <= 1 { return 1; }
+	return n * fact(n - 1);
+}
+fn say(): void { puts("hi"); }
+fn quot(a: int, b: int): int { return a / b; }
+fn rem(a: int, b: int): int { return a % b; }
+fn remove(n: int): int { return n - 1; }
+`
+
+func TestAsmBackend(t *testing.T) {
+	for _, tool := range []string{"cc", "as"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("no %s", tool)
+		}
+	}
+	for _, tc := range backendCases {
+		src := backendPrelude + "fn main(): int {\n" + tc.body + "\n}\n"
+		for _, backend := range []string{"asm", "c"} {
+			out, code := buildAndRun(t, src, backend)
+			if out != tc.out || code != tc.code {
+				t.Errorf("running %q with the %s backend: expected %q and status %d, got %q and %d", tc.body, backend, tc.out, tc.code, out, code)
+			}
+		}
+	}
+}
+
+func TestAsmGlobalInitialisers(t *testing.T) {
+	for _, tool := range []string{"cc", "as"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("no %s", tool)
+		}
+	}
+	// Unlike C, globals can be set to anything
+	src := `module m;
+let a = add(2, 3);
+var b = a * 2;
+fn add(x: int, y: int): int { return x + y; }
+fn main(): int { return a + b; }
+`
+	for _, backend := range []string{"asm", "c"} {
+		if _, code := buildAndRun(t, src, backend); code != 15 {
+			t.Errorf("with the %s backend: expected status 15, got %d", backend, code)
+		}
+	}
+}
+
+func TestAsmStringLiteral(t *testing.T) {
+	cases := []struct{ in, out string }{
+		{"abc", `"abc"`},
+		{"a\"b\\c", `"a\"b\\c"`},
+		{"\n\t\x01é", `"\012\011\001\303\251"`},
+	}
+	for _, tc := range cases {
+		if got := asmStringLiteral(tc.in); got != tc.out {
+			t.Errorf("quoting %q: expected %s got %s", tc.in, tc.out, got)
+		}
+	}
+}
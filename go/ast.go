@@ -2,33 +2,69 @@ package main
 
 type Node interface {
 	isNode()
-	Codegen(thing *CodegenModule)
+	// Where in the source the node was parsed from
+	Span() Span
+}
+type node struct {
+	span Span
+}
+
+func (n *node) Span() Span {
+	return n.span
+}
+
+// SourceText returns the text of src that n was parsed from
+func SourceText(src string, n Node) string {
+	span := n.Span()
+	return src[span.Start.Offset:span.End.Offset]
 }
-type node struct{}
 
 type AstModule struct {
 	node
 	Name       *AstIdent
 	Statements []AstStatement
+	// The file the module was parsed from, used for error messages
+	Filename string
 }
 
 type AstStatement interface {
 	Node
 	isStatement()
-	ForwardDecl(thing *CodegenModule)
 }
 type AstExpr interface {
 	Node
 }
 
+// AstConstAssign declares a constant. Type is nil when it was left out,
+// the checker fills in the type inferred from Value.
 type AstConstAssign struct {
 	node
-	Ident string
+	Ident *AstIdent
+	Type  *AstType
+	Value AstExpr
+}
+
+// AstVarDecl declares a mutable variable, unlike AstConstAssign
+// it can be the target of an AstAssign. Type is inferred like
+// AstConstAssign's.
+type AstVarDecl struct {
+	node
+	Ident *AstIdent
 	Type  *AstType
 	Value AstExpr
 }
 
+// AstAssign stores Value into Target. Op is TokAssign for plain
+// assignment, or one of the compound assignment tokens (TokPlusAssign, ...)
+type AstAssign struct {
+	node
+	Target *AstIdent
+	Op     TokenKind
+	Value  AstExpr
+}
+
 type AstIdent struct {
+	node
 	Name string
 }
 
@@ -45,6 +81,26 @@ type AstStringLitExpr struct {
 	node
 	Value string
 }
+type AstBoolLitExpr struct {
+	node
+	Value bool
+}
+
+// AstBinaryExpr is an infix operation, Op is the operator token
+// (TokPlus, TokLt, TokAnd, ...)
+type AstBinaryExpr struct {
+	node
+	Op    TokenKind
+	Left  AstExpr
+	Right AstExpr
+}
+
+// AstUnaryExpr is a prefix operation, Op is TokMinus or TokNot
+type AstUnaryExpr struct {
+	node
+	Op   TokenKind
+	Expr AstExpr
+}
 
 type AstFnDecl struct {
 	node
@@ -55,30 +111,123 @@ type AstFnDecl struct {
 }
 
 type AstBlock struct {
+	node
 	Body []AstStatement
 }
 
+// AstIf is an if statement, Else is nil, another *AstIf for an
+// `else if` chain, or an *AstBlock for a final `else`
+type AstIf struct {
+	node
+	Cond AstExpr
+	Then *AstBlock
+	Else AstStatement
+}
+
+// AstReturn returns from the enclosing function, Value is nil for a
+// bare `return;`
+type AstReturn struct {
+	node
+	Value AstExpr
+}
+
+// AstWhile loops while Cond holds. Label is nil unless the loop
+// was labelled for use by a break or continue.
+type AstWhile struct {
+	node
+	Label *AstIdent
+	Cond  AstExpr
+	Body  *AstBlock
+}
+
+// AstFor is a C style `for init; cond; step {}` loop, any of
+// Init, Cond and Step may be nil
+type AstFor struct {
+	node
+	Label *AstIdent
+	Init  AstStatement
+	Cond  AstExpr
+	Step  AstStatement
+	Body  *AstBlock
+}
+
+// AstRangeFor is `for x in lo..hi {}`, iterating over the half
+// open range [lo, hi)
+type AstRangeFor struct {
+	node
+	Label *AstIdent
+	Var   *AstIdent
+	Lo    AstExpr
+	Hi    AstExpr
+	Body  *AstBlock
+}
+
+// AstBreak leaves the innermost loop, or the loop named by Label
+type AstBreak struct {
+	node
+	Label *AstIdent
+}
+
+// AstContinue skips to the next iteration of the innermost loop,
+// or the loop named by Label
+type AstContinue struct {
+	node
+	Label *AstIdent
+}
+
 type AstParam struct {
+	node
 	Name *AstIdent
 	Type *AstType
 }
 
 type AstFnCall struct {
+	node
 	Name *AstIdent
 	Args []AstExpr
 }
 
+func (n *AstModule) isNode()        {}
 func (n *AstConstAssign) isNode()   {}
+func (n *AstVarDecl) isNode()       {}
+func (n *AstAssign) isNode()        {}
 func (s *AstIntLitExpr) isNode()    {}
 func (s *AstStringLitExpr) isNode() {}
+func (s *AstBoolLitExpr) isNode()   {}
 func (s *AstFnDecl) isNode()        {}
 func (s *AstFnCall) isNode()        {}
 func (s *AstIdent) isNode()         {}
+func (s *AstParam) isNode()         {}
+func (s *AstType) isNode()          {}
+func (s *AstBinaryExpr) isNode()    {}
+func (s *AstUnaryExpr) isNode()     {}
+func (s *AstBlock) isNode()         {}
+func (s *AstIf) isNode()            {}
+func (s *AstReturn) isNode()        {}
+func (s *AstWhile) isNode()         {}
+func (s *AstFor) isNode()           {}
+func (s *AstRangeFor) isNode()      {}
+func (s *AstBreak) isNode()         {}
+func (s *AstContinue) isNode()      {}
 
 func (s *AstConstAssign) isStatement() {}
+func (s *AstVarDecl) isStatement()     {}
+func (s *AstAssign) isStatement()      {}
 func (s *AstFnDecl) isStatement()      {}
 func (s *AstFnCall) isStatement()      {}
+func (s *AstBlock) isStatement()       {}
+func (s *AstIf) isStatement()          {}
+func (s *AstReturn) isStatement()      {}
+func (s *AstWhile) isStatement()       {}
+func (s *AstFor) isStatement()         {}
+func (s *AstRangeFor) isStatement()    {}
+func (s *AstBreak) isStatement()       {}
+func (s *AstContinue) isStatement()    {}
 
 func (s *AstIntLitExpr) isExpr()    {}
 func (s *AstStringLitExpr) isExpr() {}
+func (s *AstBoolLitExpr) isExpr()   {}
 func (s *AstIdent) isExpr()         {}
+func (s *AstBinaryExpr) isExpr()    {}
+func (s *AstUnaryExpr) isExpr()     {}
+func (s *AstFnCall) isExpr()        {}
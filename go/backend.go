@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Backend turns a resolved and type checked module into code for some
+// target. Backends can walk the AST themselves, or lower it with BuildIR
+// and work from the IR like the C backend does.
+type Backend interface {
+	// Name is what the backend is called on the command line
+	Name() string
+	// Ext is the file extension of the generated code, which decides how
+	// it's built: .c files are compiled by the C compiler and .s files
+	// are assembled
+	Ext() string
+	Generate(mod *AstModule, res *Resolution, info *TypeInfo) (string, error)
+}
+
+// IRBackend is a backend that works from the IR, which lets the driver
+// optimise it first. The IR can be in SSA form.
+type IRBackend interface {
+	Backend
+	GenerateIR(m *IrModule) (string, error)
+}
+
+// Backends are all the backends that can be chosen with --backend, the
+// first is the default
+var Backends = []Backend{
+	CBackend{},
+	AsmBackend{},
+	BytecodeBackend{},
+}
+
+// LookupBackend finds the backend called name
+func LookupBackend(name string) (Backend, error) {
+	names := []string{}
+	for _, b := range Backends {
+		if b.Name() == name {
+			return b, nil
+		}
+		names = append(names, b.Name())
+	}
+	return nil, fmt.Errorf("unknown backend %q, expected one of %s", name, strings.Join(names, ", "))
+}
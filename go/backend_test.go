@@ -0,0 +1,17 @@
+package main
+
+import "testing"
+
+func TestLookupBackend(t *testing.T) {
+	for _, b := range Backends {
+		got, err := LookupBackend(b.Name())
+		if err != nil || got != b {
+			t.Errorf("LookupBackend(%q) = %v, %v", b.Name(), got, err)
+		}
+	}
+	_, err := LookupBackend("wasm")
+	want := `unknown backend "wasm", expected one of c, asm, bc`
+	if err == nil || err.Error() != want {
+		t.Errorf("LookupBackend(wasm) error = %v, want %s", err, want)
+	}
+}
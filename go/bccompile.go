@@ -0,0 +1,441 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// BytecodeBackend compiles to bytecode for compy's own VM, the generated
+// "code" is the program in the bytecode file format
+type BytecodeBackend struct{}
+
+func (BytecodeBackend) Name() string {
+	return "bc"
+}
+
+func (BytecodeBackend) Ext() string {
+	return ".bc"
+}
+
+func (BytecodeBackend) Generate(mod *AstModule, res *Resolution, info *TypeInfo) (string, error) {
+	prog, err := CompileBytecode(mod, res, info)
+	if err != nil {
+		return "", err
+	}
+	b, err := prog.MarshalBinary()
+	return string(b), err
+}
+
+type bcCompiler struct {
+	filename string
+	res      *Resolution
+	info     *TypeInfo
+	prog     *Program
+	errs     []error
+
+	strings map[string]int
+	globals map[*Symbol]int
+	funcs   map[*AstFnDecl]int
+	// Functions waiting to be compiled, nested functions are compiled
+	// after the one they're in
+	pending []*AstFnDecl
+
+	// State for the function being compiled
+	decl  *AstFnDecl
+	fn    *BcFunc
+	slots map[*Symbol]int
+	loops []bcLoop
+}
+
+// bcLoop collects the jumps for break and continue, they're patched once
+// the loop has been compiled and where they go is known
+type bcLoop struct {
+	label             *AstIdent
+	breaks, continues []int
+}
+
+// CompileBytecode compiles a checked module to bytecode
+func CompileBytecode(mod *AstModule, res *Resolution, info *TypeInfo) (*Program, error) {
+	c := &bcCompiler{
+		filename: mod.Filename,
+		res:      res,
+		info:     info,
+		prog:     &Program{Module: mod.Name.Name, Filename: mod.Filename, Init: -1, Main: -1},
+		strings:  map[string]int{},
+		globals:  map[*Symbol]int{},
+		funcs:    map[*AstFnDecl]int{},
+	}
+
+	inits := []AstStatement{}
+	for _, st := range mod.Statements {
+		switch n := st.(type) {
+		case *AstFnDecl:
+			i := c.addFunc(n, n.Name.Name)
+			if n.Name.Name == "main" {
+				c.prog.Main = i
+			}
+		case *AstConstAssign:
+			c.global(n.Ident)
+			inits = append(inits, n)
+		case *AstVarDecl:
+			c.global(n.Ident)
+			inits = append(inits, n)
+		}
+	}
+	if len(inits) > 0 {
+		c.prog.Init = len(c.prog.Funcs)
+		c.prog.Funcs = append(c.prog.Funcs, &BcFunc{Name: "<init>"})
+		c.function(nil, c.prog.Funcs[c.prog.Init], func() {
+			for _, st := range inits {
+				c.stmt(st)
+			}
+		})
+	}
+	for len(c.pending) > 0 {
+		fn := c.pending[0]
+		c.pending = c.pending[1:]
+		c.function(fn, c.prog.Funcs[c.funcs[fn]], func() {
+			c.block(fn.Body)
+		})
+	}
+	return c.prog, errors.Join(c.errs...)
+}
+
+func (c *bcCompiler) errorAt(n Node, format string, a ...any) {
+	c.errs = append(c.errs, nodeError(c.filename, n, format, a...))
+}
+
+// addFunc gives a function its place in the program, so it can be called
+// before it's compiled
+func (c *bcCompiler) addFunc(fn *AstFnDecl, name string) int {
+	i := len(c.prog.Funcs)
+	c.prog.Funcs = append(c.prog.Funcs, &BcFunc{Name: name, Params: len(fn.Params)})
+	c.funcs[fn] = i
+	c.pending = append(c.pending, fn)
+	return i
+}
+
+func (c *bcCompiler) global(id *AstIdent) {
+	c.globals[c.res.SymbolOf(id)] = len(c.prog.Globals)
+	c.prog.Globals = append(c.prog.Globals, id.Name)
+}
+
+func (c *bcCompiler) function(decl *AstFnDecl, fn *BcFunc, body func()) {
+	c.decl, c.fn = decl, fn
+	c.slots = map[*Symbol]int{}
+	c.loops = nil
+	if decl != nil {
+		for _, p := range decl.Params {
+			c.slots[c.res.SymbolOf(p.Name)] = c.slot()
+		}
+	}
+	body()
+	// Only void functions can get here, and main which returns 0 like it
+	// does in C
+	c.emit(OpRetVoid)
+}
+
+// slot gives a local somewhere to live
+func (c *bcCompiler) slot() int {
+	c.fn.Locals++
+	return c.fn.Locals - 1
+}
+
+// emit adds an instruction, returning where it is in the code
+func (c *bcCompiler) emit(op Opcode, args ...int) int {
+	if len(args) != op.Operands() {
+		panic(fmt.Sprintf("bytecode: %s takes %d operands, got %d", op, op.Operands(), len(args)))
+	}
+	pc := len(c.fn.Code)
+	c.fn.Code = append(c.fn.Code, byte(op))
+	for _, arg := range args {
+		c.fn.Code = binary.LittleEndian.AppendUint32(c.fn.Code, uint32(int32(arg)))
+	}
+	return pc
+}
+
+// patch points the jump at pc to the next instruction
+func (c *bcCompiler) patch(pc int) {
+	binary.LittleEndian.PutUint32(c.fn.Code[pc+1:], uint32(len(c.fn.Code)))
+}
+
+// line records that the code from here on is for n, so runtime errors
+// can point at it
+func (c *bcCompiler) line(n Node) {
+	span := n.Span()
+	lines := c.fn.Lines
+	if len(lines) > 0 && lines[len(lines)-1].Span == span {
+		return
+	}
+	if len(lines) > 0 && lines[len(lines)-1].PC == len(c.fn.Code) {
+		lines[len(lines)-1].Span = span
+		return
+	}
+	c.fn.Lines = append(lines, BcLine{len(c.fn.Code), span})
+}
+
+func (c *bcCompiler) store(id *AstIdent) {
+	sym := c.res.SymbolOf(id)
+	if g, ok := c.globals[sym]; ok {
+		c.emit(OpGStore, g)
+		return
+	}
+	slot, ok := c.slots[sym]
+	if !ok {
+		slot = c.slot()
+		c.slots[sym] = slot
+	}
+	c.emit(OpStore, slot)
+}
+
+func (c *bcCompiler) load(id *AstIdent) {
+	sym := c.res.SymbolOf(id)
+	if g, ok := c.globals[sym]; ok {
+		c.emit(OpGLoad, g)
+		return
+	}
+	slot, ok := c.slots[sym]
+	if !ok {
+		// The resolver makes sure functions only use their own locals
+		panic(fmt.Sprintf("bytecode: %s isn't a local of the function", id.Name))
+	}
+	c.emit(OpLoad, slot)
+}
+
+func (c *bcCompiler) block(b *AstBlock) {
+	for _, st := range b.Body {
+		c.stmt(st)
+	}
+}
+
+func (c *bcCompiler) stmt(st AstStatement) {
+	c.line(st)
+	switch n := st.(type) {
+	case *AstConstAssign:
+		c.expr(n.Value)
+		c.store(n.Ident)
+	case *AstVarDecl:
+		c.expr(n.Value)
+		c.store(n.Ident)
+	case *AstAssign:
+		c.expr(n.Value)
+		if op, ok := compoundOps[n.Op]; ok {
+			c.load(n.Target)
+			c.emit(OpSwap)
+			c.emit(bcOperators[op])
+		}
+		c.store(n.Target)
+	case *AstFnDecl:
+		// Nested functions are compiled on their own after this one
+		c.addFunc(n, c.fn.Name+"."+n.Name.Name)
+	case *AstFnCall:
+		c.call(n)
+		if c.info.TypeOf(n) != TypVoid {
+			c.emit(OpPop)
+		}
+	case *AstBlock:
+		c.block(n)
+	case *AstIf:
+		c.expr(n.Cond)
+		toElse := c.emit(OpJmpFalse, 0)
+		c.block(n.Then)
+		if n.Else == nil {
+			c.patch(toElse)
+			break
+		}
+		toEnd := c.emit(OpJmp, 0)
+		c.patch(toElse)
+		c.stmt(n.Else)
+		c.patch(toEnd)
+	case *AstWhile:
+		top := len(c.fn.Code)
+		c.expr(n.Cond)
+		exit := c.emit(OpJmpFalse, 0)
+		loop := c.loopBody(n.Label, n.Body)
+		c.patchAll(loop.continues)
+		c.emit(OpJmp, top)
+		c.patch(exit)
+		c.patchAll(loop.breaks)
+	case *AstFor:
+		if n.Init != nil {
+			c.stmt(n.Init)
+		}
+		top := len(c.fn.Code)
+		exit := -1
+		if n.Cond != nil {
+			c.expr(n.Cond)
+			exit = c.emit(OpJmpFalse, 0)
+		}
+		loop := c.loopBody(n.Label, n.Body)
+		c.patchAll(loop.continues)
+		if n.Step != nil {
+			c.stmt(n.Step)
+		}
+		c.emit(OpJmp, top)
+		if exit >= 0 {
+			c.patch(exit)
+		}
+		c.patchAll(loop.breaks)
+	case *AstRangeFor:
+		// The upper bound is only evaluated once
+		c.expr(n.Lo)
+		c.store(n.Var)
+		c.expr(n.Hi)
+		end := c.slot()
+		c.emit(OpStore, end)
+		top := len(c.fn.Code)
+		c.load(n.Var)
+		c.emit(OpLoad, end)
+		c.emit(OpLt)
+		exit := c.emit(OpJmpFalse, 0)
+		loop := c.loopBody(n.Label, n.Body)
+		c.patchAll(loop.continues)
+		c.load(n.Var)
+		c.emit(OpConst, 1)
+		c.emit(OpAdd)
+		c.store(n.Var)
+		c.emit(OpJmp, top)
+		c.patch(exit)
+		c.patchAll(loop.breaks)
+	case *AstBreak:
+		loop := c.loopTarget(n.Label)
+		loop.breaks = append(loop.breaks, c.emit(OpJmp, 0))
+	case *AstContinue:
+		loop := c.loopTarget(n.Label)
+		loop.continues = append(loop.continues, c.emit(OpJmp, 0))
+	case *AstReturn:
+		if n.Value != nil {
+			c.expr(n.Value)
+			c.emit(OpRet)
+		} else {
+			c.emit(OpRetVoid)
+		}
+	default:
+		panic(fmt.Sprintf("bytecode: unhandled statement %T", st))
+	}
+}
+
+func (c *bcCompiler) patchAll(jumps []int) {
+	for _, pc := range jumps {
+		c.patch(pc)
+	}
+}
+
+// loopBody compiles the body of a loop, returning the breaks and
+// continues in it that need patching
+func (c *bcCompiler) loopBody(label *AstIdent, body *AstBlock) bcLoop {
+	c.loops = append(c.loops, bcLoop{label: label})
+	c.block(body)
+	loop := c.loops[len(c.loops)-1]
+	c.loops = c.loops[:len(c.loops)-1]
+	return loop
+}
+
+// loopTarget finds the loop a break or continue refers to, the parser
+// has already made sure there is one
+func (c *bcCompiler) loopTarget(label *AstIdent) *bcLoop {
+	for i := len(c.loops) - 1; i >= 0; i-- {
+		if label == nil || (c.loops[i].label != nil && c.loops[i].label.Name == label.Name) {
+			return &c.loops[i]
+		}
+	}
+	panic("bytecode: break or continue outside of a loop")
+}
+
+var bcOperators = map[TokenKind]Opcode{
+	TokPlus:    OpAdd,
+	TokMinus:   OpSub,
+	TokStar:    OpMul,
+	TokDiv:     OpDiv,
+	TokPercent: OpMod,
+	TokEq:      OpEq,
+	TokNeq:     OpNe,
+	TokLt:      OpLt,
+	TokLte:     OpLe,
+	TokGt:      OpGt,
+	TokGte:     OpGe,
+}
+
+func (c *bcCompiler) expr(e AstExpr) {
+	switch n := e.(type) {
+	case *AstIntLitExpr:
+		c.emit(OpConst, n.Value)
+	case *AstBoolLitExpr:
+		if n.Value {
+			c.emit(OpConst, 1)
+		} else {
+			c.emit(OpConst, 0)
+		}
+	case *AstStringLitExpr:
+		i, ok := c.strings[n.Value]
+		if !ok {
+			i = len(c.prog.Strings)
+			c.strings[n.Value] = i
+			c.prog.Strings = append(c.prog.Strings, n.Value)
+		}
+		c.emit(OpString, i)
+	case *AstIdent:
+		c.load(n)
+	case *AstFnCall:
+		c.call(n)
+	case *AstUnaryExpr:
+		c.expr(n.Expr)
+		if n.Op == TokNot {
+			c.emit(OpNot)
+		} else {
+			c.emit(OpNeg)
+		}
+	case *AstBinaryExpr:
+		c.expr(n.Left)
+		if n.Op == TokAnd || n.Op == TokOr {
+			// The left side is the answer if it decides it, otherwise
+			// it's dropped for the right side
+			c.emit(OpDup)
+			jump := OpJmpFalse
+			if n.Op == TokOr {
+				jump = OpJmpTrue
+			}
+			done := c.emit(jump, 0)
+			c.emit(OpPop)
+			c.expr(n.Right)
+			c.patch(done)
+			return
+		}
+		c.expr(n.Right)
+		c.line(n)
+		c.emit(bcOperators[n.Op])
+	default:
+		panic(fmt.Sprintf("bytecode: unhandled expression %T", e))
+	}
+}
+
+func (c *bcCompiler) call(n *AstFnCall) {
+	for _, arg := range n.Args {
+		c.expr(arg)
+	}
+	sym := c.res.SymbolOf(n.Name)
+	if sym.Kind == SymFn {
+		c.line(n)
+		c.emit(OpCall, c.funcs[sym.Decl.(*AstFnDecl)], len(n.Args))
+		return
+	}
+	builtin := -1
+	for i, name := range Builtins {
+		if name == sym.Name {
+			builtin = i
+		}
+	}
+	if len(n.Args) > 32 {
+		c.errorAt(n, "too many arguments to %s, the most it can take is 32", n.Name.Name)
+		return
+	}
+	// The VM needs to know which arguments are strings to pass them on
+	strs := 0
+	for i, arg := range n.Args {
+		if c.info.TypeOf(arg) == TypString {
+			strs |= 1 << i
+		}
+	}
+	c.emit(OpBuiltin, builtin, len(n.Args), strs)
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// buildOptions control how the generated C is turned into something
+// that can be run or linked into another program
+type buildOptions struct {
+	// Where to write the result, the default is named after the source
+	output string
+	// The C compiler, and any arguments it needs, defaults to $CC or cc
+	cc      string
+	cflags  string
+	ldflags string
+	// The -O level, which picks the IR passes and is passed to the C
+	// compiler
+	opt string
+	// A comma separated list of IR passes to run instead
+	passes string
+	// Which backend generates the code, c, asm or bc
+	backend string
+	// Keep the generated C next to the output instead of deleting it
+	keepC bool
+	// Make an object file, or a static library if output ends in .a,
+	// instead of an executable
+	compileOnly bool
+}
+
+// addCompilerFlags adds the flags for choosing and configuring the C
+// compiler
+func addCompilerFlags(d *driver, fs *flag.FlagSet) {
+	cc := os.Getenv("CC")
+	if cc == "" {
+		cc = "cc"
+	}
+	fs.StringVar(&d.build.cc, "cc", cc, "the C compiler to use, defaults to $CC")
+	fs.StringVar(&d.build.cflags, "cflags", "", "extra flags for the C compiler")
+	fs.StringVar(&d.build.ldflags, "ldflags", "", "extra flags for linking")
+	addOptFlags(d, fs)
+	fs.StringVar(&d.build.backend, "backend", "c", "how code is generated: c to compile through C, asm for x86-64 assembly, or bc for bytecode run by compy's VM")
+}
+
+// addOptFlags adds the flags that choose how the IR is optimised
+func addOptFlags(d *driver, fs *flag.FlagSet) {
+	fs.StringVar(&d.build.opt, "O", "0", "optimisation level: 0, 1, 2, 3 or s, it picks the IR passes and is passed to the C compiler")
+	fs.StringVar(&d.build.passes, "passes", "", "comma separated IR passes to run instead of the ones -O picks, for debugging")
+}
+
+// addRunFlags adds the flags for run, which can interpret a program
+// instead of compiling it
+func addRunFlags(d *driver, fs *flag.FlagSet) {
+	addCompilerFlags(d, fs)
+	fs.BoolVar(&d.interp, "interp", false, "run the program with the interpreter, no C compiler is needed")
+}
+
+// addBuildFlags adds the flags for build, which can choose what it makes
+// on top of how it's compiled
+func addBuildFlags(d *driver, fs *flag.FlagSet) {
+	addCompilerFlags(d, fs)
+	fs.StringVar(&d.build.output, "o", "", "the output file, defaults to the name of the source without .b (or with .o for -c)")
+	fs.BoolVar(&d.build.keepC, "keep-c", false, "keep the generated C (or assembly) source, it's written next to the output with a .c (or .s) extension")
+	fs.BoolVar(&d.build.compileOnly, "c", false, "make an object file instead of an executable, or a static library if the output ends in .a")
+}
+
+var optLevels = map[string]bool{"0": true, "1": true, "2": true, "3": true, "s": true}
+
+func (o *buildOptions) validate() error {
+	if o.opt != "" && !optLevels[o.opt] {
+		return fmt.Errorf("unknown optimisation level -O%s, expected 0, 1, 2, 3 or s", o.opt)
+	}
+	if o.passes != "" {
+		if _, err := LookupPasses(o.passes); err != nil {
+			return err
+		}
+	}
+	if o.backend != "" {
+		b, err := LookupBackend(o.backend)
+		if err != nil {
+			return err
+		}
+		if _, ok := b.(IRBackend); !ok && o.passes != "" {
+			return fmt.Errorf("--passes can't be used with --backend=%s, it doesn't use the IR", o.backend)
+		}
+	}
+	if o.compileOnly && o.backend == "bc" {
+		return fmt.Errorf("-c can't be used with --backend=bc, bytecode isn't compiled any further")
+	}
+	if o.compileOnly && o.ldflags != "" {
+		return fmt.Errorf("-ldflags can't be used with -c, nothing is linked")
+	}
+	return nil
+}
+
+var optFlagRe = regexp.MustCompile(`^--?O([0-9a-z]+)$`)
+
+// optFlags lets -O levels be written like they are for cc, turning -O2
+// into -O=2 which the flag package understands. Only the flags are
+// rewritten, not the arguments after them.
+func optFlags(fs *flag.FlagSet, args []string) []string {
+	out := []string{}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" || !strings.HasPrefix(arg, "-") {
+			return append(out, args[i:]...)
+		}
+		if m := optFlagRe.FindStringSubmatch(arg); m != nil {
+			arg = "-O=" + m[1]
+		}
+		out = append(out, arg)
+		// Skip over the value of a flag like -o out
+		name := strings.TrimLeft(arg, "-")
+		if f := fs.Lookup(name); f != nil && !strings.Contains(name, "=") && !isBoolFlag(f) && i+1 < len(args) {
+			i++
+			out = append(out, args[i])
+		}
+	}
+	return out
+}
+
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// compile builds filename into an executable, object file or static
+// library as the build options say
+func (d *driver) compile(filename string) error {
+	o := d.build
+	backend, err := LookupBackend(o.backend)
+	if err != nil {
+		return err
+	}
+	code, err := d.generate(filename, backend)
+	if err != nil {
+		return err
+	}
+	output := o.output
+	if backend.Ext() == ".bc" {
+		// Bytecode is run by compy itself, there's nothing more to do
+		if output == "" {
+			output = baseName(filename) + ".bc"
+		}
+		d.logf(1, "writing %s\n", output)
+		return os.WriteFile(output, []byte(code), 0644)
+	}
+	if output == "" {
+		output = baseName(filename)
+		if o.compileOnly {
+			output += ".o"
+		}
+	}
+	library := o.compileOnly && strings.HasSuffix(output, ".a")
+
+	// Anything in between goes in here
+	dir, err := os.MkdirTemp("", "compy")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir) // clean up
+	object := filepath.Join(dir, baseName(filename)+".o")
+
+	ext := backend.Ext()
+	srcFile := filepath.Join(dir, baseName(filename)+ext)
+	if o.keepC {
+		srcFile = strings.TrimSuffix(output, filepath.Ext(output)) + ext
+		if srcFile == output {
+			srcFile += ext
+		}
+	}
+	if err := os.WriteFile(srcFile, []byte(code), 0644); err != nil {
+		return err
+	}
+	d.logf(1, "generated source: %s\n", srcFile)
+
+	// What's made before it goes in a library
+	made := output
+	if library {
+		made = object
+	}
+	cc := strings.Fields(o.cc)
+	if len(cc) == 0 {
+		return fmt.Errorf("no C compiler given")
+	}
+	link := func(inputs ...string) error {
+		args := append(cc[1:], "-O"+o.opt, "-g")
+		args = append(args, strings.Fields(o.cflags)...)
+		if o.compileOnly {
+			args = append(args, "-c")
+		}
+		args = append(args, "-o", made)
+		args = append(args, inputs...)
+		args = append(args, strings.Fields(o.ldflags)...)
+		return d.runTool(cc[0], args...)
+	}
+
+	if ext == ".s" {
+		as := os.Getenv("AS")
+		if as == "" {
+			as = "as"
+		}
+		if o.compileOnly {
+			err = d.runTool(as, "-o", made, srcFile)
+		} else if err = d.runTool(as, "-o", object, srcFile); err == nil {
+			err = link(object)
+		}
+	} else {
+		err = link(srcFile)
+	}
+	if err != nil {
+		return err
+	}
+
+	if library {
+		// ar adds to an existing archive, start from scratch so nothing
+		// stale is left in it
+		if err := os.Remove(output); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		ar := os.Getenv("AR")
+		if ar == "" {
+			ar = "ar"
+		}
+		return d.runTool(ar, "rcs", output, made)
+	}
+	return nil
+}
+
+// runTool runs an external program, its output is only shown if it fails
+// or at verbosity 1
+func (d *driver) runTool(name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	d.logf(1, "%s\n", cmd)
+	out, err := cmd.CombinedOutput()
+	if len(out) > 0 {
+		d.logf(1, "======= %s Output =======\n%s\n", filepath.Base(name), out)
+	}
+	if err != nil {
+		return fmt.Errorf("running %s: %v\n%s", filepath.Base(name), err, out)
+	}
+	return nil
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+)
+
+// The bytecode is for a simple stack machine, see vm.go. Every value is
+// an int64: ints are kept sign extended from 32 bits like they are with
+// the asm backend, bools are 0 or 1 and strings are indexes into the
+// program's string table.
+//
+// An instruction is an Opcode byte followed by its operands, each a
+// little endian int32. Jumps are to offsets in the function's code.
+
+type Opcode byte
+
+const (
+	OpConst  Opcode = iota // n: push n
+	OpString               // i: push string i
+	OpLoad                 // slot: push a local
+	OpStore                // slot: pop into a local
+	OpGLoad                // g: push a global
+	OpGStore               // g: pop into a global
+	OpPop                  // drop the top of the stack
+	OpDup                  // push the top of the stack again
+	OpSwap                 // swap the top two values
+	OpAdd                  // the arithmetic and comparisons pop the right
+	OpSub                  // operand and then the left, and push the result
+	OpMul
+	OpDiv
+	OpMod
+	OpEq
+	OpNe
+	OpLt
+	OpLe
+	OpGt
+	OpGe
+	OpNeg
+	OpNot
+	OpJmp      // pc: jump to pc
+	OpJmpFalse // pc: pop, and jump if it is false
+	OpJmpTrue  // pc: pop, and jump if it is true
+	OpCall     // f, n: call function f with the n arguments on the stack
+	OpBuiltin  // b, n, strs: call Builtins[b], strs has bit i set if argument i is a string
+	OpRet      // return the top of the stack
+	OpRetVoid  // return nothing
+)
+
+var opcodes = []struct {
+	name     string
+	operands int
+}{
+	OpConst:    {"const", 1},
+	OpString:   {"string", 1},
+	OpLoad:     {"load", 1},
+	OpStore:    {"store", 1},
+	OpGLoad:    {"gload", 1},
+	OpGStore:   {"gstore", 1},
+	OpPop:      {"pop", 0},
+	OpDup:      {"dup", 0},
+	OpSwap:     {"swap", 0},
+	OpAdd:      {"add", 0},
+	OpSub:      {"sub", 0},
+	OpMul:      {"mul", 0},
+	OpDiv:      {"div", 0},
+	OpMod:      {"mod", 0},
+	OpEq:       {"eq", 0},
+	OpNe:       {"ne", 0},
+	OpLt:       {"lt", 0},
+	OpLe:       {"le", 0},
+	OpGt:       {"gt", 0},
+	OpGe:       {"ge", 0},
+	OpNeg:      {"neg", 0},
+	OpNot:      {"not", 0},
+	OpJmp:      {"jmp", 1},
+	OpJmpFalse: {"jmpfalse", 1},
+	OpJmpTrue:  {"jmptrue", 1},
+	OpCall:     {"call", 2},
+	OpBuiltin:  {"builtin", 3},
+	OpRet:      {"ret", 0},
+	OpRetVoid:  {"retvoid", 0},
+}
+
+func (op Opcode) String() string {
+	if int(op) < len(opcodes) {
+		return opcodes[op].name
+	}
+	return fmt.Sprintf("Opcode(%d)", int(op))
+}
+
+// Operands is how many operands follow op
+func (op Opcode) Operands() int {
+	return opcodes[op].operands
+}
+
+// Program is a compiled module
+type Program struct {
+	Module string
+	// The file it was compiled from, for errors
+	Filename string
+	Strings  []string
+	// The names of the globals, only kept for disassembly
+	Globals []string
+	Funcs   []*BcFunc
+	// Indexes into Funcs, Init sets the globals before Main runs. Either
+	// is -1 if there isn't one.
+	Init, Main int
+}
+
+// BcFunc is a compiled function. Its locals live in slots numbered from
+// 0, starting with the parameters.
+type BcFunc struct {
+	Name   string
+	Params int
+	Locals int
+	Code   []byte
+	// Where the code for each statement, call or operator starts, in
+	// order of PC
+	Lines []BcLine
+}
+
+type BcLine struct {
+	PC   int
+	Span Span
+}
+
+// Span returns the part of the source the code at pc came from, a zero
+// Span if it's unknown
+func (f *BcFunc) Span(pc int) Span {
+	span := Span{}
+	for _, l := range f.Lines {
+		if l.PC > pc {
+			break
+		}
+		span = l.Span
+	}
+	return span
+}
+
+// Line returns the source line the code at pc came from, 0 if unknown
+func (f *BcFunc) Line(pc int) int {
+	return int(f.Span(pc).Start.Line)
+}
+
+// operand reads the operand starting at pc
+func (f *BcFunc) operand(pc int) int {
+	return int(int32(binary.LittleEndian.Uint32(f.Code[pc:])))
+}
+
+// Disassemble writes a readable listing of the program
+func (p *Program) Disassemble(w io.Writer) {
+	fmt.Fprintf(w, "module %s\n", p.Module)
+	for i, s := range p.Strings {
+		fmt.Fprintf(w, "string %d %s\n", i, cStringLiteral(s))
+	}
+	for i, g := range p.Globals {
+		fmt.Fprintf(w, "global %d %s\n", i, g)
+	}
+	for i, f := range p.Funcs {
+		fmt.Fprintf(w, "\nfunc %d %s params=%d locals=%d", i, f.Name, f.Params, f.Locals)
+		switch i {
+		case p.Init:
+			fmt.Fprint(w, " init")
+		case p.Main:
+			fmt.Fprint(w, " main")
+		}
+		fmt.Fprintln(w)
+		line := 0
+		for pc := 0; pc < len(f.Code); {
+			op := Opcode(f.Code[pc])
+			if l := f.Line(pc); l != line {
+				line = l
+				fmt.Fprintf(w, "%4d ", line)
+			} else {
+				fmt.Fprint(w, "     ")
+			}
+			fmt.Fprintf(w, "%5d  %s", pc, op)
+			if op.Operands() > 0 {
+				args := []string{}
+				for i := 0; i < op.Operands(); i++ {
+					args = append(args, fmt.Sprint(f.operand(pc+1+4*i)))
+				}
+				fmt.Fprintf(w, "%*s%s", 9-len(op.String()), "", strings.Join(args, " "))
+			}
+			if comment := p.comment(f, pc); comment != "" {
+				fmt.Fprintf(w, "  ; %s", comment)
+			}
+			fmt.Fprintln(w)
+			pc += 1 + 4*op.Operands()
+		}
+	}
+}
+
+// comment says what an instruction's operands refer to
+func (p *Program) comment(f *BcFunc, pc int) string {
+	arg := func(i int) int { return f.operand(pc + 1 + 4*i) }
+	switch op := Opcode(f.Code[pc]); op {
+	case OpString:
+		if i := arg(0); i < len(p.Strings) {
+			return cStringLiteral(p.Strings[i])
+		}
+	case OpGLoad, OpGStore:
+		if i := arg(0); i < len(p.Globals) {
+			return p.Globals[i]
+		}
+	case OpCall:
+		if i := arg(0); i < len(p.Funcs) {
+			return p.Funcs[i].Name
+		}
+	case OpBuiltin:
+		if i := arg(0); i < len(Builtins) {
+			return Builtins[i]
+		}
+	}
+	return ""
+}
+
+// The file format starts with bcMagic and a version byte, the rest is the
+// Program written as unsigned varints, with strings as their length and
+// then their bytes. Code is written as it is.
+const (
+	bcMagic   = "compy bc"
+	bcVersion = 2
+)
+
+// MarshalBinary encodes the program in the bytecode file format
+func (p *Program) MarshalBinary() ([]byte, error) {
+	b := []byte(bcMagic)
+	b = append(b, bcVersion)
+	num := func(n int) { b = binary.AppendUvarint(b, uint64(n)) }
+	str := func(s string) {
+		num(len(s))
+		b = append(b, s...)
+	}
+	str(p.Module)
+	str(p.Filename)
+	num(len(p.Strings))
+	for _, s := range p.Strings {
+		str(s)
+	}
+	num(len(p.Globals))
+	for _, g := range p.Globals {
+		str(g)
+	}
+	num(len(p.Funcs))
+	for _, f := range p.Funcs {
+		str(f.Name)
+		num(f.Params)
+		num(f.Locals)
+		str(string(f.Code))
+		num(len(f.Lines))
+		for _, l := range f.Lines {
+			num(l.PC)
+			for _, pos := range []Pos{l.Span.Start, l.Span.End} {
+				num(int(pos.Line))
+				num(int(pos.Col))
+				num(pos.Offset)
+			}
+		}
+	}
+	// -1 is written as 0
+	num(p.Init + 1)
+	num(p.Main + 1)
+	return b, nil
+}
+
+var errBadBytecode = errors.New("not a compy bytecode file")
+
+// UnmarshalBinary decodes a program written by MarshalBinary, checking
+// that the code in it is well formed
+func (p *Program) UnmarshalBinary(data []byte) error {
+	if !strings.HasPrefix(string(data), bcMagic) || len(data) <= len(bcMagic) {
+		return errBadBytecode
+	}
+	if v := data[len(bcMagic)]; v != bcVersion {
+		return fmt.Errorf("unsupported bytecode version %d, expected %d", v, bcVersion)
+	}
+	data = data[len(bcMagic)+1:]
+
+	truncated := false
+	num := func() int {
+		n, size := binary.Uvarint(data)
+		if size <= 0 || n > math.MaxInt32 {
+			truncated = true
+			data = nil
+			return 0
+		}
+		data = data[size:]
+		return int(n)
+	}
+	str := func() string {
+		n := num()
+		if n > len(data) {
+			truncated = true
+			data = nil
+			return ""
+		}
+		s := string(data[:n])
+		data = data[n:]
+		return s
+	}
+	// Counts are limited by what's left so a bad one can't allocate much
+	count := func() int {
+		return min(num(), len(data))
+	}
+
+	*p = Program{Module: str(), Filename: str()}
+	for i := count(); i > 0; i-- {
+		p.Strings = append(p.Strings, str())
+	}
+	for i := count(); i > 0; i-- {
+		p.Globals = append(p.Globals, str())
+	}
+	for i := count(); i > 0; i-- {
+		f := &BcFunc{Name: str(), Params: num(), Locals: num(), Code: []byte(str())}
+		for j := count(); j > 0; j-- {
+			l := BcLine{PC: num()}
+			for _, pos := range []*Pos{&l.Span.Start, &l.Span.End} {
+				*pos = Pos{uint(num()), uint(num()), num()}
+			}
+			f.Lines = append(f.Lines, l)
+		}
+		p.Funcs = append(p.Funcs, f)
+	}
+	p.Init = num() - 1
+	p.Main = num() - 1
+	if truncated {
+		return fmt.Errorf("%w, it is truncated", errBadBytecode)
+	}
+	if len(data) != 0 {
+		return fmt.Errorf("%w, %d bytes left over", errBadBytecode, len(data))
+	}
+	return p.verify()
+}
+
+// verify checks that the code only refers to things that exist, so the VM
+// doesn't have to
+func (p *Program) verify() error {
+	if p.Init >= len(p.Funcs) || p.Main >= len(p.Funcs) {
+		return fmt.Errorf("%w, entry point out of range", errBadBytecode)
+	}
+	for _, f := range p.Funcs {
+		bad := func(pc int, format string, a ...any) error {
+			return fmt.Errorf("%w, %s at %d: %s", errBadBytecode, f.Name, pc, fmt.Sprintf(format, a...))
+		}
+		if f.Params > f.Locals {
+			return bad(0, "more parameters than locals")
+		}
+		// Find where the instructions start first, jumps must go to one
+		starts := map[int]bool{}
+		last := -1
+		for pc := 0; pc < len(f.Code); {
+			op := Opcode(f.Code[pc])
+			if int(op) >= len(opcodes) {
+				return bad(pc, "unknown opcode %d", op)
+			}
+			starts[pc] = true
+			last = pc
+			pc += 1 + 4*op.Operands()
+			if pc > len(f.Code) {
+				return bad(last, "truncated instruction")
+			}
+		}
+		if last < 0 {
+			return bad(0, "no code")
+		}
+		switch Opcode(f.Code[last]) {
+		case OpRet, OpRetVoid, OpJmp:
+		default:
+			return bad(last, "code runs off the end")
+		}
+		for pc := 0; pc < len(f.Code); pc += 1 + 4*Opcode(f.Code[pc]).Operands() {
+			arg := func(i int) int { return f.operand(pc + 1 + 4*i) }
+			switch op := Opcode(f.Code[pc]); op {
+			case OpString:
+				if arg(0) < 0 || arg(0) >= len(p.Strings) {
+					return bad(pc, "string %d out of range", arg(0))
+				}
+			case OpLoad, OpStore:
+				if arg(0) < 0 || arg(0) >= f.Locals {
+					return bad(pc, "local %d out of range", arg(0))
+				}
+			case OpGLoad, OpGStore:
+				if arg(0) < 0 || arg(0) >= len(p.Globals) {
+					return bad(pc, "global %d out of range", arg(0))
+				}
+			case OpJmp, OpJmpFalse, OpJmpTrue:
+				if !starts[arg(0)] {
+					return bad(pc, "jump to %d isn't to an instruction", arg(0))
+				}
+			case OpCall:
+				if arg(0) < 0 || arg(0) >= len(p.Funcs) || p.Funcs[arg(0)].Params != arg(1) {
+					return bad(pc, "bad call to function %d with %d arguments", arg(0), arg(1))
+				}
+			case OpBuiltin:
+				if arg(0) < 0 || arg(0) >= len(Builtins) || arg(1) < 1 || arg(1) > 32 {
+					return bad(pc, "bad call to builtin %d with %d arguments", arg(0), arg(1))
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// compileSrc checks src and compiles it to bytecode
+func compileSrc(t *testing.T, src string) (*Program, error) {
+	t.Helper()
+	mod, res, info, err := checkSrc(t, src)
+	if err != nil {
+		t.Fatalf("checking %q: %v", src, err)
+	}
+	return CompileBytecode(mod, res, info)
+}
+
+func TestBytecodeVM(t *testing.T) {
+	for _, tc := range backendCases {
+		src := backendPrelude + "fn main(): int {\n" + tc.body + "\n}\n"
+		prog, err := compileSrc(t, src)
+		if err != nil {
+			t.Fatalf("compiling %q: %v", tc.body, err)
+		}
+		// Everything should survive being written to a file
+		data, err := prog.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		loaded := &Program{}
+		if err := loaded.UnmarshalBinary(data); err != nil {
+			t.Fatalf("loading %q: %v", tc.body, err)
+		}
+		if !reflect.DeepEqual(prog, loaded) {
+			t.Errorf("%q changed when written and loaded:\n%#v\n%#v", tc.body, prog, loaded)
+		}
+		out := bytes.Buffer{}
+		code, err := RunBytecode(loaded, &out)
+		if err != nil || out.String() != tc.out || code != tc.code {
+			t.Errorf("running %q: expected %q and status %d, got %q, %d and %v", tc.body, tc.out, tc.code, out.String(), code, err)
+		}
+	}
+}
+
+func TestBytecodeErrors(t *testing.T) {
+	cases := []struct {
+		src  string
+		want string
+	}{
+		{"module m;\nfn main(): int {\n\tlet z = 0;\n\treturn 1 / z;\n}\n", "<filename>:4:9  integer division by zero"},
+		{"module m;\nfn main(): int {\n\tvar z = 0;\n\tz %= z;\n\treturn z;\n}\n", "<filename>:4:2  integer division by zero"},
+		{"module m;\nfn f(n: int): int { return f(n + 1); }\nfn main(): int { return f(0); }\n", "<filename>:2:28  stack overflow, calls are nested more than 1048576 deep"},
+		{"module m;\nfn other(): void {}\n", "<filename>: module m has no main function to run"},
+	}
+	for _, tc := range cases {
+		prog, err := compileSrc(t, tc.src)
+		if err != nil {
+			t.Fatalf("compiling %q: %v", tc.src, err)
+		}
+		_, err = RunBytecode(prog, &bytes.Buffer{})
+		var perr ParseError
+		if !errors.As(err, &perr) || perr.Code != CodeRuntime || err.Error() != tc.want {
+			t.Errorf("running %q: expected %s %q got %v", tc.src, CodeRuntime, tc.want, err)
+		}
+	}
+}
+
+func TestDisassemble(t *testing.T) {
+	src := `module m;
+let hi = "hi";
+fn main(): int {
+	for i in 0..3 {
+		puts(hi);
+	}
+	return 0;
+}
+`
+	prog, err := compileSrc(t, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := strings.Builder{}
+	prog.Disassemble(&out)
+	want := `module m
+string 0 "hi"
+global 0 hi
+
+func 0 main params=0 locals=2 main
+   4     0  const    0
+         5  store    0
+        10  const    3
+        15  store    1
+        20  load     0
+        25  load     1
+        30  lt
+        31  jmpfalse 76
+   5    36  gload    0  ; hi
+        41  builtin  1 1 1  ; puts
+        54  pop
+        55  load     0
+        60  const    1
+        65  add
+        66  store    0
+        71  jmp      20
+   7    76  const    0
+        81  ret
+        82  retvoid
+
+func 1 <init> params=0 locals=0 init
+   2     0  string   0  ; "hi"
+         5  gstore   0  ; hi
+        10  retvoid
+`
+	if out.String() != want {
+		t.Errorf("expected\n%s\ngot\n%s", want, out.String())
+	}
+}
+
+func TestBytecodeBadFiles(t *testing.T) {
+	prog, err := compileSrc(t, "module m;\nfn main(): int { return 1 + 2; }\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	good, _ := prog.MarshalBinary()
+	corrupt := func(f func(p *Program)) []byte {
+		p := *prog
+		p.Funcs = []*BcFunc{{Name: "main", Code: append([]byte{}, prog.Funcs[0].Code...)}}
+		f(&p)
+		b, _ := p.MarshalBinary()
+		return b
+	}
+	cases := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"empty", nil, "not a compy bytecode file"},
+		{"not bytecode", []byte("module m;"), "not a compy bytecode file"},
+		{"version", append([]byte(bcMagic), 99), "unsupported bytecode version 99, expected 2"},
+		{"truncated", good[:len(good)-3], "not a compy bytecode file, it is truncated"},
+		{"extra", append(append([]byte{}, good...), 0), "not a compy bytecode file, 1 bytes left over"},
+		{"opcode", corrupt(func(p *Program) { p.Funcs[0].Code[0] = 200 }), "not a compy bytecode file, main at 0: unknown opcode 200"},
+		{"local", corrupt(func(p *Program) { p.Funcs[0].Code = []byte{byte(OpLoad), 1, 0, 0, 0, byte(OpRet)} }), "not a compy bytecode file, main at 0: local 1 out of range"},
+		{"jump", corrupt(func(p *Program) { p.Funcs[0].Code = []byte{byte(OpJmp), 2, 0, 0, 0} }), "not a compy bytecode file, main at 0: jump to 2 isn't to an instruction"},
+		{"off the end", corrupt(func(p *Program) { p.Funcs[0].Code = []byte{byte(OpConst), 2, 0, 0, 0} }), "not a compy bytecode file, main at 0: code runs off the end"},
+	}
+	for _, tc := range cases {
+		err := (&Program{}).UnmarshalBinary(tc.data)
+		if err == nil || err.Error() != tc.want {
+			t.Errorf("%s: expected %q got %v", tc.name, tc.want, err)
+		}
+		if err != nil && !errors.Is(err, errBadBytecode) && tc.name != "version" {
+			t.Errorf("%s: expected errBadBytecode, got %v", tc.name, err)
+		}
+	}
+}
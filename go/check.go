@@ -0,0 +1,443 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// CheckReturns makes sure that every function with a non-void return type
+// returns a value on every path through its body, and that returns agree
+// with the declared type about whether they carry a value.
+func CheckReturns(mod *AstModule) error {
+	errs := []error{}
+	for _, st := range mod.Statements {
+		fn, ok := st.(*AstFnDecl)
+		if !ok {
+			continue
+		}
+		errs = append(errs, checkFnReturns(mod.Filename, fn)...)
+	}
+	return errors.Join(errs...)
+}
+
+func checkFnReturns(filename string, fn *AstFnDecl) []error {
+	isVoid := fn.ReturnType.Name.Name == "void"
+	errs := []error{}
+	fnError := func(label Label, format string, a ...any) {
+		err := nodeError(filename, fn.Name, format, a...)
+		err.Code = CodeReturn
+		err.Labels = []Label{label}
+		errs = append(errs, err)
+	}
+
+	var checkStmt func(st AstStatement)
+	checkStmt = func(st AstStatement) {
+		switch n := st.(type) {
+		case *AstReturn:
+			if isVoid && n.Value != nil {
+				fnError(Label{n.Span(), "returns a value here"}, "function %s returns void but a return has a value", fn.Name.Name)
+			} else if !isVoid && n.Value == nil {
+				fnError(Label{n.Span(), "returns without a value here"}, "function %s must return a value of type %s", fn.Name.Name, fn.ReturnType.Name.Name)
+			}
+		case *AstBlock:
+			for _, s := range n.Body {
+				checkStmt(s)
+			}
+		case *AstIf:
+			checkStmt(n.Then)
+			if n.Else != nil {
+				checkStmt(n.Else)
+			}
+		case *AstWhile:
+			checkStmt(n.Body)
+		case *AstFor:
+			checkStmt(n.Body)
+		case *AstRangeFor:
+			checkStmt(n.Body)
+		}
+	}
+	checkStmt(fn.Body)
+
+	if !isVoid && !alwaysReturns(fn.Body) {
+		// Point at the closing brace
+		end := fn.Body.Span().End
+		brace := Span{Pos{end.Line, end.Col - 1, end.Offset - 1}, end}
+		fnError(Label{brace, "can reach the end of the function without returning"}, "function %s is missing a return, it must return a value of type %s on every path", fn.Name.Name, fn.ReturnType.Name.Name)
+	}
+	return errs
+}
+
+// alwaysReturns reports if every path through st ends in a return
+func alwaysReturns(st AstStatement) bool {
+	switch n := st.(type) {
+	case *AstReturn:
+		return true
+	case *AstBlock:
+		for _, s := range n.Body {
+			if alwaysReturns(s) {
+				return true
+			}
+		}
+	case *AstIf:
+		return n.Else != nil && alwaysReturns(n.Then) && alwaysReturns(n.Else)
+	}
+	return false
+}
+
+// TypeInfo records the types worked out by Check
+type TypeInfo struct {
+	// The type of every expression
+	Types map[AstExpr]*Type
+	// The type of every declared symbol
+	Defs map[*Symbol]*Type
+	// The values of the module level lets worked out at compile time
+	Consts map[*Symbol]*IrConst
+}
+
+// TypeOf returns the type of an expression, TypInvalid if it wasn't checked
+func (ti *TypeInfo) TypeOf(e AstExpr) *Type {
+	if t, ok := ti.Types[e]; ok {
+		return t
+	}
+	return TypInvalid
+}
+
+type checker struct {
+	filename string
+	res      *Resolution
+	info     *TypeInfo
+	errs     []error
+	// The function being checked, nil at the module level
+	fn     *AstFnDecl
+	fnType *Type
+}
+
+// Check type checks a resolved module. Declarations must agree with their
+// initialisers, calls with the signature of the function being called
+// and returns with the enclosing function's return type.
+func Check(mod *AstModule, res *Resolution) (*TypeInfo, error) {
+	c := newChecker(mod, res)
+	// Functions can be called before they are declared, so work out all
+	// their signatures up front
+	for _, st := range mod.Statements {
+		if fn, ok := st.(*AstFnDecl); ok {
+			c.declareFn(fn)
+		}
+	}
+	for _, st := range mod.Statements {
+		switch st.(type) {
+		case *AstConstAssign, *AstVarDecl, *AstFnDecl:
+		default:
+			c.errorAt(st, CodeTopLevel, "only declarations are allowed at the module level")
+		}
+		c.stmt(st)
+		c.fold(st)
+	}
+	return c.info, errors.Join(c.errs...)
+}
+
+func newChecker(mod *AstModule, res *Resolution) *checker {
+	return &checker{
+		filename: mod.Filename,
+		res:      res,
+		info: &TypeInfo{
+			Types:  map[AstExpr]*Type{},
+			Defs:   map[*Symbol]*Type{},
+			Consts: map[*Symbol]*IrConst{},
+		},
+	}
+}
+
+func (c *checker) errorAt(n Node, code string, format string, a ...any) {
+	err := nodeError(c.filename, n, format, a...)
+	err.Code = code
+	c.errs = append(c.errs, err)
+}
+
+// lookupType turns the name of a type into a Type
+func (c *checker) lookupType(t *AstType) *Type {
+	if typ, ok := BuiltinTypes[t.Name.Name]; ok {
+		return typ
+	}
+	c.errorAt(t.Name, CodeUnknownType, "unknown type %s", t.Name.Name)
+	return TypInvalid
+}
+
+// valueType is lookupType for the type of a declaration, which can't be void
+func (c *checker) valueType(t *AstType, what string, name *AstIdent) *Type {
+	typ := c.lookupType(t)
+	if typ == TypVoid {
+		c.errorAt(t.Name, CodeType, "%s %s can't have type void", what, name.Name)
+		return TypInvalid
+	}
+	return typ
+}
+
+// decl checks a let or var declaration. When there is no type annotation
+// the type is inferred from the initialiser and returned as a new AstType,
+// so code generation can treat it the same as a written one.
+func (c *checker) decl(id *AstIdent, typ *AstType, value AstExpr, what string) *AstType {
+	if typ != nil {
+		t := c.valueType(typ, what, id)
+		c.expectExpr(value, t, "declaration of "+id.Name)
+		c.define(id, t)
+		return typ
+	}
+	t := c.expr(value)
+	if t == TypVoid {
+		c.errorAt(value, CodeType, "cannot use void value to initialise %s %s", what, id.Name)
+		t = TypInvalid
+	}
+	c.define(id, t)
+	return &AstType{node: id.node, Name: &AstIdent{node: id.node, Name: t.Name}}
+}
+
+func (c *checker) define(id *AstIdent, t *Type) {
+	if sym := c.res.SymbolOf(id); sym != nil {
+		c.info.Defs[sym] = t
+	}
+}
+
+func (c *checker) declareFn(fn *AstFnDecl) *Type {
+	params := []*Type{}
+	for _, p := range fn.Params {
+		params = append(params, c.valueType(p.Type, "parameter", p.Name))
+	}
+	t := NewFnType(params, c.lookupType(fn.ReturnType), false)
+	c.define(fn.Name, t)
+	return t
+}
+
+// symType returns the type of the symbol id refers to
+func (c *checker) symType(id *AstIdent) *Type {
+	sym := c.res.SymbolOf(id)
+	if sym == nil {
+		return TypInvalid
+	}
+	if t, ok := c.info.Defs[sym]; ok {
+		return t
+	}
+	if sym.Kind == SymBuiltin {
+		if t, ok := BuiltinFns[sym.Name]; ok {
+			return t
+		}
+	}
+	return TypInvalid
+}
+
+func (c *checker) stmt(st AstStatement) {
+	switch n := st.(type) {
+	case *AstConstAssign:
+		n.Type = c.decl(n.Ident, n.Type, n.Value, "constant")
+	case *AstVarDecl:
+		n.Type = c.decl(n.Ident, n.Type, n.Value, "variable")
+	case *AstAssign:
+		t := c.symType(n.Target)
+		if n.Op == TokAssign {
+			c.expectExpr(n.Value, t, "assignment to "+n.Target.Name)
+			break
+		}
+		if !AssignableTo(t, TypInt) {
+			c.errorAt(n.Target, CodeOperator, "operator %s not defined for %s (type %s)", cAssignOperators[n.Op], n.Target.Name, t)
+		}
+		c.expectExpr(n.Value, TypInt, "assignment to "+n.Target.Name)
+	case *AstFnDecl:
+		c.fnDecl(n)
+	case *AstFnCall:
+		c.expr(n)
+	case *AstBlock:
+		c.block(n)
+	case *AstIf:
+		c.cond(n.Cond, "if statement")
+		c.block(n.Then)
+		if n.Else != nil {
+			c.stmt(n.Else)
+		}
+	case *AstWhile:
+		c.cond(n.Cond, "while loop")
+		c.block(n.Body)
+	case *AstFor:
+		if n.Init != nil {
+			c.stmt(n.Init)
+		}
+		if n.Cond != nil {
+			c.cond(n.Cond, "for loop")
+		}
+		if n.Step != nil {
+			c.stmt(n.Step)
+		}
+		c.block(n.Body)
+	case *AstRangeFor:
+		c.expectExpr(n.Lo, TypInt, "range start")
+		c.expectExpr(n.Hi, TypInt, "range end")
+		c.define(n.Var, TypInt)
+		c.block(n.Body)
+	case *AstReturn:
+		if c.fn == nil {
+			c.errorAt(n, CodeReturn, "return outside of a function")
+			break
+		}
+		if n.Value == nil {
+			break
+		}
+		if c.fnType.Result == TypVoid {
+			// checkFnReturns complains about this
+			c.expr(n.Value)
+			break
+		}
+		c.expectExpr(n.Value, c.fnType.Result, "return from "+c.fn.Name.Name)
+	case *AstBreak, *AstContinue:
+	default:
+		panic(fmt.Sprintf("check: unhandled statement %T", st))
+	}
+}
+
+func (c *checker) block(b *AstBlock) {
+	for _, st := range b.Body {
+		c.stmt(st)
+	}
+}
+
+func (c *checker) fnDecl(fn *AstFnDecl) {
+	t := c.symType(fn.Name)
+	if t.Kind != TypeFn {
+		// Nested functions are only declared when we reach them
+		t = c.declareFn(fn)
+	}
+	for i, p := range fn.Params {
+		c.define(p.Name, t.Params[i])
+	}
+	outerFn, outerType := c.fn, c.fnType
+	c.fn, c.fnType = fn, t
+	c.block(fn.Body)
+	c.fn, c.fnType = outerFn, outerType
+	c.errs = append(c.errs, checkFnReturns(c.filename, fn)...)
+}
+
+func (c *checker) cond(e AstExpr, what string) {
+	t := c.expr(e)
+	if !AssignableTo(t, TypBool) {
+		c.errorAt(e, CodeType, "non-bool condition (type %s) in %s", t, what)
+	}
+}
+
+// expectExpr checks e and makes sure it can be used as a value of type t
+func (c *checker) expectExpr(e AstExpr, t *Type, context string) {
+	v := c.expr(e)
+	if !AssignableTo(v, t) {
+		c.errorAt(e, CodeType, "cannot use %s value as %s in %s", v, t, context)
+	}
+}
+
+func (c *checker) expr(e AstExpr) *Type {
+	t := c.exprType(e)
+	c.info.Types[e] = t
+	return t
+}
+
+func (c *checker) exprType(e AstExpr) *Type {
+	switch n := e.(type) {
+	case *AstIntLitExpr:
+		return TypInt
+	case *AstStringLitExpr:
+		return TypString
+	case *AstBoolLitExpr:
+		return TypBool
+	case *AstIdent:
+		t := c.symType(n)
+		if t.Kind == TypeFn {
+			c.errorAt(n, CodeType, "cannot use function %s as a value", n.Name)
+			return TypInvalid
+		}
+		return t
+	case *AstFnCall:
+		return c.call(n)
+	case *AstUnaryExpr:
+		return c.unary(n)
+	case *AstBinaryExpr:
+		return c.binary(n)
+	}
+	panic(fmt.Sprintf("check: unhandled expression %T", e))
+}
+
+func (c *checker) call(n *AstFnCall) *Type {
+	t := c.symType(n.Name)
+	if t == TypInvalid {
+		for _, arg := range n.Args {
+			c.expr(arg)
+		}
+		return TypInvalid
+	}
+	if t.Kind != TypeFn {
+		c.errorAt(n.Name, CodeCall, "cannot call %s, it is not a function (type %s)", n.Name.Name, t)
+		return TypInvalid
+	}
+	if len(n.Args) < len(t.Params) || (!t.Variadic && len(n.Args) > len(t.Params)) {
+		err := nodeError(c.filename, n.Name, "wrong number of arguments in call to %s: expected %d got %d", n.Name.Name, len(t.Params), len(n.Args))
+		err.Code = CodeCall
+		err.Notes = []string{fmt.Sprintf("%s has type %s", n.Name.Name, t)}
+		c.errs = append(c.errs, err)
+	}
+	for i, arg := range n.Args {
+		context := fmt.Sprintf("argument %d to %s", i+1, n.Name.Name)
+		if i < len(t.Params) {
+			c.expectExpr(arg, t.Params[i], context)
+		} else if v := c.expr(arg); v == TypVoid {
+			c.errorAt(arg, CodeType, "cannot use void value as %s", context)
+		}
+	}
+	return t.Result
+}
+
+func (c *checker) unary(n *AstUnaryExpr) *Type {
+	t := c.expr(n.Expr)
+	want := TypInt
+	if n.Op == TokNot {
+		want = TypBool
+	}
+	if !AssignableTo(t, want) {
+		c.errorAt(n, CodeOperator, "operator %s not defined for %s", cOperators[n.Op], t)
+		return TypInvalid
+	}
+	return want
+}
+
+func (c *checker) binary(n *AstBinaryExpr) *Type {
+	l := c.expr(n.Left)
+	r := c.expr(n.Right)
+	if l == TypInvalid || r == TypInvalid {
+		return TypInvalid
+	}
+	mismatch := func() *Type {
+		c.errorAt(n, CodeOperator, "operator %s not defined for %s and %s", cOperators[n.Op], l, r)
+		return TypInvalid
+	}
+	switch n.Op {
+	case TokPlus, TokMinus, TokStar, TokDiv, TokPercent:
+		if n.Op == TokPlus && l == TypString && r == TypString {
+			// fold joins them
+			return TypString
+		}
+		if l != TypInt || r != TypInt {
+			return mismatch()
+		}
+		return TypInt
+	case TokLt, TokLte, TokGt, TokGte:
+		if l != TypInt || r != TypInt {
+			return mismatch()
+		}
+		return TypBool
+	case TokEq, TokNeq:
+		// Strings are pointers in C so == would compare addresses
+		if l != r || (l != TypInt && l != TypBool) {
+			return mismatch()
+		}
+		return TypBool
+	case TokAnd, TokOr:
+		if l != TypBool || r != TypBool {
+			return mismatch()
+		}
+		return TypBool
+	}
+	panic(fmt.Sprintf("check: unhandled operator %v", n.Op))
+}
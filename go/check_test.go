@@ -0,0 +1,233 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckReturns(t *testing.T) {
+	goodCases := []string{
+		"module m; fn main(): int { return 0; }",
+		"module m; fn f(): void {}",
+		"module m; fn f(): void { return; }",
+		"module m; fn f(a: int): int { if a > 1 { return 1; } else { return 2; } }",
+		"module m; fn f(a: int): int { if a > 1 { return 1; } return 2; }",
+		"module m; fn f(a: int): int { if a > 1 { return 1; } else if a > 0 { return 2; } else { return 3; } }",
+	}
+	for _, src := range goodCases {
+		p := NewParser(src, "<filename>")
+		mod, err := p.ParseModule()
+		if err != nil {
+			t.Fatalf("parsing %#v: %v", src, err)
+		}
+		if err := CheckReturns(mod); err != nil {
+			t.Errorf("unexpected error checking %#v: %v", src, err)
+		}
+	}
+
+	badCases := []string{
+		"module m; fn main(): int {}",
+		"module m; fn f(): void { return 1; }",
+		"module m; fn f(): int { return; }",
+		"module m; fn f(a: int): int { if a > 1 { return 1; } }",
+		"module m; fn f(a: int): int { if a > 1 { return 1; } else if a > 0 { return 2; } }",
+	}
+	for _, src := range badCases {
+		p := NewParser(src, "<filename>")
+		mod, err := p.ParseModule()
+		if err != nil {
+			t.Fatalf("parsing %#v: %v", src, err)
+		}
+		if err := CheckReturns(mod); err == nil {
+			t.Errorf("expected error checking %#v", src)
+		}
+	}
+}
+
+func TestCheckReturnsPosition(t *testing.T) {
+	p := NewParser("module m;\n\nfn  nope(): int {}", "test.b")
+	mod, err := p.ParseModule()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = CheckReturns(mod)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if got, want := err.Error(), "test.b:3:5  function nope is missing a return, it must return a value of type int on every path"; got != want {
+		t.Errorf("expected %q got %q", want, got)
+	}
+}
+
+// checkSrc parses, resolves and checks src, failing the test if it can't
+// be parsed or resolved
+func checkSrc(t *testing.T, src string) (*AstModule, *Resolution, *TypeInfo, error) {
+	t.Helper()
+	p := NewParser(src, "<filename>")
+	mod, err := p.ParseModule()
+	if err != nil {
+		t.Fatalf("parsing %#v: %v", src, err)
+	}
+	res, err := Resolve(mod)
+	if err != nil {
+		t.Fatalf("resolving %#v: %v", src, err)
+	}
+	info, err := Check(mod, res)
+	return mod, res, info, err
+}
+
+func TestCheck(t *testing.T) {
+	src := `
+		module test;
+
+		let greeting: string = "hi";
+		var count: int = 0;
+
+		fn main(): int {
+			let ok: bool = count < 10 && !false;
+			if ok {
+				count += add(1, 2) * 3;
+			}
+			while count > 0 {
+				count -= 1;
+			}
+			for i in 0..count {
+				printf("%s %d %d\n", greeting, i, add(i, 1));
+			}
+			puts(greeting);
+			return count;
+		}
+
+		fn add(a: int, b: int): int {
+			return a + b;
+		}
+
+		fn nothing(): void {
+			return;
+		}
+	`
+	mod, _, info, err := checkSrc(t, src)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	main := mod.Statements[2].(*AstFnDecl)
+	ok := main.Body.Body[0].(*AstConstAssign)
+	if got := info.TypeOf(ok.Value); got != TypBool {
+		t.Errorf("expected bool, got %v", got)
+	}
+	assign := main.Body.Body[1].(*AstIf).Then.Body[0].(*AstAssign)
+	if got := info.TypeOf(assign.Value); got != TypInt {
+		t.Errorf("expected int, got %v", got)
+	}
+}
+
+func TestCheckErrors(t *testing.T) {
+	badCases := []struct{ src, msg string }{
+		{`module m; let x: int = "hi";`, "<filename>:1:24  cannot use string value as int in declaration of x"},
+		{`module m; let x: nope = 1;`, "<filename>:1:18  unknown type nope"},
+		{`module m; var x: void = 1;`, "<filename>:1:18  variable x can't have type void"},
+		{`module m; fn f(a: void): void {}`, "<filename>:1:19  parameter a can't have type void"},
+		{`module m; fn f(a: int): int { return "no"; }`, "<filename>:1:38  cannot use string value as int in return from f"},
+		{`module m; fn f(a: int): int { return a == 1; }`, "<filename>:1:38  cannot use bool value as int in return from f"},
+		{`module m; fn f(a: int): int { return a; } fn g(): void { f(); }`, "<filename>:1:58  wrong number of arguments in call to f: expected 1 got 0"},
+		{`module m; fn f(a: int): int { return a; } fn g(): void { f(1, 2); }`, "<filename>:1:58  wrong number of arguments in call to f: expected 1 got 2"},
+		{`module m; fn f(a: int): int { return a; } fn g(): void { f("s"); }`, "<filename>:1:60  cannot use string value as int in argument 1 to f"},
+		{`module m; fn g(): void { printf(1); }`, "<filename>:1:33  cannot use int value as string in argument 1 to printf"},
+		{`module m; fn f(): void {} fn g(): void { printf("%d", f()); }`, "<filename>:1:55  cannot use void value as argument 2 to printf"},
+		{`module m; fn g(): void { var x: int = 1; x(); }`, "<filename>:1:42  cannot call x, it is not a function (type int)"},
+		{`module m; fn g(): void { let x: int = g; }`, "<filename>:1:39  cannot use function g as a value"},
+		{`module m; fn g(): void { var x: int = 1; x = true; }`, "<filename>:1:46  cannot use bool value as int in assignment to x"},
+		{`module m; fn g(): void { var x: string = "a"; x += 1; }`, "<filename>:1:47  operator += not defined for x (type string)"},
+		{`module m; fn g(): void { if 1 {} }`, "<filename>:1:29  non-bool condition (type int) in if statement"},
+		{`module m; fn g(a: int): void { while a {} }`, "<filename>:1:38  non-bool condition (type int) in while loop"},
+		{`module m; fn g(a: int): void { for ; a + 1; {} }`, "<filename>:1:38  non-bool condition (type int) in for loop"},
+		{`module m; fn g(): void { for i in 0.."a" {} }`, "<filename>:1:38  cannot use string value as int in range end"},
+		{`module m; fn g(a: string): bool { return a == a; }`, "<filename>:1:42  operator == not defined for string and string"},
+		{`module m; fn g(a: int): bool { return a && true; }`, "<filename>:1:39  operator && not defined for int and bool"},
+		{`module m; fn g(a: bool): int { return -a; }`, "<filename>:1:39  operator - not defined for bool"},
+		{`module m; fn g(a: int): bool { return !a; }`, "<filename>:1:39  operator ! not defined for int"},
+		{`module m; fn g(): int { return 1 + "a"; }`, "<filename>:1:32  operator + not defined for int and string"},
+		{`module m; printf("hi");`, "<filename>:1:11  only declarations are allowed at the module level"},
+	}
+	for _, tc := range badCases {
+		_, _, _, err := checkSrc(t, tc.src)
+		if err == nil {
+			t.Errorf("expected failure checking: %#v", tc.src)
+		} else if err.Error() != tc.msg {
+			t.Errorf("checking %#v: expected %q got %q", tc.src, tc.msg, err.Error())
+		}
+	}
+}
+
+func TestCheckIncludesReturns(t *testing.T) {
+	_, _, _, err := checkSrc(t, "module m; fn f(): int {}")
+	if err == nil {
+		t.Fatal("expected a missing return error")
+	}
+}
+
+func TestCheckInference(t *testing.T) {
+	src := `
+		module test;
+
+		let a = 12;
+		let s = "str";
+
+		fn main(): int {
+			var b = a * 2 > 3;
+			let c = add(a, 1);
+			for var i = 0; i < c; i += 1 {}
+			if b { return c; }
+			return 0;
+		}
+
+		fn add(x: int, y: int): int { return x + y; }
+	`
+	mod, res, info, err := checkSrc(t, src)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := map[string]string{"a": "int", "s": "string"}
+	for _, st := range mod.Statements[:2] {
+		decl := st.(*AstConstAssign)
+		if decl.Type == nil || decl.Type.Name.Name != want[decl.Ident.Name] {
+			t.Errorf("expected %s to be %s, got %+v", decl.Ident.Name, want[decl.Ident.Name], decl.Type)
+		}
+	}
+	body := mod.Statements[2].(*AstFnDecl).Body.Body
+	if b := body[0].(*AstVarDecl); b.Type.Name.Name != "bool" || info.TypeOf(b.Value) != TypBool {
+		t.Errorf("expected b to be bool, got %+v", b.Type)
+	}
+	if c := body[1].(*AstConstAssign); c.Type.Name.Name != "int" {
+		t.Errorf("expected c to be int, got %+v", c.Type)
+	}
+	if i := body[2].(*AstFor).Init.(*AstVarDecl); i.Type.Name.Name != "int" {
+		t.Errorf("expected i to be int, got %+v", i.Type)
+	}
+
+	cCode, err := CBackend{}.Generate(mod, res, info)
+	if err != nil {
+		t.Fatalf("ERR: %v", err)
+	}
+	code := strings.Join(strings.Fields(cCode), " ")
+	for _, decl := range []string{"const int b_a =", "const string b_s =", "bool b_b =", "const int b_c =", "int b_i ="} {
+		if !strings.Contains(code, decl) {
+			t.Errorf("expected generated code to contain %q:\n%s", decl, code)
+		}
+	}
+}
+
+func TestCheckInferenceErrors(t *testing.T) {
+	badCases := []struct{ src, msg string }{
+		{`module m; fn f(): void {} fn g(): void { let x = f(); }`, "<filename>:1:50  cannot use void value to initialise constant x"},
+		{`module m; fn g(): void { var x = 1; x = "s"; }`, "<filename>:1:41  cannot use string value as int in assignment to x"},
+	}
+	for _, tc := range badCases {
+		_, _, _, err := checkSrc(t, tc.src)
+		if err == nil {
+			t.Errorf("expected failure checking: %#v", tc.src)
+		} else if err.Error() != tc.msg {
+			t.Errorf("checking %#v: expected %q got %q", tc.src, tc.msg, err.Error())
+		}
+	}
+}
@@ -2,120 +2,383 @@ package main
 
 import (
 	"fmt"
+	"math"
+	"slices"
 	"strings"
 )
 
+// CBackend generates C from the IR, which is then compiled by the
+// system's C compiler
+type CBackend struct{}
+
+func (CBackend) Name() string {
+	return "c"
+}
+
+func (CBackend) Ext() string {
+	return ".c"
+}
+
+func (CBackend) Generate(mod *AstModule, res *Resolution, info *TypeInfo) (string, error) {
+	ir, err := BuildIR(mod, res, info)
+	if err != nil {
+		return "", err
+	}
+	return CBackend{}.GenerateIR(ir)
+}
+
+func (CBackend) GenerateIR(m *IrModule) (string, error) {
+	for _, f := range m.funcs() {
+		LeaveSSA(f)
+	}
+	return GenerateC(m), nil
+}
+
 type CodegenModule struct {
 	Code strings.Builder
+	// The block after the one being generated, and the blocks that are
+	// jumped to with goto rather than falling through
+	next   *IrBlock
+	gotoed map[*IrBlock]bool
+	// The instructions that declare the local they set, and if it's const
+	decls map[*IrInstr]bool
 }
 
-func (c *CodegenModule) Write(s string) error {
-	_, _ = c.Code.WriteString(" ")
-	_, err := c.Code.WriteString(s)
-	_, _ = c.Code.WriteString(" ")
-	return err
+func (cg *CodegenModule) line(format string, a ...any) {
+	fmt.Fprintf(&cg.Code, format, a...)
+	cg.Code.WriteByte('\n')
 }
 
-func (c *CodegenModule) Nl() {
-	_, _ = c.Code.WriteString("\n")
+// GenerateC writes the C for a module. Every IR variable becomes a C
+// variable, and blocks become labels that are jumped to with goto.
+func GenerateC(m *IrModule) string {
+	cg := &CodegenModule{}
+	cg.line("#include <stdio.h>")
+	cg.line("#include <stdbool.h>")
+	cg.line("typedef char* string;")
+	cg.line("")
+	cg.line("/* Module: %s */", m.Name)
+	for _, g := range m.Globals {
+		if g.Init == nil {
+			cg.line("%s %s;", g.Type, cName(g))
+		} else if g.Const {
+			cg.line("const %s %s = %s;", g.Type, cName(g), cValue(g.Init))
+		} else {
+			cg.line("%s %s = %s;", g.Type, cName(g), cValue(g.Init))
+		}
+	}
+	for _, f := range m.Funcs {
+		cg.line("%s;", cSignature(f))
+	}
+	// The globals that aren't constants are set when main starts. Without
+	// a main, the module is linked into something else, so they're set
+	// before that's main runs like C++ static initialisers.
+	start := map[string][]string{}
+	if m.Init != nil {
+		init := cFuncName(m.Init.Name)
+		if slices.ContainsFunc(m.Funcs, func(f *IrFunc) bool { return f.Name == "main" }) {
+			cg.line("static void %s(void);", init)
+			start["main"] = []string{init + "();"}
+		} else {
+			cg.line("static void %s(void) __attribute__((constructor));", init)
+		}
+	}
+	for _, f := range m.Funcs {
+		cg.line("")
+		cg.genFunc(cSignature(f), f, start[f.Name]...)
+	}
+	if m.Init != nil {
+		cg.line("")
+		cg.genFunc(fmt.Sprintf("static void %s(void)", cFuncName(m.Init.Name)), m.Init)
+	}
+	return cg.Code.String()
 }
 
-func (c *CodegenModule) Writef(format string, a ...any) error {
-	return c.Write(fmt.Sprintf(format, a...))
+// cFuncName turns the name of an IR function into a C identifier. Names
+// get a prefix so they can't clash with C's keywords or the C library,
+// main keeps its name so it's still where the program starts. Nested
+// functions have a '.' in their name, and the init function is called
+// <init>.
+func cFuncName(name string) string {
+	switch name {
+	case "<init>":
+		return "__compy_init"
+	case "main":
+		return name
+	}
+	return "b_" + strings.ReplaceAll(name, ".", "__")
 }
 
-func (c *CodegenModule) WriteRuntime() {
-	c.Write("#include <stdio.h>\n")
-	c.Write("typedef char* string;")
-	c.Nl()
+// cName is the C identifier for a variable. Temporaries get names no one
+// would write, and the rest are prefixed like functions.
+func cName(v *IrVar) string {
+	if v.Kind == IrTemp {
+		return "__t" + v.Name
+	}
+	return "b_" + strings.ReplaceAll(v.Name, ".", "__")
 }
 
-func (n *AstModule) Codegen(cg *CodegenModule) {
-	cg.WriteRuntime()
-	cg.Writef("/* Module: %s */", n.Name)
-	cg.Nl()
-	for _, stmt := range n.Statements {
-		stmt.ForwardDecl(cg)
-		cg.Write(";\n")
+func cSignature(f *IrFunc) string {
+	params := []string{}
+	for _, p := range f.Params {
+		params = append(params, fmt.Sprintf("%s %s", p.Type, cName(p)))
 	}
-	cg.Nl()
-	for _, stmt := range n.Statements {
-		stmt.Codegen(cg)
-		cg.Nl()
+	if len(params) == 0 {
+		params = append(params, "void")
 	}
+	return fmt.Sprintf("%s %s(%s)", f.Result, cFuncName(f.Name), strings.Join(params, ", "))
+}
 
-	cg.Nl()
+// genFunc writes a function, with the start lines run before its body
+func (cg *CodegenModule) genFunc(sig string, f *IrFunc, start ...string) {
+	cg.line("%s {", sig)
+	cg.decls = declared(f)
+	inline := map[*IrVar]bool{}
+	for in := range cg.decls {
+		inline[in.Dst] = true
+	}
+	for _, v := range f.Locals {
+		if !inline[v] {
+			cg.line("\t%s %s;", v.Type, cName(v))
+		}
+	}
+	for _, s := range start {
+		cg.line("\t%s", s)
+	}
+	next := func(i int) *IrBlock {
+		if i+1 < len(f.Blocks) {
+			return f.Blocks[i+1]
+		}
+		return nil
+	}
+	cg.gotoed = map[*IrBlock]bool{}
+	for i, b := range f.Blocks {
+		for j, t := range b.Succs() {
+			// Only a branch's first target always needs a goto
+			if t != next(i) || (b.Terminator().Op == IrBr && j == 0) {
+				cg.gotoed[t] = true
+			}
+		}
+	}
+	for i, b := range f.Blocks {
+		cg.next = next(i)
+		if cg.gotoed[b] {
+			if _, ok := cg.decls[b.Instrs[0]]; ok {
+				// A label has to be on a statement, not a declaration
+				cg.line("%s:;", cLabel(b))
+			} else {
+				cg.line("%s:", cLabel(b))
+			}
+		}
+		for _, in := range b.Instrs {
+			cg.genInstr(in)
+		}
+	}
+	cg.line("}")
 }
 
-func (n *AstConstAssign) Codegen(cg *CodegenModule) {
-	cg.Write("const")
-	n.Type.Codegen(cg)
-	cg.Write(n.Ident)
-	cg.Write("=")
-	n.Value.Codegen(cg)
+// declared finds the locals that can be declared where they're first set
+// rather than at the top of the function, which is when that comes before
+// everything else that uses them, both in the C and on every path through
+// it. They're keyed by the instruction that declares them, and are const
+// when nothing else sets them.
+func declared(f *IrFunc) map[*IrInstr]bool {
+	type place struct {
+		b  *IrBlock
+		in *IrInstr
+		n  int
+	}
+	t := dominators(f, predecessors(f))
+	first := map[*IrVar]place{}
+	sets := map[*IrVar]int{}
+	bad := map[*IrVar]bool{}
+	after := func(v *IrVar, b *IrBlock, n int) bool {
+		p, ok := first[v]
+		return ok && n > p.n && t.dominates(p.b, b)
+	}
+	n := 0
+	for _, b := range f.Blocks {
+		for _, in := range b.Instrs {
+			n++
+			for _, a := range in.Args {
+				if v, ok := a.(*IrVar); ok && v.Kind == IrLocal && !after(v, b, n) {
+					bad[v] = true
+				}
+			}
+			v := in.Dst
+			if v == nil || v.Kind != IrLocal {
+				continue
+			}
+			sets[v]++
+			if _, ok := first[v]; !ok {
+				first[v] = place{b, in, n}
+			} else if !after(v, b, n) {
+				bad[v] = true
+			}
+		}
+	}
+	decls := map[*IrInstr]bool{}
+	for v, p := range first {
+		if !bad[v] {
+			decls[p.in] = v.Const && sets[v] == 1
+		}
+	}
+	return decls
 }
-func (n *AstConstAssign) ForwardDecl(cg *CodegenModule) {}
 
-func (n *AstType) Codegen(cg *CodegenModule) {
-	cg.Write(n.Name.Name)
+func cLabel(b *IrBlock) string {
+	return strings.ReplaceAll(b.Label, ".", "_")
 }
 
-func (n *AstIntLitExpr) Codegen(cg *CodegenModule) {
-	cg.Writef("%d", n.Value)
+// cValue writes an operand as a C expression
+func cValue(v IrValue) string {
+	switch v := v.(type) {
+	case *IrVar:
+		return cName(v)
+	case *IrConst:
+		if v.Type == TypInt && v.Int == math.MinInt32 {
+			// 2147483648 doesn't fit in an int, so it can't be negated
+			return "(-2147483647 - 1)"
+		}
+		return v.String()
+	}
+	panic(fmt.Sprintf("codegen: unhandled value %T", v))
 }
 
-func (n *AstStringLitExpr) Codegen(cg *CodegenModule) {
-	cg.Writef("\"%s\"", n.Value)
+// cIrOperators are the C operators for the IR's, the arithmetic is done
+// unsigned so it wraps around rather than being undefined
+var cIrOperators = map[IrOp]string{
+	IrAdd: "+",
+	IrSub: "-",
+	IrMul: "*",
+	IrDiv: "/",
+	IrMod: "%",
+	IrEq:  "==",
+	IrNe:  "!=",
+	IrLt:  "<",
+	IrLe:  "<=",
+	IrGt:  ">",
+	IrGe:  ">=",
 }
 
-func (n *AstFnDecl) Codegen(cg *CodegenModule) {
-	n.ReturnType.Codegen(cg)
-	cg.Write(n.Name.Name + "(")
-	paramCount := len(n.Params)
-	for i, p := range n.Params {
-		p.Type.Codegen(cg)
-		cg.Write(p.Name.Name)
-		if i != paramCount-1 {
-			cg.Write(",")
+func (cg *CodegenModule) genInstr(in *IrInstr) {
+	args := []string{}
+	for _, a := range in.Args {
+		args = append(args, cValue(a))
+	}
+	dst := ""
+	if in.Dst != nil {
+		dst = cName(in.Dst) + " = "
+	}
+	if isConst, ok := cg.decls[in]; ok {
+		dst = fmt.Sprintf("%s %s", in.Dst.Type, dst)
+		if isConst {
+			dst = "const " + dst
 		}
 	}
-	cg.Write(")")
-	n.Body.Codegen(cg)
-}
-func (n *AstFnDecl) ForwardDecl(cg *CodegenModule) {
-	n.ReturnType.Codegen(cg)
-	cg.Write(n.Name.Name + "(")
-	for i, p := range n.Params {
-		if i != 0 {
-			cg.Write(",")
+	switch in.Op {
+	case IrCopy:
+		cg.line("\t%s%s;", dst, args[0])
+	case IrNeg:
+		cg.line("\t%s(int)-(unsigned)%s;", dst, args[0])
+	case IrNot:
+		cg.line("\t%s!%s;", dst, args[0])
+	case IrAdd, IrSub, IrMul:
+		cg.line("\t%s(int)((unsigned)%s %s (unsigned)%s);", dst, args[0], cIrOperators[in.Op], args[1])
+	case IrDiv, IrMod:
+		if c, ok := in.Args[1].(*IrConst); ok && c.Int != -1 {
+			cg.line("\t%s%s %s %s;", dst, args[0], cIrOperators[in.Op], args[1])
+		} else if in.Op == IrDiv {
+			// The smallest int divided by -1 traps in C, it wraps around
+			// like the other backends here
+			cg.line("\t%s%s == -1 ? (int)-(unsigned)%s : %s / %s;", dst, args[1], args[0], args[0], args[1])
+		} else {
+			cg.line("\t%s%s == -1 ? 0 : %s %% %s;", dst, args[1], args[0], args[1])
+		}
+	case IrEq, IrNe, IrLt, IrLe, IrGt, IrGe:
+		cg.line("\t%s%s %s %s;", dst, args[0], cIrOperators[in.Op], args[1])
+	case IrCall, IrBuiltin:
+		callee := in.Callee
+		if in.Op == IrCall {
+			callee = cFuncName(callee)
+		}
+		cg.line("\t%s%s(%s);", dst, callee, strings.Join(args, ", "))
+	case IrJmp:
+		cg.jump(in.Targets[0])
+	case IrBr:
+		cg.line("\tif (%s) goto %s;", args[0], cLabel(in.Targets[0]))
+		cg.jump(in.Targets[1])
+	case IrRet:
+		if len(args) == 0 {
+			cg.line("\treturn;")
+		} else {
+			cg.line("\treturn %s;", args[0])
 		}
-		p.Type.Codegen(cg)
+	default:
+		panic(fmt.Sprintf("codegen: unhandled instruction %v", in.Op))
 	}
-	cg.Write(")")
 }
 
-func (n *AstBlock) Codegen(cg *CodegenModule) {
-	cg.Write("{\n")
-	for _, s := range n.Body {
-		s.Codegen(cg)
-		cg.Write(";\n")
+// jump goes to b, falling through when it's next
+func (cg *CodegenModule) jump(b *IrBlock) {
+	if b != cg.next {
+		cg.line("\tgoto %s;", cLabel(b))
 	}
-	cg.Write("\n}")
 }
 
-func (n *AstFnCall) Codegen(cg *CodegenModule) {
-	cg.Write(n.Name.Name + "(")
-	for i, arg := range n.Args {
-		if i != 0 {
-			cg.Write(",")
+var cAssignOperators = map[TokenKind]string{
+	TokAssign:        "=",
+	TokPlusAssign:    "+=",
+	TokMinusAssign:   "-=",
+	TokStarAssign:    "*=",
+	TokDivAssign:     "/=",
+	TokPercentAssign: "%=",
+}
+
+// cStringLiteral quotes s as a C string literal. Anything that isn't
+// printable ASCII is written as an octal escape, which unlike \x
+// escapes can't run on into the following characters.
+func cStringLiteral(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c == '\n':
+			b.WriteString("\\n")
+		case c == '\t':
+			b.WriteString("\\t")
+		case c == '\r':
+			b.WriteString("\\r")
+		case c == '?' && i > 0 && s[i-1] == '?':
+			// Avoid writing a trigraph
+			b.WriteString("\\?")
+		case c >= 0x20 && c < 0x7f:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "\\%03o", c)
 		}
-		arg.Codegen(cg)
 	}
-	cg.Write(")")
+	b.WriteByte('"')
+	return b.String()
 }
 
-func (n *AstFnCall) ForwardDecl(cg *CodegenModule) {}
-
-func (n *AstIdent) Codegen(cg *CodegenModule) {
-	cg.Write(n.Name)
+var cOperators = map[TokenKind]string{
+	TokOr:      "||",
+	TokAnd:     "&&",
+	TokEq:      "==",
+	TokNeq:     "!=",
+	TokLt:      "<",
+	TokLte:     "<=",
+	TokGt:      ">",
+	TokGte:     ">=",
+	TokPlus:    "+",
+	TokMinus:   "-",
+	TokStar:    "*",
+	TokDiv:     "/",
+	TokPercent: "%",
+	TokNot:     "!",
 }
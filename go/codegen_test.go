@@ -0,0 +1,48 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCStringLiteral(t *testing.T) {
+	cases := []struct{ in, out string }{
+		{"hello", `"hello"`},
+		{"a\nb\tc\rd", `"a\nb\tc\rd"`},
+		{`say "hi" \o/`, `"say \"hi\" \\o/"`},
+		{"\x01\xff", `"\001\377"`},
+		{"é", `"\303\251"`},
+		{"what??!", `"what?\?!"`},
+		{"\x012", `"\0012"`},
+	}
+	for _, tc := range cases {
+		if got := cStringLiteral(tc.in); got != tc.out {
+			t.Errorf("quoting %q: expected %s got %s", tc.in, tc.out, got)
+		}
+	}
+}
+
+func TestCGlobalInitialisers(t *testing.T) {
+	mod, res, info, err := checkSrc(t, backendPrelude+"fn main(): int { return big; }\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := CBackend{}.Generate(mod, res, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only the globals that aren't constants are set by the init function
+	for _, want := range []string{
+		"const int b_base = 3;",
+		"const string b_greeting = \"hello\";",
+		"const int b_big = 200;",
+		"int b_count = 4;",
+	} {
+		if !strings.Contains(code, want) {
+			t.Errorf("expected the C to contain %q:\n%s", want, code)
+		}
+	}
+	if strings.Contains(code, "__compy_init") {
+		t.Errorf("expected no init function:\n%s", code)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import "math"
+
+// fold works out constant expressions at compile time and replaces them
+// with literals. It's run over each statement at the module level once
+// it's been checked. The initialiser of a module level let is folded when
+// it only uses literals, operators and the lets before it, so backends
+// don't have to work it out when the program starts. Anything else is left
+// to run then, apart from joining strings with +, which backends can't
+// do, so it's an error if the strings aren't constants.
+//
+// Division by zero and overflow are errors in the constants that are
+// folded, where ints in code that runs wrap around like 32 bit C ints.
+func (c *checker) fold(root Node) Node {
+	return Rewrite(root, nil, func(n Node) Node {
+		switch n := n.(type) {
+		case *AstBinaryExpr:
+			if c.info.TypeOf(n) != TypString {
+				break
+			}
+			// Joins inside this one that couldn't be folded have already
+			// been reported
+			_, left := n.Left.(*AstBinaryExpr)
+			_, right := n.Right.(*AstBinaryExpr)
+			if left || right {
+				break
+			}
+			v, ok := c.constValue(n)
+			if !ok {
+				c.errorAt(n, CodeOperator, "operator + can only join strings known at compile time")
+				break
+			}
+			return c.literal(n, v)
+		case *AstConstAssign:
+			if n != root || c.info.TypeOf(n.Value) == TypInvalid {
+				break
+			}
+			if v, ok := c.constValue(n.Value); ok {
+				c.info.Consts[c.res.SymbolOf(n.Ident)] = v
+				n.Value = c.literal(n.Value, v)
+			}
+		}
+		return n
+	})
+}
+
+// literal makes the literal for a folded value, in place of e
+func (c *checker) literal(e AstExpr, v *IrConst) AstExpr {
+	at := node{e.Span()}
+	var lit AstExpr
+	switch v.Type {
+	case TypInt:
+		lit = &AstIntLitExpr{node: at, Value: v.Int}
+	case TypBool:
+		lit = &AstBoolLitExpr{node: at, Value: v.Int != 0}
+	default:
+		lit = &AstStringLitExpr{node: at, Value: v.Str}
+	}
+	c.info.Types[lit] = v.Type
+	return lit
+}
+
+// constValue works out the value of e, if it's a constant. The errors
+// in it are reported, and make it not a constant.
+func (c *checker) constValue(e AstExpr) (*IrConst, bool) {
+	switch n := e.(type) {
+	case *AstIntLitExpr:
+		return c.constInt(n, n.Value, "%d doesn't fit in an int", n.Value)
+	case *AstBoolLitExpr:
+		return BoolConst(n.Value), true
+	case *AstStringLitExpr:
+		return &IrConst{Type: TypString, Str: n.Value}, true
+	case *AstIdent:
+		v, ok := c.info.Consts[c.res.SymbolOf(n)]
+		return v, ok
+	case *AstUnaryExpr:
+		if lit, ok := n.Expr.(*AstIntLitExpr); ok && n.Op == TokMinus {
+			// The smallest int is only written like this
+			return c.constInt(n, -lit.Value, "-%d doesn't fit in an int", lit.Value)
+		}
+		v, ok := c.constValue(n.Expr)
+		if !ok {
+			return nil, false
+		}
+		if n.Op == TokNot {
+			return BoolConst(v.Int == 0), true
+		}
+		return c.constInt(n, -v.Int, "-(%d) overflows an int", v.Int)
+	case *AstBinaryExpr:
+		return c.constBinary(n)
+	}
+	// Calls are run when the program is
+	return nil, false
+}
+
+func (c *checker) constBinary(n *AstBinaryExpr) (*IrConst, bool) {
+	l, lok := c.constValue(n.Left)
+	if n.Op == TokAnd || n.Op == TokOr {
+		// The right hand side isn't worked out if the left decides it,
+		// or could when the program runs
+		if !lok || (l.Int != 0) == (n.Op == TokOr) {
+			return l, lok
+		}
+		return c.constValue(n.Right)
+	}
+	r, rok := c.constValue(n.Right)
+	if !lok || !rok {
+		return nil, false
+	}
+	if l.Type == TypString {
+		return &IrConst{Type: TypString, Str: l.Str + r.Str}, true
+	}
+	a, b := l.Int, r.Int
+	op := cOperators[n.Op]
+	switch n.Op {
+	case TokPlus:
+		return c.constInt(n, a+b, "%d %s %d overflows an int", a, op, b)
+	case TokMinus:
+		return c.constInt(n, a-b, "%d %s %d overflows an int", a, op, b)
+	case TokStar:
+		return c.constInt(n, a*b, "%d %s %d overflows an int", a, op, b)
+	case TokDiv, TokPercent:
+		if b == 0 {
+			c.errorAt(n, CodeConst, "division by zero in %d %s %d", a, op, b)
+			return nil, false
+		}
+		if n.Op == TokPercent {
+			// This traps in C like the division does
+			if a == math.MinInt32 && b == -1 {
+				c.errorAt(n, CodeConst, "%d %s %d overflows an int", a, op, b)
+				return nil, false
+			}
+			return IntConst(a % b), true
+		}
+		return c.constInt(n, a/b, "%d %s %d overflows an int", a, op, b)
+	case TokEq:
+		return BoolConst(a == b), true
+	case TokNeq:
+		return BoolConst(a != b), true
+	case TokLt:
+		return BoolConst(a < b), true
+	case TokLte:
+		return BoolConst(a <= b), true
+	case TokGt:
+		return BoolConst(a > b), true
+	case TokGte:
+		return BoolConst(a >= b), true
+	}
+	return nil, false
+}
+
+// constInt is the int n, or an error when it doesn't fit in 32 bits
+func (c *checker) constInt(at Node, n int, format string, a ...any) (*IrConst, bool) {
+	if n < math.MinInt32 || n > math.MaxInt32 {
+		c.errorAt(at, CodeConst, format, a...)
+		return nil, false
+	}
+	return IntConst(n), true
+}
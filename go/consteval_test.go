@@ -0,0 +1,99 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestFold(t *testing.T) {
+	src := `module m;
+let a = 6 * 7;
+let b = a / 5 - -a % 4;
+let min = -2147483648;
+let big = min + 2147483647 == -1 && !(b > 100);
+let skipped = false && 1 / 0 == 1;
+let s = "x" + "y";
+let t = s + "\n" + s;
+var v = 1 + 2;
+let n = f() + a;
+fn f(): int { return 1; }
+fn main(): int { puts(t + "!"); return 0; }
+`
+	mod, _, _, err := checkSrc(t, src)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	values := map[string]any{}
+	for _, st := range mod.Statements {
+		n, ok := st.(*AstConstAssign)
+		if !ok {
+			continue
+		}
+		switch v := n.Value.(type) {
+		case *AstIntLitExpr:
+			values[n.Ident.Name] = v.Value
+		case *AstBoolLitExpr:
+			values[n.Ident.Name] = v.Value
+		case *AstStringLitExpr:
+			values[n.Ident.Name] = v.Value
+		}
+	}
+	want := map[string]any{
+		"a":       42,
+		"b":       10,
+		"min":     -2147483648,
+		"big":     true,
+		"skipped": false,
+		"s":       "xy",
+		"t":       "xy\nxy",
+	}
+	for name, v := range want {
+		if values[name] != v {
+			t.Errorf("expected %s to be %#v, got %#v", name, v, values[name])
+		}
+	}
+	if _, ok := values["n"]; ok {
+		t.Errorf("expected n, which calls a function, not to be folded")
+	}
+	if _, ok := mod.Statements[7].(*AstVarDecl).Value.(*AstBinaryExpr); !ok {
+		t.Errorf("expected var v not to be folded")
+	}
+	main := mod.Statements[10].(*AstFnDecl)
+	arg := main.Body.Body[0].(*AstFnCall).Args[0]
+	if lit, ok := arg.(*AstStringLitExpr); !ok || lit.Value != "xy\nxy!" {
+		t.Errorf("expected the string joined in main to be folded, got %#v", arg)
+	}
+}
+
+func TestFoldErrors(t *testing.T) {
+	badCases := []struct{ src, msg string }{
+		{`module m; let x = 1 / 0;`, "<filename>:1:19  division by zero in 1 / 0"},
+		{`module m; let a = 2; let x = 7 % (a - 2);`, "<filename>:1:30  division by zero in 7 % 0"},
+		{`module m; let x = 2147483647 + 1;`, "<filename>:1:19  2147483647 + 1 overflows an int"},
+		{`module m; let x = 65536 * 65536;`, "<filename>:1:19  65536 * 65536 overflows an int"},
+		{`module m; let x = 2147483648;`, "<filename>:1:19  2147483648 doesn't fit in an int"},
+		{`module m; let x = -2147483649;`, "<filename>:1:19  -2147483649 doesn't fit in an int"},
+		{`module m; let min = -2147483648; let x = -min;`, "<filename>:1:42  -(-2147483648) overflows an int"},
+		{`module m; let x = -2147483648 / -1;`, "<filename>:1:19  -2147483648 / -1 overflows an int"},
+		{`module m; let x = -2147483648 % -1;`, "<filename>:1:19  -2147483648 % -1 overflows an int"},
+		{`module m; fn f(): int { return 0; } let x = f() + 1 / 0;`, "<filename>:1:51  division by zero in 1 / 0"},
+		{`module m; fn f(a: string): void { puts(a + "!"); }`, "<filename>:1:40  operator + can only join strings known at compile time"},
+		{`module m; var s = "a"; let t = s + "b" + "c";`, "<filename>:1:32  operator + can only join strings known at compile time"},
+	}
+	for _, tc := range badCases {
+		_, _, _, err := checkSrc(t, tc.src)
+		if err == nil {
+			t.Errorf("expected failure checking: %#v", tc.src)
+		} else if err.Error() != tc.msg {
+			t.Errorf("checking %#v: expected %q got %q", tc.src, tc.msg, err.Error())
+		}
+	}
+}
+
+func TestFoldLeavesCodeThatRuns(t *testing.T) {
+	// Ints in functions wrap around when the program runs, like they do
+	// in C, so they aren't errors
+	src := `module m; fn f(): int { let x = 2147483647 + 1; return x / 0; }`
+	if _, _, _, err := checkSrc(t, src); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+type Severity int
+
+const (
+	SevError Severity = iota
+	SevWarning
+	SevNote
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SevError:
+		return "error"
+	case SevWarning:
+		return "warning"
+	case SevNote:
+		return "note"
+	}
+	return fmt.Sprintf("Severity(%d)", int(s))
+}
+
+// Diagnostic codes, every kind of problem has its own so tools can tell
+// them apart without matching on the message
+const (
+	CodeLex    = "E0001" // the lexer couldn't make sense of the source
+	CodeSyntax = "E0002" // the parser didn't get what it expected
+
+	CodeUndefined  = "E0101" // use of a name that isn't declared
+	CodeRedeclared = "E0102" // a name declared twice in one scope
+	CodeAssign     = "E0103" // assignment to something other than a var
+	CodeCapture    = "E0104" // a nested function using a local of the one it's in
+	CodeShadow     = "W0101" // a declaration hides an outer one
+
+	CodeType        = "E0201" // a value of the wrong type
+	CodeUnknownType = "E0202" // a type name that doesn't exist
+	CodeOperator    = "E0203" // an operator applied to the wrong types
+	CodeCall        = "E0204" // a bad function call
+	CodeReturn      = "E0205" // a return that doesn't agree with its function
+	CodeTopLevel    = "E0206" // a statement outside of a function
+	CodeConst       = "E0207" // a constant that can't be worked out, like a division by zero
+
+	CodeRuntime = "E0301" // a program interpreted by compy failed
+)
+
+// Label points at some other part of the source that helps explain a
+// diagnostic
+type Label struct {
+	Span Span
+	Msg  string
+}
+
+// Fix is a suggested change to the source, replacing Span with Replacement
+type Fix struct {
+	Msg         string
+	Span        Span
+	Replacement string
+}
+
+// Diagnostic is a problem found in a program, with everything needed to
+// show it to the user
+type Diagnostic struct {
+	Severity Severity
+	Code     string
+	Msg      string
+	Filename string
+	// The part of the source the problem is in, it's zero for problems that
+	// aren't about any particular part
+	Span   Span
+	Labels []Label
+	Notes  []string
+	Fix    *Fix
+}
+
+// Diagnostic turns e into a diagnostic of the given severity
+func (e ParseError) Diagnostic(sev Severity) Diagnostic {
+	return Diagnostic{
+		Severity: sev,
+		Code:     e.Code,
+		Msg:      e.Msg,
+		Filename: e.Filename,
+		Span:     e.Span,
+		Labels:   e.Labels,
+		Notes:    e.Notes,
+		Fix:      e.Fix,
+	}
+}
+
+// Diagnostics flattens err, which may be several errors joined together,
+// into diagnostics of the given severity. Errors that aren't ParseErrors
+// only have a message.
+func Diagnostics(err error, sev Severity) []Diagnostic {
+	if err == nil {
+		return nil
+	}
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		diags := []Diagnostic{}
+		for _, e := range joined.Unwrap() {
+			diags = append(diags, Diagnostics(e, sev)...)
+		}
+		return diags
+	}
+	var pe ParseError
+	if errors.As(err, &pe) {
+		return []Diagnostic{pe.Diagnostic(sev)}
+	}
+	return []Diagnostic{{Severity: sev, Msg: err.Error()}}
+}
+
+// DiagnosticOutput is somewhere to send diagnostics
+type DiagnosticOutput interface {
+	Print(d Diagnostic)
+	// PrintSummary is called once all the diagnostics have been printed
+	PrintSummary()
+}
+
+// DiagnosticPrinter writes diagnostics for people to read, showing the
+// source lines they refer to when it has the source for their file
+type DiagnosticPrinter struct {
+	W     io.Writer
+	Color bool
+	// Source text by filename
+	Sources map[string]string
+
+	errors   int
+	warnings int
+}
+
+func NewDiagnosticPrinter(w io.Writer, color bool) *DiagnosticPrinter {
+	return &DiagnosticPrinter{W: w, Color: color, Sources: map[string]string{}}
+}
+
+const (
+	ansiReset  = "\x1b[0m"
+	ansiBold   = "\x1b[1m"
+	ansiRed    = "\x1b[1;31m"
+	ansiYellow = "\x1b[1;33m"
+	ansiBlue   = "\x1b[1;34m"
+	ansiCyan   = "\x1b[1;36m"
+)
+
+func (p *DiagnosticPrinter) paint(color, s string) string {
+	if !p.Color {
+		return s
+	}
+	return color + s + ansiReset
+}
+
+func severityColor(sev Severity) string {
+	switch sev {
+	case SevError:
+		return ansiRed
+	case SevWarning:
+		return ansiYellow
+	}
+	return ansiCyan
+}
+
+// mark is an underlined part of a source line
+type mark struct {
+	span    Span
+	primary bool
+	msg     string
+}
+
+// Print writes d, something like:
+//
+//	error[E0101]: undefined: b
+//	 --> test.b:3:5
+//	  |
+//	3 |     b = c;
+//	  |     ^
+func (p *DiagnosticPrinter) Print(d Diagnostic) {
+	switch d.Severity {
+	case SevError:
+		p.errors++
+	case SevWarning:
+		p.warnings++
+	}
+	sevColor := severityColor(d.Severity)
+	title := d.Severity.String()
+	if d.Code != "" {
+		title += "[" + d.Code + "]"
+	}
+	fmt.Fprintf(p.W, "%s%s\n", p.paint(sevColor, title), p.paint(ansiBold, ": "+d.Msg))
+
+	src, haveSrc := p.Sources[d.Filename]
+	haveSrc = haveSrc && d.Span.Start.Line > 0 && d.Span.Start.Offset <= len(src)
+
+	marks := []mark{}
+	if haveSrc {
+		marks = append(marks, mark{d.Span, true, ""})
+		for _, l := range d.Labels {
+			marks = append(marks, mark{l.Span, false, l.Msg})
+		}
+	}
+	width := 1
+	for _, m := range marks {
+		width = max(width, len(fmt.Sprint(m.span.Start.Line)))
+	}
+	gutter := p.paint(ansiBlue, strings.Repeat(" ", width)+" |")
+
+	if d.Filename != "" {
+		arrow := p.paint(ansiBlue, strings.Repeat(" ", width)+"-->")
+		if d.Span.Start.Line > 0 {
+			fmt.Fprintf(p.W, "%s %s:%v\n", arrow, d.Filename, d.Span.Start)
+		} else {
+			fmt.Fprintf(p.W, "%s %s\n", arrow, d.Filename)
+		}
+	}
+	if len(marks) > 0 {
+		p.printSnippet(src, marks, width, sevColor)
+	}
+	for _, note := range d.Notes {
+		fmt.Fprintf(p.W, "%s %s %s\n", strings.Repeat(" ", width), p.paint(ansiBlue, "="), p.paint(ansiBold, "note")+": "+note)
+	}
+	if d.Fix != nil {
+		fmt.Fprintf(p.W, "%s %s %s\n", strings.Repeat(" ", width), p.paint(ansiBlue, "="), p.paint(ansiBold, "help")+": "+d.Fix.Msg)
+		if haveSrc && d.Fix.Span.Start.Line > 0 {
+			p.printFix(src, d.Fix, width, gutter)
+		}
+	}
+	if len(marks) > 0 || len(d.Notes) > 0 || d.Fix != nil {
+		fmt.Fprintln(p.W)
+	}
+}
+
+// printSnippet writes the source lines the marks are on, each followed by
+// its underlines
+func (p *DiagnosticPrinter) printSnippet(src string, marks []mark, width int, sevColor string) {
+	gutter := p.paint(ansiBlue, strings.Repeat(" ", width)+" |")
+	sort.SliceStable(marks, func(i, j int) bool {
+		return marks[i].span.Start.Offset < marks[j].span.Start.Offset
+	})
+	fmt.Fprintln(p.W, gutter)
+	lastLine := uint(0)
+	for _, m := range marks {
+		line := m.span.Start.Line
+		if line != lastLine {
+			if lastLine != 0 && line > lastLine+1 {
+				fmt.Fprintln(p.W, p.paint(ansiBlue, "..."))
+			}
+			lineNo := fmt.Sprintf("%*d |", width, line)
+			fmt.Fprintf(p.W, "%s %s\n", p.paint(ansiBlue, lineNo), sourceLine(src, m.span.Start.Offset))
+		}
+		lastLine = line
+		indent, n := underline(src, m.span)
+		ch, color := "-", ansiBlue
+		if m.primary {
+			ch, color = "^", sevColor
+		}
+		text := strings.Repeat(ch, n)
+		if m.msg != "" {
+			text += " " + m.msg
+		}
+		fmt.Fprintf(p.W, "%s %s%s\n", gutter, indent, p.paint(color, text))
+	}
+}
+
+// printFix writes the line the fix applies to with the fix made
+func (p *DiagnosticPrinter) printFix(src string, fix *Fix, width int, gutter string) {
+	start, end := fix.Span.Start.Offset, fix.Span.End.Offset
+	if end < start || end > len(src) {
+		return
+	}
+	lineStart := strings.LastIndexByte(src[:start], '\n') + 1
+	lineEnd := strings.IndexByte(src[end:], '\n')
+	if lineEnd < 0 {
+		lineEnd = len(src)
+	} else {
+		lineEnd += end
+	}
+	fixed := src[lineStart:start] + fix.Replacement + src[end:lineEnd]
+	lineNo := fmt.Sprintf("%*d |", width, fix.Span.Start.Line)
+	fmt.Fprintln(p.W, gutter)
+	fmt.Fprintf(p.W, "%s %s\n", p.paint(ansiBlue, lineNo), fixed)
+	indent, _ := underline(src, Span{fix.Span.Start, fix.Span.Start})
+	n := max(utf8.RuneCountInString(fix.Replacement), 1)
+	fmt.Fprintf(p.W, "%s %s%s\n", gutter, indent, p.paint(ansiCyan, strings.Repeat("+", n)))
+}
+
+// sourceLine returns the line of src containing offset, without its newline
+func sourceLine(src string, offset int) string {
+	start := strings.LastIndexByte(src[:offset], '\n') + 1
+	end := strings.IndexByte(src[start:], '\n')
+	if end < 0 {
+		return src[start:]
+	}
+	return strings.TrimSuffix(src[start:start+end], "\r")
+}
+
+// underline works out how to underline span on its first line. The indent
+// keeps any tabs from the source so the underline stays lined up, and the
+// underline is at least one character long so empty spans still show up.
+func underline(src string, span Span) (string, int) {
+	start := span.Start.Offset
+	lineStart := strings.LastIndexByte(src[:start], '\n') + 1
+	indent := strings.Builder{}
+	for _, c := range src[lineStart:start] {
+		if c == '\t' {
+			indent.WriteRune('\t')
+		} else {
+			indent.WriteRune(' ')
+		}
+	}
+	end := min(max(span.End.Offset, start), len(src))
+	if nl := strings.IndexByte(src[start:end], '\n'); nl >= 0 {
+		end = start + nl
+	}
+	return indent.String(), max(utf8.RuneCountInString(src[start:end]), 1)
+}
+
+// Summary describes how many errors and warnings have been printed, it is
+// empty if there weren't any
+func (p *DiagnosticPrinter) Summary() string {
+	parts := []string{}
+	if p.errors > 0 {
+		parts = append(parts, plural(p.errors, "error"))
+	}
+	if p.warnings > 0 {
+		parts = append(parts, plural(p.warnings, "warning"))
+	}
+	return strings.Join(parts, " and ")
+}
+
+// PrintSummary writes the Summary, if there is anything to say, and
+// starts counting again
+func (p *DiagnosticPrinter) PrintSummary() {
+	if s := p.Summary(); s != "" {
+		fmt.Fprintf(p.W, "%s generated\n", s)
+	}
+	p.errors, p.warnings = 0, 0
+}
+
+func plural(n int, word string) string {
+	if n == 1 {
+		return fmt.Sprintf("%d %s", n, word)
+	}
+	return fmt.Sprintf("%d %ss", n, word)
+}
+
+// isTerminal reports if f is a terminal, so output to it can use colour.
+// Setting NO_COLOR turns colour off regardless.
+func isTerminal(f *os.File) bool {
+	if os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// JSONDiagnosticPrinter writes diagnostics for tools to read, one JSON
+// object per line
+type JSONDiagnosticPrinter struct {
+	enc *json.Encoder
+}
+
+func NewJSONDiagnosticPrinter(w io.Writer) *JSONDiagnosticPrinter {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	return &JSONDiagnosticPrinter{enc: enc}
+}
+
+type jsonPos struct {
+	Line   uint `json:"line"`
+	Col    uint `json:"col"`
+	Offset int  `json:"offset"`
+}
+
+type jsonRange struct {
+	Start jsonPos `json:"start"`
+	End   jsonPos `json:"end"`
+}
+
+type jsonRelated struct {
+	File    string     `json:"file"`
+	Range   *jsonRange `json:"range"`
+	Message string     `json:"message"`
+}
+
+type jsonFix struct {
+	Message     string     `json:"message"`
+	Range       *jsonRange `json:"range"`
+	Replacement string     `json:"replacement"`
+}
+
+type jsonDiagnostic struct {
+	File     string        `json:"file,omitempty"`
+	Range    *jsonRange    `json:"range,omitempty"`
+	Severity string        `json:"severity"`
+	Code     string        `json:"code,omitempty"`
+	Message  string        `json:"message"`
+	Related  []jsonRelated `json:"related,omitempty"`
+	Notes    []string      `json:"notes,omitempty"`
+	Fix      *jsonFix      `json:"fix,omitempty"`
+}
+
+// toJSONRange is nil for the zero span, which doesn't point anywhere
+func toJSONRange(s Span) *jsonRange {
+	if s.Start.Line == 0 {
+		return nil
+	}
+	return &jsonRange{
+		Start: jsonPos{s.Start.Line, s.Start.Col, s.Start.Offset},
+		End:   jsonPos{s.End.Line, s.End.Col, s.End.Offset},
+	}
+}
+
+func (p *JSONDiagnosticPrinter) Print(d Diagnostic) {
+	jd := jsonDiagnostic{
+		File:     d.Filename,
+		Range:    toJSONRange(d.Span),
+		Severity: d.Severity.String(),
+		Code:     d.Code,
+		Message:  d.Msg,
+		Notes:    d.Notes,
+	}
+	for _, l := range d.Labels {
+		jd.Related = append(jd.Related, jsonRelated{d.Filename, toJSONRange(l.Span), l.Msg})
+	}
+	if d.Fix != nil {
+		jd.Fix = &jsonFix{d.Fix.Msg, toJSONRange(d.Fix.Span), d.Fix.Replacement}
+	}
+	// Writes only fail if the output has gone away, and then there's
+	// nowhere left to report it
+	_ = p.enc.Encode(jd)
+}
+
+// PrintSummary does nothing, tools can count for themselves
+func (p *JSONDiagnosticPrinter) PrintSummary() {}
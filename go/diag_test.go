@@ -0,0 +1,192 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func printDiags(src string, diags []Diagnostic) string {
+	out := strings.Builder{}
+	p := NewDiagnosticPrinter(&out, false)
+	p.Sources["test.b"] = src
+	for _, d := range diags {
+		p.Print(d)
+	}
+	p.PrintSummary()
+	return out.String()
+}
+
+func TestPrintDiagnostics(t *testing.T) {
+	cases := []struct {
+		src  string
+		want string
+	}{
+		{
+			"module m;\nlet a: int = 1;\nfn main(): int {\n\tlet a: int = b;\n\treturn a;\n}\n",
+			`warning[W0101]: a shadows the constant declared at 2:5
+ --> test.b:4:6
+  |
+2 | let a: int = 1;
+  |     - constant a declared here
+...
+4 | 	let a: int = b;
+  | 	    ^
+
+error[E0101]: undefined: b
+ --> test.b:4:15
+  |
+4 | 	let a: int = b;
+  | 	             ^
+
+1 error and 1 warning generated
+`,
+		},
+		{
+			"module m;\nlet a: bool = b | c;\n",
+			`error[E0001]: unexpected character '|', did you mean '||'?
+ --> test.b:2:17
+  |
+2 | let a: bool = b | c;
+  |                 ^
+  = help: replace "|" with "||"
+  |
+2 | let a: bool = b || c;
+  |                 ++
+
+1 error generated
+`,
+		},
+		{
+			"module m;\nfn main(): int {\n\treturn 1\n}\n",
+			`error[E0002]: expected ';', found '}'
+ --> test.b:4:1
+  |
+4 | }
+  | ^
+
+1 error generated
+`,
+		},
+		{
+			"module m;\nfn f(): int {\n\treturn f(1 +\n\t\t2);\n}\n",
+			`error[E0204]: wrong number of arguments in call to f: expected 0 got 1
+ --> test.b:3:9
+  |
+3 | 	return f(1 +
+  | 	       ^
+  = note: f has type fn(): int
+
+1 error generated
+`,
+		},
+	}
+	for _, tc := range cases {
+		diags := []Diagnostic{}
+		p := NewParser(tc.src, "test.b")
+		mod, err := p.ParseModule()
+		if err == nil {
+			res, rerr := Resolve(mod)
+			for _, w := range res.Warnings {
+				diags = append(diags, w.Diagnostic(SevWarning))
+			}
+			err = rerr
+			if err == nil {
+				_, err = Check(mod, res)
+			}
+		}
+		diags = append(diags, Diagnostics(err, SevError)...)
+		if got := printDiags(tc.src, diags); got != tc.want {
+			t.Errorf("printing diagnostics for %q, expected:\n%s\ngot:\n%s", tc.src, tc.want, got)
+		}
+	}
+}
+
+func TestPrintDiagnosticSpans(t *testing.T) {
+	src := "module m;\nlet s: string = \"abc\";\n"
+	d := Diagnostic{
+		Severity: SevError,
+		Msg:      "bad string",
+		Filename: "test.b",
+		Span:     Span{Pos{2, 17, 26}, Pos{2, 22, 31}},
+		Notes:    []string{"one", "two"},
+	}
+	want := `error: bad string
+ --> test.b:2:17
+  |
+2 | let s: string = "abc";
+  |                 ^^^^^
+  = note: one
+  = note: two
+
+1 error generated
+`
+	if got := printDiags(src, []Diagnostic{d}); got != want {
+		t.Errorf("expected:\n%s\ngot:\n%s", want, got)
+	}
+
+	// Without the source only the location is shown
+	d.Filename = "other.b"
+	d.Notes = nil
+	want = "error: bad string\n --> other.b:2:17\n1 error generated\n"
+	if got := printDiags(src, []Diagnostic{d}); got != want {
+		t.Errorf("expected:\n%s\ngot:\n%s", want, got)
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	err := errors.Join(
+		ParseError{Msg: "one", Filename: "a.b", Line: 1, Col: 2, Code: CodeSyntax},
+		errors.Join(errors.New("two"), ParseError{Msg: "three"}),
+	)
+	diags := Diagnostics(err, SevWarning)
+	msgs := []string{}
+	for _, d := range diags {
+		if d.Severity != SevWarning {
+			t.Errorf("expected a warning, got %v", d.Severity)
+		}
+		msgs = append(msgs, d.Msg)
+	}
+	if strings.Join(msgs, ",") != "one,two,three" {
+		t.Errorf("expected one,two,three got %v", msgs)
+	}
+	if diags[0].Code != CodeSyntax || diags[0].Filename != "a.b" {
+		t.Errorf("expected the ParseError's details to be kept, got %+v", diags[0])
+	}
+	if Diagnostics(nil, SevError) != nil {
+		t.Errorf("expected no diagnostics for a nil error")
+	}
+}
+
+func TestJSONDiagnostics(t *testing.T) {
+	src := "module m;\nlet a: int = 1;\nlet a: bool = b & c;\n"
+	p := NewParser(src, "test.b")
+	_, err := p.ParseModule()
+	diags := Diagnostics(err, SevError)
+	diags = append(diags, Diagnostic{Severity: SevWarning, Msg: "no position"})
+
+	out := strings.Builder{}
+	jp := NewJSONDiagnosticPrinter(&out)
+	for _, d := range diags {
+		jp.Print(d)
+	}
+	jp.PrintSummary()
+	want := `{"file":"test.b","range":{"start":{"line":3,"col":17,"offset":42},"end":{"line":3,"col":18,"offset":43}},"severity":"error","code":"E0001","message":"unexpected character '&', did you mean '&&'?","fix":{"message":"replace \"&\" with \"&&\"","range":{"start":{"line":3,"col":17,"offset":42},"end":{"line":3,"col":18,"offset":43}},"replacement":"&&"}}
+{"severity":"warning","message":"no position"}
+`
+	if out.String() != want {
+		t.Errorf("expected:\n%s\ngot:\n%s", want, out.String())
+	}
+
+	// Labels become related information
+	_, _, err = resolveSrc(t, "module m;\nlet a: int = 1;\nlet a: int = 2;\n")
+	out.Reset()
+	for _, d := range Diagnostics(err, SevError) {
+		jp.Print(d)
+	}
+	want = `{"file":"<filename>","range":{"start":{"line":3,"col":5,"offset":30},"end":{"line":3,"col":6,"offset":31}},"severity":"error","code":"E0102","message":"a redeclared in this scope, previous declaration at 2:5","related":[{"file":"<filename>","range":{"start":{"line":2,"col":5,"offset":14},"end":{"line":2,"col":6,"offset":15}},"message":"previous declaration of a"}]}
+`
+	if out.String() != want {
+		t.Errorf("expected:\n%s\ngot:\n%s", want, out.String())
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+)
+
+// DumpTokens writes every token in src, one per line, for debugging the
+// lexer
+func DumpTokens(w io.Writer, src string) {
+	lex := NewLexer(src)
+	for {
+		tok := lex.Next()
+		fmt.Fprintf(w, "%-7v %-4v %q", tok.Pos(), tok.Kind, tok.Text)
+		if tok.Error != nil {
+			fmt.Fprintf(w, "  error: %v", tok.Error)
+		}
+		fmt.Fprintln(w)
+		if tok.Kind == TokEof {
+			return
+		}
+	}
+}
+
+var nodeType = reflect.TypeOf((*Node)(nil)).Elem()
+
+// DumpAst writes n and everything under it as an indented tree. Each node
+// is shown with its span and any fields that aren't nodes, its children
+// follow on their own lines.
+func DumpAst(w io.Writer, n Node) {
+	dumpNode(w, reflect.ValueOf(n), 0, "")
+}
+
+func dumpNode(w io.Writer, v reflect.Value, depth int, field string) {
+	indent := strings.Repeat("  ", depth)
+	if field != "" {
+		field += ": "
+	}
+	if v.Kind() == reflect.Interface {
+		v = v.Elem()
+	}
+	n := v.Interface().(Node)
+	s := v.Elem()
+	fmt.Fprintf(w, "%s%s%s %v", indent, field, s.Type().Name(), n.Span())
+
+	type child struct {
+		name string
+		v    reflect.Value
+	}
+	children := []child{}
+	for i := 0; i < s.NumField(); i++ {
+		f := s.Type().Field(i)
+		fv := s.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		switch {
+		case f.Type.Implements(nodeType) || f.Type.Kind() == reflect.Slice:
+			children = append(children, child{f.Name, fv})
+		case f.Type.Kind() == reflect.String:
+			fmt.Fprintf(w, " %s=%q", f.Name, fv.String())
+		default:
+			fmt.Fprintf(w, " %s=%v", f.Name, fv.Interface())
+		}
+	}
+	fmt.Fprintln(w)
+
+	for _, c := range children {
+		if c.v.Kind() == reflect.Slice {
+			if c.v.Len() == 0 {
+				continue
+			}
+			fmt.Fprintf(w, "%s  %s:\n", indent, c.name)
+			for i := 0; i < c.v.Len(); i++ {
+				dumpNode(w, c.v.Index(i), depth+2, "")
+			}
+			continue
+		}
+		if !c.v.IsNil() {
+			dumpNode(w, c.v, depth+1, c.name)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestDumpAst(t *testing.T) {
+	src := "module m;\nfn f(a: int): int {\n\treturn -a + 1;\n}\n"
+	p := NewParser(src, "<filename>")
+	mod, err := p.ParseModule()
+	if err != nil {
+		t.Fatalf("ERR: %v", err)
+	}
+	out := strings.Builder{}
+	DumpAst(&out, mod)
+	want := `AstModule 1:1-4:2 Filename="<filename>"
+  Name: AstIdent 1:8-1:9 Name="m"
+  Statements:
+    AstFnDecl 2:1-4:2
+      Name: AstIdent 2:4-2:5 Name="f"
+      ReturnType: AstType 2:15-2:18
+        Name: AstIdent 2:15-2:18 Name="int"
+      Params:
+        AstParam 2:6-2:12
+          Name: AstIdent 2:6-2:7 Name="a"
+          Type: AstType 2:9-2:12
+            Name: AstIdent 2:9-2:12 Name="int"
+      Body: AstBlock 2:19-4:2
+        Body:
+          AstReturn 3:2-3:15
+            Value: AstBinaryExpr 3:9-3:15 Op=` + fmt.Sprint(TokPlus) + `
+              Left: AstUnaryExpr 3:9-3:11 Op=` + fmt.Sprint(TokMinus) + `
+                Expr: AstIdent 3:10-3:11 Name="a"
+              Right: AstIntLitExpr 3:14-3:15 Value=1
+`
+	if out.String() != want {
+		t.Errorf("expected:\n%s\ngot:\n%s", want, out.String())
+	}
+}
+
+func TestDumpTokens(t *testing.T) {
+	out := strings.Builder{}
+	DumpTokens(&out, "let a = &;")
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 6 {
+		t.Fatalf("expected 6 tokens, got %q", lines)
+	}
+	if !strings.HasPrefix(lines[1], "1:5 ") || !strings.HasSuffix(lines[1], `"a"`) {
+		t.Errorf("expected the identifier a at 1:5, got %q", lines[1])
+	}
+	if !strings.HasSuffix(lines[3], `"&"  error: unexpected character '&', did you mean '&&'?`) {
+		t.Errorf("expected the lexer error to be shown, got %q", lines[3])
+	}
+}
@@ -4,8 +4,10 @@ fn main(): int {
    let x: string = "thing";
    printf("Hi: %s %d\n", "more", 12);
    printf("X: %s\n", x);
+   return 0;
 }
 
-fn bar(arg: string): int {}	
-fn baz(arg: string,): int {}	
-fn more(arg: string, another: int): string {}	
\ No newline at end of file
+fn bar(arg: string): int { return 1; }	
+fn baz(arg: string,): int { return 2; }	
+fn more(arg: string, another: int): string { return arg; }	
+fn nothing(): void {}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+)
+
+// inlineLimit is the most instructions a function can have and still be
+// inlined
+const inlineLimit = 20
+
+// inlineCalls copies the bodies of small functions that can't end up
+// calling themselves into the places they're called. Only the calls that
+// were there to begin with are inlined, so it's done once each time the
+// pass runs.
+func inlineCalls(m *IrModule) {
+	funcs := map[string]*IrFunc{}
+	for _, f := range m.Funcs {
+		funcs[f.Name] = f
+	}
+	small := map[*IrFunc]bool{}
+	for _, f := range m.Funcs {
+		small[f] = size(f) <= inlineLimit && !recursive(f, funcs)
+	}
+	for _, f := range m.funcs() {
+		calls := []*IrInstr{}
+		for _, b := range f.Blocks {
+			for _, in := range b.Instrs {
+				if callee := funcs[in.Callee]; in.Op == IrCall && callee != f && small[callee] {
+					calls = append(calls, in)
+				}
+			}
+		}
+		if len(calls) == 0 {
+			continue
+		}
+		inl := &inliner{f: f, labels: map[string]bool{}, names: map[string]bool{}}
+		for _, b := range f.Blocks {
+			inl.labels[b.Label] = true
+		}
+		for _, v := range append(slices.Clone(f.Params), f.Locals...) {
+			inl.names[v.Name] = true
+		}
+		for _, call := range calls {
+			inl.inline(call, funcs[call.Callee])
+		}
+		// The code after a call to a function that never returns can't be
+		// reached
+		removeUnreachable(f)
+	}
+}
+
+// size is how many instructions a function has
+func size(f *IrFunc) int {
+	n := 0
+	for _, b := range f.Blocks {
+		n += len(b.Instrs)
+	}
+	return n
+}
+
+// recursive reports if f can call itself, directly or through other
+// functions
+func recursive(f *IrFunc, funcs map[string]*IrFunc) bool {
+	seen := map[*IrFunc]bool{}
+	var calls func(g *IrFunc) bool
+	calls = func(g *IrFunc) bool {
+		for _, b := range g.Blocks {
+			for _, in := range b.Instrs {
+				callee := funcs[in.Callee]
+				if in.Op != IrCall || callee == nil {
+					continue
+				}
+				if callee == f {
+					return true
+				}
+				if !seen[callee] {
+					seen[callee] = true
+					if calls(callee) {
+						return true
+					}
+				}
+			}
+		}
+		return false
+	}
+	return calls(f)
+}
+
+type inliner struct {
+	f *IrFunc
+	// The labels and variable names already used in f
+	labels map[string]bool
+	names  map[string]bool
+	n      int
+}
+
+// unique makes name different to everything in used
+func unique(name string, used map[string]bool) string {
+	s := name
+	for i := 2; used[s]; i++ {
+		s = fmt.Sprintf("%s.%d", name, i)
+	}
+	used[s] = true
+	return s
+}
+
+// inline replaces call with a copy of callee's body. The block the call
+// is in is split in two: the part before the call jumps to the copy, and
+// the copy's returns jump to the rest, where a phi picks the result.
+func (inl *inliner) inline(call *IrInstr, callee *IrFunc) {
+	f := inl.f
+	var b *IrBlock
+	at := -1
+	for _, x := range f.Blocks {
+		if at = slices.Index(x.Instrs, call); at >= 0 {
+			b = x
+			break
+		}
+	}
+	inl.n++
+	prefix := fmt.Sprintf("inline.%d.", inl.n)
+
+	vars := map[*IrVar]IrValue{}
+	copies := []*IrInstr{}
+	for i, p := range callee.Params {
+		vars[p] = call.Args[i]
+		// A global could change before the parameter is used
+		if g, ok := call.Args[i].(*IrVar); ok && g.Kind == IrGlobal {
+			t := &IrVar{Type: g.Type, Kind: IrTemp}
+			copies = append(copies, &IrInstr{Op: IrCopy, Dst: t, Args: []IrValue{g}})
+			vars[p] = t
+		}
+	}
+	for _, v := range callee.Locals {
+		if v.Kind == IrTemp {
+			vars[v] = &IrVar{Type: v.Type, Kind: IrTemp}
+		} else {
+			vars[v] = &IrVar{Name: unique(callee.Name+"."+v.Name, inl.names), Type: v.Type, Kind: IrLocal}
+		}
+	}
+	value := func(a IrValue) IrValue {
+		if v, ok := a.(*IrVar); ok && vars[v] != nil {
+			return vars[v]
+		}
+		return a
+	}
+	blocks := map[*IrBlock]*IrBlock{}
+	body := []*IrBlock{}
+	for _, cb := range callee.Blocks {
+		nb := &IrBlock{Label: unique(prefix+cb.Label, inl.labels)}
+		blocks[cb] = nb
+		body = append(body, nb)
+	}
+	cont := &IrBlock{Label: unique(prefix+"done", inl.labels)}
+
+	results := &IrInstr{Op: IrPhi, Dst: call.Dst}
+	for _, cb := range callee.Blocks {
+		nb := blocks[cb]
+		for _, in := range cb.Instrs {
+			if in.Op == IrRet {
+				if len(in.Args) > 0 {
+					results.Args = append(results.Args, value(in.Args[0]))
+					results.Preds = append(results.Preds, nb)
+				}
+				nb.Instrs = append(nb.Instrs, &IrInstr{Op: IrJmp, Targets: []*IrBlock{cont}})
+				continue
+			}
+			c := &IrInstr{Op: in.Op, Callee: in.Callee}
+			if in.Dst != nil {
+				c.Dst = value(in.Dst).(*IrVar)
+			}
+			for _, a := range in.Args {
+				c.Args = append(c.Args, value(a))
+			}
+			for _, t := range in.Targets {
+				c.Targets = append(c.Targets, blocks[t])
+			}
+			for _, p := range in.Preds {
+				c.Preds = append(c.Preds, blocks[p])
+			}
+			nb.Instrs = append(nb.Instrs, c)
+		}
+	}
+
+	cont.Instrs = slices.Clone(b.Instrs[at+1:])
+	b.Instrs = append(append(b.Instrs[:at], copies...), &IrInstr{Op: IrJmp, Targets: []*IrBlock{body[0]}})
+	for _, s := range cont.Succs() {
+		for _, phi := range phis(s) {
+			for i, p := range phi.Preds {
+				if p == b {
+					phi.Preds[i] = cont
+				}
+			}
+		}
+	}
+	if call.Dst != nil && len(results.Args) > 0 {
+		result := []*IrInstr{results}
+		if len(results.Args) == 1 {
+			result[0] = &IrInstr{Op: IrCopy, Dst: call.Dst, Args: results.Args}
+		}
+		// Phis only set variables that are in SSA form
+		if call.Dst.Kind == IrGlobal {
+			t := &IrVar{Type: call.Dst.Type, Kind: IrTemp}
+			result[0].Dst = t
+			result = append(result, &IrInstr{Op: IrCopy, Dst: call.Dst, Args: []IrValue{t}})
+		}
+		cont.Instrs = slices.Insert(cont.Instrs, 0, result...)
+	}
+	i := slices.Index(f.Blocks, b) + 1
+	f.Blocks = slices.Insert(f.Blocks, i, append(body, cont)...)
+}
@@ -0,0 +1,492 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// The interpreter runs a checked module straight from its AST, without
+// needing a C compiler. It is meant to behave exactly like the compiled
+// program: ints wrap around at 32 bits and the builtins format their
+// output the way the C library does.
+
+// frame holds the values of the locals of one function call. Nested
+// functions can see the frame of the call they were declared in.
+type frame struct {
+	vars   map[*Symbol]any
+	parent *frame
+}
+
+func newFrame(parent *frame) *frame {
+	return &frame{vars: map[*Symbol]any{}, parent: parent}
+}
+
+// lookup finds the frame holding sym, nil if it isn't in any of them
+func (f *frame) lookup(sym *Symbol) *frame {
+	for ; f != nil; f = f.parent {
+		if _, ok := f.vars[sym]; ok {
+			return f
+		}
+	}
+	return nil
+}
+
+// closure is the value of a function, with the frame it was declared in
+type closure struct {
+	fn  *AstFnDecl
+	env *frame
+}
+
+// control says how a statement finished, anything but ctlNext unwinds
+// until it reaches the loop or call it's meant for
+type control int
+
+const (
+	ctlNext control = iota
+	ctlBreak
+	ctlContinue
+	ctlReturn
+)
+
+type interpreter struct {
+	filename string
+	res      *Resolution
+	out      *bufio.Writer
+	globals  *frame
+
+	// Set by break, continue and return for whatever they unwind to
+	label  *AstIdent
+	result any
+}
+
+// Interpret runs mod's main function, after initialising its globals in
+// order, and returns the exit status main returns. Output from the
+// builtins goes to out.
+func Interpret(mod *AstModule, res *Resolution, out io.Writer) (int, error) {
+	in := newInterpreter(mod, res, out)
+	defer in.out.Flush()
+
+	var main *closure
+	for _, st := range mod.Statements {
+		if fn, ok := st.(*AstFnDecl); ok {
+			c := in.defineFn(fn)
+			if fn.Name.Name == "main" {
+				main = c
+			}
+		}
+	}
+	for _, st := range mod.Statements {
+		if _, err := in.stmt(in.globals, st); err != nil {
+			return 0, err
+		}
+	}
+	if main == nil {
+		err := nodeError(in.filename, mod.Name, "module %s has no main function to run", mod.Name.Name)
+		err.Code = CodeRuntime
+		return 0, err
+	}
+	result, err := in.call(main, nil)
+	if err != nil {
+		return 0, err
+	}
+	if code, ok := result.(int); ok {
+		return code, nil
+	}
+	return 0, nil
+}
+
+func newInterpreter(mod *AstModule, res *Resolution, out io.Writer) *interpreter {
+	return &interpreter{
+		filename: mod.Filename,
+		res:      res,
+		out:      bufio.NewWriter(out),
+		globals:  newFrame(nil),
+	}
+}
+
+// defineFn makes a top level function callable, they're all defined
+// before anything runs so they can be called before they're declared
+func (in *interpreter) defineFn(fn *AstFnDecl) *closure {
+	c := &closure{fn, in.globals}
+	in.globals.vars[in.res.SymbolOf(fn.Name)] = c
+	return c
+}
+
+func (in *interpreter) errorAt(n Node, format string, a ...any) error {
+	err := nodeError(in.filename, n, format, a...)
+	err.Code = CodeRuntime
+	return err
+}
+
+func (in *interpreter) call(c *closure, args []any) (any, error) {
+	f := newFrame(c.env)
+	for i, p := range c.fn.Params {
+		f.vars[in.res.SymbolOf(p.Name)] = args[i]
+	}
+	ctl, err := in.block(f, c.fn.Body)
+	if err != nil || ctl != ctlReturn {
+		return nil, err
+	}
+	result := in.result
+	in.result = nil
+	return result, nil
+}
+
+func (in *interpreter) set(f *frame, id *AstIdent, v any) {
+	sym := in.res.SymbolOf(id)
+	if owner := f.lookup(sym); owner != nil {
+		f = owner
+	}
+	f.vars[sym] = v
+}
+
+func (in *interpreter) get(f *frame, id *AstIdent) any {
+	sym := in.res.SymbolOf(id)
+	return f.lookup(sym).vars[sym]
+}
+
+func (in *interpreter) block(f *frame, b *AstBlock) (control, error) {
+	for _, st := range b.Body {
+		if ctl, err := in.stmt(f, st); ctl != ctlNext || err != nil {
+			return ctl, err
+		}
+	}
+	return ctlNext, nil
+}
+
+func (in *interpreter) stmt(f *frame, st AstStatement) (control, error) {
+	switch n := st.(type) {
+	case *AstConstAssign:
+		return in.declare(f, n.Ident, n.Value)
+	case *AstVarDecl:
+		return in.declare(f, n.Ident, n.Value)
+	case *AstAssign:
+		v, err := in.expr(f, n.Value)
+		if err != nil {
+			return ctlNext, err
+		}
+		if op, ok := compoundOps[n.Op]; ok {
+			v, err = in.arith(n, op, in.get(f, n.Target).(int), v.(int))
+			if err != nil {
+				return ctlNext, err
+			}
+		}
+		in.set(f, n.Target, v)
+	case *AstFnDecl:
+		if f != in.globals {
+			f.vars[in.res.SymbolOf(n.Name)] = &closure{n, f}
+		}
+	case *AstFnCall:
+		_, err := in.expr(f, n)
+		return ctlNext, err
+	case *AstBlock:
+		return in.block(f, n)
+	case *AstIf:
+		cond, err := in.expr(f, n.Cond)
+		if err != nil {
+			return ctlNext, err
+		}
+		if cond.(bool) {
+			return in.block(f, n.Then)
+		} else if n.Else != nil {
+			return in.stmt(f, n.Else)
+		}
+	case *AstWhile:
+		for {
+			cond, err := in.expr(f, n.Cond)
+			if err != nil || !cond.(bool) {
+				return ctlNext, err
+			}
+			if stop, ctl, err := in.loopBody(f, n.Label, n.Body); stop {
+				return ctl, err
+			}
+		}
+	case *AstFor:
+		if n.Init != nil {
+			if _, err := in.stmt(f, n.Init); err != nil {
+				return ctlNext, err
+			}
+		}
+		for {
+			if n.Cond != nil {
+				cond, err := in.expr(f, n.Cond)
+				if err != nil || !cond.(bool) {
+					return ctlNext, err
+				}
+			}
+			if stop, ctl, err := in.loopBody(f, n.Label, n.Body); stop {
+				return ctl, err
+			}
+			if n.Step != nil {
+				if _, err := in.stmt(f, n.Step); err != nil {
+					return ctlNext, err
+				}
+			}
+		}
+	case *AstRangeFor:
+		lo, err := in.expr(f, n.Lo)
+		if err != nil {
+			return ctlNext, err
+		}
+		// The upper bound is only evaluated once
+		hi, err := in.expr(f, n.Hi)
+		if err != nil {
+			return ctlNext, err
+		}
+		sym := in.res.SymbolOf(n.Var)
+		for i := lo.(int); i < hi.(int); i++ {
+			f.vars[sym] = i
+			if stop, ctl, err := in.loopBody(f, n.Label, n.Body); stop {
+				return ctl, err
+			}
+		}
+	case *AstBreak:
+		in.label = n.Label
+		return ctlBreak, nil
+	case *AstContinue:
+		in.label = n.Label
+		return ctlContinue, nil
+	case *AstReturn:
+		in.result = nil
+		if n.Value != nil {
+			v, err := in.expr(f, n.Value)
+			if err != nil {
+				return ctlNext, err
+			}
+			in.result = v
+		}
+		return ctlReturn, nil
+	default:
+		panic(fmt.Sprintf("interp: unhandled statement %T", st))
+	}
+	return ctlNext, nil
+}
+
+func (in *interpreter) declare(f *frame, id *AstIdent, value AstExpr) (control, error) {
+	v, err := in.expr(f, value)
+	if err != nil {
+		return ctlNext, err
+	}
+	f.vars[in.res.SymbolOf(id)] = v
+	return ctlNext, nil
+}
+
+// loopBody runs one iteration of a loop, stop says if the loop should
+// finish and what it finishes with. Breaks and continues for this loop
+// end here, anything else carries on unwinding.
+func (in *interpreter) loopBody(f *frame, label *AstIdent, body *AstBlock) (stop bool, ctl control, err error) {
+	ctl, err = in.block(f, body)
+	if err != nil {
+		return true, ctlNext, err
+	}
+	switch ctl {
+	case ctlNext:
+		return false, ctlNext, nil
+	case ctlBreak, ctlContinue:
+		// An unlabelled break or continue is for the innermost loop
+		if in.label == nil || (label != nil && in.label.Name == label.Name) {
+			in.label = nil
+			return ctl == ctlBreak, ctlNext, nil
+		}
+	}
+	return true, ctl, nil
+}
+
+// wrap makes n behave like a 32 bit C int
+func wrap(n int) int {
+	return int(int32(n))
+}
+
+func (in *interpreter) arith(n Node, op TokenKind, l, r int) (int, error) {
+	switch op {
+	case TokPlus:
+		return wrap(l + r), nil
+	case TokMinus:
+		return wrap(l - r), nil
+	case TokStar:
+		return wrap(l * r), nil
+	case TokDiv, TokPercent:
+		if r == 0 {
+			return 0, in.errorAt(n, "integer division by zero")
+		}
+		if op == TokDiv {
+			return wrap(l / r), nil
+		}
+		return wrap(l % r), nil
+	}
+	panic(fmt.Sprintf("interp: unhandled operator %v", op))
+}
+
+func (in *interpreter) expr(f *frame, e AstExpr) (any, error) {
+	switch n := e.(type) {
+	case *AstIntLitExpr:
+		return wrap(n.Value), nil
+	case *AstStringLitExpr:
+		return n.Value, nil
+	case *AstBoolLitExpr:
+		return n.Value, nil
+	case *AstIdent:
+		return in.get(f, n), nil
+	case *AstFnCall:
+		args := make([]any, len(n.Args))
+		for i, arg := range n.Args {
+			v, err := in.expr(f, arg)
+			if err != nil {
+				return nil, err
+			}
+			args[i] = v
+		}
+		sym := in.res.SymbolOf(n.Name)
+		if sym.Kind == SymBuiltin {
+			return callBuiltin(in.out, sym.Name, args), nil
+		}
+		return in.call(in.get(f, n.Name).(*closure), args)
+	case *AstUnaryExpr:
+		v, err := in.expr(f, n.Expr)
+		if err != nil {
+			return nil, err
+		}
+		if n.Op == TokNot {
+			return !v.(bool), nil
+		}
+		return wrap(-v.(int)), nil
+	case *AstBinaryExpr:
+		l, err := in.expr(f, n.Left)
+		if err != nil {
+			return nil, err
+		}
+		// && and || only evaluate the right side if they need it
+		switch n.Op {
+		case TokAnd:
+			if !l.(bool) {
+				return false, nil
+			}
+			return in.expr(f, n.Right)
+		case TokOr:
+			if l.(bool) {
+				return true, nil
+			}
+			return in.expr(f, n.Right)
+		}
+		r, err := in.expr(f, n.Right)
+		if err != nil {
+			return nil, err
+		}
+		switch n.Op {
+		case TokEq:
+			return l == r, nil
+		case TokNeq:
+			return l != r, nil
+		case TokLt:
+			return l.(int) < r.(int), nil
+		case TokLte:
+			return l.(int) <= r.(int), nil
+		case TokGt:
+			return l.(int) > r.(int), nil
+		case TokGte:
+			return l.(int) >= r.(int), nil
+		}
+		return in.arith(n, n.Op, l.(int), r.(int))
+	}
+	panic(fmt.Sprintf("interp: unhandled expression %T", e))
+}
+
+// callBuiltin calls one of the Builtins the way the C library would,
+// with ints, bools and strings for args
+func callBuiltin(out *bufio.Writer, name string, args []any) int {
+	// C passes bools as ints
+	for i, arg := range args {
+		if b, ok := arg.(bool); ok {
+			args[i] = 0
+			if b {
+				args[i] = 1
+			}
+		}
+	}
+	return builtinFuncs[name](out, args)
+}
+
+var builtinFuncs = map[string]func(out *bufio.Writer, args []any) int{
+	"printf": func(out *bufio.Writer, args []any) int {
+		s := cFormat(args[0].(string), args[1:])
+		out.WriteString(s)
+		return len(s)
+	},
+	"puts": func(out *bufio.Writer, args []any) int {
+		s := args[0].(string)
+		out.WriteString(s)
+		out.WriteByte('\n')
+		return len(s) + 1
+	},
+	"putchar": func(out *bufio.Writer, args []any) int {
+		c := byte(args[0].(int))
+		out.WriteByte(c)
+		return int(c)
+	},
+}
+
+// cFormat formats args like C's printf. Go's verbs take the same flags,
+// width and precision, so each conversion is translated into one of them.
+func cFormat(format string, args []any) string {
+	var b strings.Builder
+	next := func() any {
+		if len(args) == 0 {
+			return nil
+		}
+		arg := args[0]
+		args = args[1:]
+		return arg
+	}
+	for i := 0; i < len(format); i++ {
+		c := format[i]
+		if c != '%' {
+			b.WriteByte(c)
+			continue
+		}
+		// Flags, width and precision, where a * takes an argument
+		spec := strings.Builder{}
+		spec.WriteByte('%')
+		for i++; i < len(format) && strings.IndexByte("-+ #0123456789.*", format[i]) >= 0; i++ {
+			if format[i] == '*' {
+				fmt.Fprint(&spec, next())
+			} else {
+				spec.WriteByte(format[i])
+			}
+		}
+		// Length modifiers make no difference when every int is an int
+		for i < len(format) && strings.IndexByte("hlLqjzt", format[i]) >= 0 {
+			i++
+		}
+		if i == len(format) {
+			b.WriteString(spec.String())
+			break
+		}
+		verb := format[i]
+		switch verb {
+		case '%':
+			b.WriteByte('%')
+			continue
+		case 'i', 'u':
+			verb = 'd'
+		case 'c':
+			// The byte as it is, not the UTF-8 for it
+			verb = 's'
+		}
+		arg := next()
+		switch format[i] {
+		case 'u', 'x', 'X', 'o':
+			if n, ok := arg.(int); ok {
+				arg = uint32(n)
+			}
+		case 'c':
+			if n, ok := arg.(int); ok {
+				arg = string([]byte{byte(n)})
+			}
+		}
+		spec.WriteByte(verb)
+		fmt.Fprintf(&b, spec.String(), arg)
+	}
+	return b.String()
+}
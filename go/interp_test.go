@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os/exec"
+	"testing"
+)
+
+// interpSrc checks and interprets src, returning its output and exit status
+func interpSrc(t *testing.T, src string) (string, int, error) {
+	t.Helper()
+	mod, res, _, err := checkSrc(t, src)
+	if err != nil {
+		t.Fatalf("checking %q: %v", src, err)
+	}
+	out := bytes.Buffer{}
+	code, err := Interpret(mod, res, &out)
+	return out.String(), code, err
+}
+
+func TestInterp(t *testing.T) {
+	for _, tc := range backendCases {
+		src := backendPrelude + "fn main(): int {\n" + tc.body + "\n}\n"
+		out, code, err := interpSrc(t, src)
+		if err != nil || out != tc.out || code != tc.code {
+			t.Errorf("interpreting %q: expected %q and status %d, got %q, %d and %v", tc.body, tc.out, tc.code, out, code, err)
+		}
+	}
+}
+
+func TestInterpPrograms(t *testing.T) {
+	cases := []struct {
+		name string
+		src  string
+		out  string
+		code int
+	}{
+		{
+			name: "global initialisers",
+			src: `module m;
+let a = add(2, 3);
+var b = a * 2;
+fn add(x: int, y: int): int { return x + y; }
+fn main(): int { b += 1; return a + b; }`,
+			code: 16,
+		},
+		{
+			name: "nested functions call each other",
+			src: `module m;
+var n = 1;
+fn main(): int {
+	fn bump(by: int): void { n += by; }
+	fn twice(by: int): void { bump(by); bump(by); }
+	twice(2);
+	bump(3);
+	return n;
+}`,
+			code: 8,
+		},
+		{
+			name: "recursion gets a frame per call",
+			src: `module m;
+fn fib(n: int): int {
+	if n < 2 { return n; }
+	let a = fib(n - 1);
+	let b = fib(n - 2);
+	return a + b;
+}
+fn main(): int { return fib(10); }`,
+			code: 55,
+		},
+		{
+			name: "return from inside loops",
+			src: `module m;
+fn find(): int {
+	for i in 0..10 { while true { if i == 4 { return i; } break; } }
+	return -1;
+}
+fn main(): int { return find(); }`,
+			code: 4,
+		},
+		{
+			name: "void main",
+			src:  `module m; fn main(): void { printf("%s!\n", "done"); }`,
+			out:  "done!\n",
+		},
+		{
+			name: "printf conversions",
+			src:  `module m; fn main(): int { printf("[%5d|%-4s|%x|%X|%o|%c|%u|%%|%03i|%*d]\n", 42, "ab", 255, 255, 8, 66, -1, 7, 4, 9); return 0; }`,
+			out:  "[   42|ab  |ff|FF|10|B|4294967295|%|007|   9]\n",
+		},
+		{
+			name: "printf returns the length",
+			src:  `module m; fn main(): int { return printf("%s\n", "four"); }`,
+			out:  "four\n",
+			code: 5,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			out, code, err := interpSrc(t, tc.src)
+			if err != nil || out != tc.out || code != tc.code {
+				t.Errorf("expected %q and status %d, got %q, %d and %v", tc.out, tc.code, out, code, err)
+			}
+		})
+	}
+}
+
+func TestInterpErrors(t *testing.T) {
+	cases := []struct {
+		src  string
+		want string
+	}{
+		{"module m;\nfn main(): int {\n\tlet z = 0;\n\treturn 1 / z;\n}\n", "<filename>:4:9  integer division by zero"},
+		{"module m;\nfn main(): int {\n\tvar z = 0;\n\tz %= z;\n\treturn z;\n}\n", "<filename>:4:2  integer division by zero"},
+		{"module m;\nfn other(): void {}\n", "<filename>:1:8  module m has no main function to run"},
+	}
+	for _, tc := range cases {
+		_, _, err := interpSrc(t, tc.src)
+		var perr ParseError
+		if !errors.As(err, &perr) || perr.Code != CodeRuntime || err.Error() != tc.want {
+			t.Errorf("interpreting %q: expected %q got %v", tc.src, tc.want, err)
+		}
+	}
+}
+
+// The interpreter is the reference for what programs do, so its output
+// should match the C backend's exactly
+func TestInterpMatchesC(t *testing.T) {
+	if _, err := exec.LookPath("cc"); err != nil {
+		t.Skip("no C compiler")
+	}
+	srcs := []string{
+		`module m; fn main(): int { printf("%8.3s|%-6d|%+d|% d|%#x|%#o\n", "abcdef", -12, 5, 5, 255, 8); return 0; }`,
+		`module m; fn main(): int { var x = 1; for i in 0..40 { x *= 3; printf("%d ", x); } return x % 256; }`,
+		`module m; fn main(): int { printf("%d %d\n", -7 / 2, -7 % 2); return 0 - 1; }`,
+	}
+	for _, src := range srcs {
+		want, wantCode := buildAndRun(t, src, "c")
+		out, code, err := interpSrc(t, src)
+		if err != nil || out != want || code&0xff != wantCode {
+			t.Errorf("interpreting %q: the C backend gave %q and status %d, got %q, %d and %v", src, want, wantCode, out, code, err)
+		}
+	}
+}
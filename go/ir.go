@@ -0,0 +1,277 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// The IR is a typed three-address code. Each function is a list of basic
+// blocks. A block is a straight run of instructions, and it ends with the
+// only jump, branch or return in it. An instruction takes at most two
+// operands and puts its result in a variable. Operands are constants or
+// variables: the program's own locals and globals, or the temporaries
+// made for the values in between. As it's lowered, variables can be
+// assigned more than once, ToSSA puts it into SSA form for optimising.
+//
+// Nested functions are lifted out to the module level, named after the
+// function they're in, and the module level declarations are set by an
+// init function, like they are with the asm backend.
+
+type IrOp int
+
+const (
+	IrCopy IrOp = iota // dst = a
+	IrNeg
+	IrNot
+	IrAdd // dst = a op b, ints wrap around like 32 bit C ints
+	IrSub
+	IrMul
+	IrDiv
+	IrMod
+	IrEq
+	IrNe
+	IrLt
+	IrLe
+	IrGt
+	IrGe
+	IrCall    // dst = Callee(args...), dst is nil for a void function
+	IrBuiltin // the same for one of the Builtins
+	IrJmp     // go to Targets[0]
+	IrBr      // go to Targets[0] if a is true, otherwise Targets[1]
+	IrRet     // return a, or nothing if there are no args
+	IrPhi     // dst = args[i] when coming from Preds[i], only at the start of a block
+)
+
+var irOpNames = []string{
+	IrCopy:    "copy",
+	IrNeg:     "neg",
+	IrNot:     "not",
+	IrAdd:     "add",
+	IrSub:     "sub",
+	IrMul:     "mul",
+	IrDiv:     "div",
+	IrMod:     "mod",
+	IrEq:      "eq",
+	IrNe:      "ne",
+	IrLt:      "lt",
+	IrLe:      "le",
+	IrGt:      "gt",
+	IrGe:      "ge",
+	IrCall:    "call",
+	IrBuiltin: "builtin",
+	IrJmp:     "jmp",
+	IrBr:      "br",
+	IrRet:     "ret",
+	IrPhi:     "phi",
+}
+
+func (op IrOp) String() string {
+	if int(op) < len(irOpNames) {
+		return irOpNames[op]
+	}
+	return fmt.Sprintf("IrOp(%d)", int(op))
+}
+
+// IsTerminator reports if op ends a block
+func (op IrOp) IsTerminator() bool {
+	return op == IrJmp || op == IrBr || op == IrRet
+}
+
+// IrModule is a module lowered to the IR
+type IrModule struct {
+	Name     string
+	Filename string
+	Globals  []*IrVar
+	// Every function, nested ones included. They have unique names.
+	Funcs []*IrFunc
+	// Init sets the globals, it's nil if there aren't any
+	Init *IrFunc
+}
+
+type IrFunc struct {
+	Name   string
+	Params []*IrVar
+	Result *Type
+	// Every other variable the function uses, temporaries included, in the
+	// order they were made
+	Locals []*IrVar
+	// The first block is where the function starts
+	Blocks []*IrBlock
+}
+
+type IrBlock struct {
+	// Unique within the function
+	Label  string
+	Instrs []*IrInstr
+}
+
+// Terminator is the instruction the block ends with
+func (b *IrBlock) Terminator() *IrInstr {
+	return b.Instrs[len(b.Instrs)-1]
+}
+
+// Succs are the blocks b can go to next
+func (b *IrBlock) Succs() []*IrBlock {
+	return b.Terminator().Targets
+}
+
+type IrInstr struct {
+	Op IrOp
+	// Where the result goes, nil if there isn't one
+	Dst  *IrVar
+	Args []IrValue
+	// The function IrCall and IrBuiltin call
+	Callee string
+	// Where IrJmp and IrBr go
+	Targets []*IrBlock
+	// Where each of an IrPhi's args comes from
+	Preds []*IrBlock
+}
+
+// IrValue is an operand, an *IrConst or an *IrVar
+type IrValue interface {
+	fmt.Stringer
+	ValueType() *Type
+}
+
+// IrConst is a constant int, bool or string. Bools are kept in Int as 0
+// or 1.
+type IrConst struct {
+	Type *Type
+	Int  int
+	Str  string
+}
+
+func IntConst(n int) *IrConst {
+	return &IrConst{Type: TypInt, Int: n}
+}
+
+func BoolConst(b bool) *IrConst {
+	if b {
+		return &IrConst{Type: TypBool, Int: 1}
+	}
+	return &IrConst{Type: TypBool}
+}
+
+func (c *IrConst) ValueType() *Type {
+	return c.Type
+}
+
+func (c *IrConst) String() string {
+	switch c.Type {
+	case TypString:
+		return cStringLiteral(c.Str)
+	case TypBool:
+		return fmt.Sprint(c.Int != 0)
+	}
+	return fmt.Sprint(c.Int)
+}
+
+type IrVarKind int
+
+const (
+	IrTemp IrVarKind = iota
+	IrLocal
+	IrParam
+	IrGlobal
+)
+
+// IrVar is somewhere a value is kept. Locals are named after the
+// variable they hold, with a number added when a function has more than
+// one variable of that name.
+type IrVar struct {
+	Name string
+	Type *Type
+	Kind IrVarKind
+	// Const is set for lets, which are only set once
+	Const bool
+	// Init is the value a global starts with, when it's known at compile
+	// time rather than set by the init function
+	Init *IrConst
+}
+
+func (v *IrVar) ValueType() *Type {
+	return v.Type
+}
+
+func (v *IrVar) String() string {
+	switch v.Kind {
+	case IrTemp:
+		return "%" + v.Name
+	case IrGlobal:
+		return "@" + v.Name
+	}
+	return v.Name
+}
+
+// WriteIR writes a readable listing of the module
+func WriteIR(w io.Writer, m *IrModule) {
+	fmt.Fprintf(w, "module %s\n", m.Name)
+	if len(m.Globals) > 0 {
+		fmt.Fprintln(w)
+	}
+	for _, g := range m.Globals {
+		kind := "global"
+		if g.Const {
+			kind = "const"
+		}
+		fmt.Fprintf(w, "%s %s: %s", kind, g, g.Type)
+		if g.Init != nil {
+			fmt.Fprintf(w, " = %s", g.Init)
+		}
+		fmt.Fprintln(w)
+	}
+	for _, f := range m.Funcs {
+		fmt.Fprintln(w)
+		f.write(w)
+	}
+	if m.Init != nil {
+		fmt.Fprintln(w)
+		m.Init.write(w)
+	}
+}
+
+func (f *IrFunc) write(w io.Writer) {
+	params := []string{}
+	for _, p := range f.Params {
+		params = append(params, fmt.Sprintf("%s: %s", p, p.Type))
+	}
+	fmt.Fprintf(w, "func %s(%s): %s {\n", f.Name, strings.Join(params, ", "), f.Result)
+	for _, b := range f.Blocks {
+		fmt.Fprintf(w, "%s:\n", b.Label)
+		for _, in := range b.Instrs {
+			fmt.Fprintf(w, "  %s\n", in)
+		}
+	}
+	fmt.Fprintln(w, "}")
+}
+
+func (in *IrInstr) String() string {
+	b := strings.Builder{}
+	if in.Dst != nil {
+		fmt.Fprintf(&b, "%s: %s = ", in.Dst, in.Dst.Type)
+	}
+	b.WriteString(in.Op.String())
+	args := []string{}
+	for _, a := range in.Args {
+		args = append(args, a.String())
+	}
+	switch in.Op {
+	case IrCall, IrBuiltin:
+		fmt.Fprintf(&b, " %s(%s)", in.Callee, strings.Join(args, ", "))
+	case IrPhi:
+		for i := range args {
+			args[i] = fmt.Sprintf("[%s, %s]", args[i], in.Preds[i].Label)
+		}
+		b.WriteString(" " + strings.Join(args, ", "))
+	default:
+		for _, t := range in.Targets {
+			args = append(args, t.Label)
+		}
+		if len(args) > 0 {
+			b.WriteString(" " + strings.Join(args, ", "))
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// lowerSrc checks src and lowers it to the IR
+func lowerSrc(t *testing.T, src string) (*IrModule, error) {
+	t.Helper()
+	mod, res, info, err := checkSrc(t, src)
+	if err != nil {
+		t.Fatalf("checking %q: %v", src, err)
+	}
+	return BuildIR(mod, res, info)
+}
+
+func TestBuildIR(t *testing.T) {
+	src := `module m;
+var total = 0;
+fn main(): int {
+	let a = 1;
+	if a > 0 && total == 0 {
+		let a = "shadowed";
+		puts(a);
+	}
+	for i in 0..a {
+		total += i;
+	}
+	fn twice(n: int): int { return n * 2; }
+	return twice(-a);
+}
+`
+	want := `module m
+
+global @total: int = 0
+
+func main(): int {
+entry:
+  a: int = copy 1
+  %0: bool = gt a, 0
+  br %0, and.rhs.2, and.done.2
+and.rhs.2:
+  %1: int = copy @total
+  %0: bool = eq %1, 0
+  jmp and.done.2
+and.done.2:
+  br %0, if.then.1, if.done.1
+if.then.1:
+  a.1: string = copy "shadowed"
+  builtin puts(a.1)
+  jmp if.done.1
+if.done.1:
+  i: int = copy 0
+  %2: int = copy a
+  jmp for.cond.3
+for.cond.3:
+  %3: bool = lt i, %2
+  br %3, for.body.3, for.done.3
+for.body.3:
+  %4: int = copy @total
+  @total: int = add %4, i
+  jmp for.step.3
+for.step.3:
+  i: int = add i, 1
+  jmp for.cond.3
+for.done.3:
+  %5: int = neg a
+  %6: int = call main.twice(%5)
+  ret %6
+}
+
+func main.twice(n: int): int {
+entry:
+  %0: int = mul n, 2
+  ret %0
+}
+`
+	ir, err := lowerSrc(t, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := strings.Builder{}
+	WriteIR(&out, ir)
+	if out.String() != want {
+		t.Errorf("expected\n%s\ngot\n%s", want, out.String())
+	}
+}
+
+func TestBuildIRBlocks(t *testing.T) {
+	// Blocks end in the only terminator in them, and only go to blocks in
+	// the same function
+	for _, tc := range backendCases {
+		src := backendPrelude + "fn main(): int {\n" + tc.body + "\n}\n"
+		ir, err := lowerSrc(t, src)
+		if err != nil {
+			t.Fatalf("lowering %q: %v", tc.body, err)
+		}
+		for _, f := range ir.Funcs {
+			blocks := map[*IrBlock]bool{}
+			for _, b := range f.Blocks {
+				blocks[b] = true
+			}
+			for _, b := range f.Blocks {
+				for i, in := range b.Instrs {
+					if in.Op.IsTerminator() != (i == len(b.Instrs)-1) {
+						t.Errorf("lowering %q: %s %s has %s at %d of %d", tc.body, f.Name, b.Label, in, i, len(b.Instrs))
+					}
+				}
+				for _, s := range b.Succs() {
+					if !blocks[s] {
+						t.Errorf("lowering %q: %s %s goes to %s, which isn't in the function", tc.body, f.Name, b.Label, s.Label)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestBuildIRUnreachable(t *testing.T) {
+	src := "module m;\nfn f(b: bool): int {\n\tif b { return 1; } else { return 2; }\n\tputs(\"never\");\n}\nfn main(): int { return f(true); }\n"
+	ir, err := lowerSrc(t, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := strings.Builder{}
+	WriteIR(&out, ir)
+	if strings.Contains(out.String(), "never") || strings.Contains(out.String(), "if.done") {
+		t.Errorf("expected the code after the if to be removed:\n%s", out.String())
+	}
+}
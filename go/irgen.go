@@ -0,0 +1,507 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+)
+
+type irGen struct {
+	res  *Resolution
+	info *TypeInfo
+	mod  *IrModule
+
+	globals map[*Symbol]*IrVar
+	funcs   map[*AstFnDecl]*IrFunc
+	names   map[string]bool
+	// Functions waiting to be lowered, nested functions are lowered after
+	// the one they're in
+	pending []*AstFnDecl
+
+	// State for the function being lowered
+	fn     *IrFunc
+	cur    *IrBlock
+	vars   map[*Symbol]*IrVar
+	locals map[string]int
+	temps  int
+	labels int
+	loops  []irLoop
+}
+
+// irLoop is where a break or continue in a loop goes
+type irLoop struct {
+	label     *AstIdent
+	brk, cont *IrBlock
+}
+
+// BuildIR lowers a checked module to the IR
+func BuildIR(mod *AstModule, res *Resolution, info *TypeInfo) (*IrModule, error) {
+	g := &irGen{
+		res:     res,
+		info:    info,
+		mod:     &IrModule{Name: mod.Name.Name, Filename: mod.Filename},
+		globals: map[*Symbol]*IrVar{},
+		funcs:   map[*AstFnDecl]*IrFunc{},
+		names:   map[string]bool{},
+	}
+
+	inits := []AstStatement{}
+	for _, st := range mod.Statements {
+		switch n := st.(type) {
+		case *AstFnDecl:
+			g.addFunc(n, n.Name.Name)
+		case *AstConstAssign:
+			v := g.global(n.Ident)
+			v.Const = true
+			// The checker has worked out the lets that are constants
+			if v.Init = info.Consts[res.SymbolOf(n.Ident)]; v.Init == nil {
+				inits = append(inits, n)
+			}
+		case *AstVarDecl:
+			if !static(g.global(n.Ident), n.Value) {
+				inits = append(inits, n)
+			}
+		}
+	}
+	if len(inits) > 0 {
+		g.mod.Init = &IrFunc{Name: "<init>", Result: TypVoid}
+		g.function(nil, g.mod.Init, func() {
+			for _, st := range inits {
+				g.stmt(st)
+			}
+		})
+	}
+	for len(g.pending) > 0 {
+		fn := g.pending[0]
+		g.pending = g.pending[1:]
+		g.function(fn, g.funcs[fn], func() {
+			g.block(fn.Body)
+		})
+	}
+	return g.mod, nil
+}
+
+// addFunc adds a function to the module so it can be called before it's
+// lowered. Nested functions with the same name get a number added.
+func (g *irGen) addFunc(fn *AstFnDecl, name string) {
+	unique := name
+	for i := 2; g.names[unique]; i++ {
+		unique = fmt.Sprintf("%s.%d", name, i)
+	}
+	g.names[unique] = true
+	f := &IrFunc{Name: unique, Result: g.info.Defs[g.res.SymbolOf(fn.Name)].Result}
+	g.mod.Funcs = append(g.mod.Funcs, f)
+	g.funcs[fn] = f
+	g.pending = append(g.pending, fn)
+}
+
+func (g *irGen) global(id *AstIdent) *IrVar {
+	sym := g.res.SymbolOf(id)
+	v := &IrVar{Name: id.Name, Type: g.info.Defs[sym], Kind: IrGlobal}
+	g.globals[sym] = v
+	g.mod.Globals = append(g.mod.Globals, v)
+	return v
+}
+
+// static gives a global the value it starts with when it's set to a
+// literal, so it doesn't have to be set when the program starts
+func static(v *IrVar, e AstExpr) bool {
+	switch n := e.(type) {
+	case *AstIntLitExpr:
+		v.Init = IntConst(n.Value)
+	case *AstBoolLitExpr:
+		v.Init = BoolConst(n.Value)
+	case *AstStringLitExpr:
+		v.Init = &IrConst{Type: TypString, Str: n.Value}
+	case *AstUnaryExpr:
+		lit, ok := n.Expr.(*AstIntLitExpr)
+		if !ok || n.Op != TokMinus {
+			return false
+		}
+		v.Init = IntConst(-lit.Value)
+	default:
+		return false
+	}
+	return true
+}
+
+func (g *irGen) function(decl *AstFnDecl, f *IrFunc, body func()) {
+	g.fn = f
+	g.vars = map[*Symbol]*IrVar{}
+	g.locals = map[string]int{}
+	g.temps, g.labels = 0, 0
+	g.loops = nil
+	g.start(&IrBlock{Label: "entry"})
+	if decl != nil {
+		for _, p := range decl.Params {
+			f.Params = append(f.Params, g.local(p.Name, IrParam))
+		}
+	}
+	body()
+	// Only void functions and main can get here, main returns 0 like it
+	// does in C. The checker makes sure no other function can.
+	if f.Result == TypVoid {
+		g.emit(IrRet, nil)
+	} else {
+		g.emit(IrRet, nil, zeroValue(f.Result))
+	}
+	// Drops the blocks started for code after a return
+	removeUnreachable(f)
+	// Temporaries are numbered again after assign has removed some
+	n := 0
+	for _, v := range f.Locals {
+		if v.Kind == IrTemp {
+			v.Name = fmt.Sprint(n)
+			n++
+		}
+	}
+}
+
+func zeroValue(t *Type) *IrConst {
+	return &IrConst{Type: t}
+}
+
+// label numbers the blocks for a statement, they're named after what
+// they're for
+func (g *irGen) label() int {
+	g.labels++
+	return g.labels
+}
+
+func newBlock(what string, n int) *IrBlock {
+	return &IrBlock{Label: fmt.Sprintf("%s.%d", what, n)}
+}
+
+// start makes b the block code is added to
+func (g *irGen) start(b *IrBlock) {
+	g.fn.Blocks = append(g.fn.Blocks, b)
+	g.cur = b
+}
+
+func (g *irGen) terminated() bool {
+	return len(g.cur.Instrs) > 0 && g.cur.Terminator().Op.IsTerminator()
+}
+
+func (g *irGen) add(in *IrInstr) *IrInstr {
+	if g.terminated() {
+		// Nothing can get here, but the code still has to go somewhere
+		g.start(newBlock("dead", g.label()))
+	}
+	g.cur.Instrs = append(g.cur.Instrs, in)
+	return in
+}
+
+func (g *irGen) emit(op IrOp, dst *IrVar, args ...IrValue) *IrInstr {
+	return g.add(&IrInstr{Op: op, Dst: dst, Args: args})
+}
+
+// jump ends the current block by going to b, unless it has already ended
+func (g *irGen) jump(b *IrBlock) {
+	if !g.terminated() {
+		g.add(&IrInstr{Op: IrJmp, Targets: []*IrBlock{b}})
+	}
+}
+
+func (g *irGen) branch(cond IrValue, then, els *IrBlock) {
+	g.add(&IrInstr{Op: IrBr, Args: []IrValue{cond}, Targets: []*IrBlock{then, els}})
+}
+
+func (g *irGen) temp(t *Type) *IrVar {
+	v := &IrVar{Name: fmt.Sprint(g.temps), Type: t, Kind: IrTemp}
+	g.temps++
+	g.fn.Locals = append(g.fn.Locals, v)
+	return v
+}
+
+// local makes the variable for a local declaration
+func (g *irGen) local(id *AstIdent, kind IrVarKind) *IrVar {
+	sym := g.res.SymbolOf(id)
+	name := id.Name
+	if n := g.locals[name]; n > 0 {
+		name = fmt.Sprintf("%s.%d", name, n)
+	}
+	g.locals[id.Name]++
+	v := &IrVar{Name: name, Type: g.info.Defs[sym], Kind: kind}
+	g.vars[sym] = v
+	if kind != IrParam {
+		g.fn.Locals = append(g.fn.Locals, v)
+	}
+	return v
+}
+
+// define finds the variable a declaration sets, making it if it's local
+func (g *irGen) define(id *AstIdent) *IrVar {
+	if v, ok := g.globals[g.res.SymbolOf(id)]; ok {
+		return v
+	}
+	return g.local(id, IrLocal)
+}
+
+// variable finds the variable id refers to. The resolver makes sure
+// functions only use their own locals.
+func (g *irGen) variable(id *AstIdent) *IrVar {
+	sym := g.res.SymbolOf(id)
+	if v, ok := g.globals[sym]; ok {
+		return v
+	}
+	if v, ok := g.vars[sym]; ok {
+		return v
+	}
+	panic(fmt.Sprintf("ir: %s isn't a variable of %s", id.Name, g.fn.Name))
+}
+
+// load gives the value of a variable. Globals are copied first, so
+// they're read in order with any calls that might change them.
+func (g *irGen) load(id *AstIdent) IrValue {
+	v := g.variable(id)
+	if v.Kind == IrGlobal {
+		t := g.temp(v.Type)
+		g.emit(IrCopy, t, v)
+		return t
+	}
+	return v
+}
+
+// assign stores val in dst. When val is the temporary the last
+// instruction just made, that instruction sets dst itself instead and the
+// temporary goes.
+func (g *irGen) assign(dst *IrVar, val IrValue) {
+	if t, ok := val.(*IrVar); ok && t.Kind == IrTemp && len(g.cur.Instrs) > 0 {
+		if last := g.cur.Instrs[len(g.cur.Instrs)-1]; last.Dst == t {
+			last.Dst = dst
+			g.fn.Locals = slices.DeleteFunc(g.fn.Locals, func(v *IrVar) bool { return v == t })
+			return
+		}
+	}
+	g.emit(IrCopy, dst, val)
+}
+
+func (g *irGen) block(b *AstBlock) {
+	for _, st := range b.Body {
+		g.stmt(st)
+	}
+}
+
+func (g *irGen) stmt(st AstStatement) {
+	switch n := st.(type) {
+	case *AstConstAssign:
+		v := g.expr(n.Value)
+		d := g.define(n.Ident)
+		d.Const = true
+		g.assign(d, v)
+	case *AstVarDecl:
+		v := g.expr(n.Value)
+		g.assign(g.define(n.Ident), v)
+	case *AstAssign:
+		v := g.expr(n.Value)
+		if op, ok := compoundOps[n.Op]; ok {
+			t := g.temp(TypInt)
+			g.emit(irOperators[op], t, g.load(n.Target), v)
+			v = t
+		}
+		g.assign(g.variable(n.Target), v)
+	case *AstFnDecl:
+		g.addFunc(n, g.fn.Name+"."+n.Name.Name)
+	case *AstFnCall:
+		g.call(n, false)
+	case *AstBlock:
+		g.block(n)
+	case *AstIf:
+		l := g.label()
+		then, done := newBlock("if.then", l), newBlock("if.done", l)
+		els := done
+		if n.Else != nil {
+			els = newBlock("if.else", l)
+		}
+		g.branch(g.expr(n.Cond), then, els)
+		g.start(then)
+		g.block(n.Then)
+		g.jump(done)
+		if n.Else != nil {
+			g.start(els)
+			g.stmt(n.Else)
+			g.jump(done)
+		}
+		g.start(done)
+	case *AstWhile:
+		l := g.label()
+		cond, body, done := newBlock("while.cond", l), newBlock("while.body", l), newBlock("while.done", l)
+		g.jump(cond)
+		g.start(cond)
+		g.branch(g.expr(n.Cond), body, done)
+		g.start(body)
+		g.loopBody(irLoop{n.Label, done, cond}, n.Body)
+		g.jump(cond)
+		g.start(done)
+	case *AstFor:
+		l := g.label()
+		cond, body, step, done := newBlock("for.cond", l), newBlock("for.body", l), newBlock("for.step", l), newBlock("for.done", l)
+		if n.Init != nil {
+			g.stmt(n.Init)
+		}
+		g.jump(cond)
+		g.start(cond)
+		if n.Cond != nil {
+			g.branch(g.expr(n.Cond), body, done)
+		} else {
+			g.jump(body)
+		}
+		g.start(body)
+		g.loopBody(irLoop{n.Label, done, step}, n.Body)
+		g.jump(step)
+		g.start(step)
+		if n.Step != nil {
+			g.stmt(n.Step)
+		}
+		g.jump(cond)
+		g.start(done)
+	case *AstRangeFor:
+		l := g.label()
+		cond, body, step, done := newBlock("for.cond", l), newBlock("for.body", l), newBlock("for.step", l), newBlock("for.done", l)
+		lo := g.expr(n.Lo)
+		v := g.define(n.Var)
+		g.assign(v, lo)
+		// The upper bound is only evaluated once
+		end := g.expr(n.Hi)
+		if _, ok := end.(*IrConst); !ok {
+			t := g.temp(TypInt)
+			g.emit(IrCopy, t, end)
+			end = t
+		}
+		g.jump(cond)
+		g.start(cond)
+		t := g.temp(TypBool)
+		g.emit(IrLt, t, v, end)
+		g.branch(t, body, done)
+		g.start(body)
+		g.loopBody(irLoop{n.Label, done, step}, n.Body)
+		g.jump(step)
+		g.start(step)
+		g.emit(IrAdd, v, v, IntConst(1))
+		g.jump(cond)
+		g.start(done)
+	case *AstBreak:
+		g.jump(g.loopTarget(n.Label).brk)
+	case *AstContinue:
+		g.jump(g.loopTarget(n.Label).cont)
+	case *AstReturn:
+		if n.Value != nil {
+			g.emit(IrRet, nil, g.expr(n.Value))
+		} else {
+			g.emit(IrRet, nil)
+		}
+	default:
+		panic(fmt.Sprintf("ir: unhandled statement %T", st))
+	}
+}
+
+func (g *irGen) loopBody(loop irLoop, body *AstBlock) {
+	g.loops = append(g.loops, loop)
+	g.block(body)
+	g.loops = g.loops[:len(g.loops)-1]
+}
+
+// loopTarget finds the loop a break or continue refers to, the parser
+// has already made sure there is one
+func (g *irGen) loopTarget(label *AstIdent) irLoop {
+	for i := len(g.loops) - 1; i >= 0; i-- {
+		if label == nil || (g.loops[i].label != nil && g.loops[i].label.Name == label.Name) {
+			return g.loops[i]
+		}
+	}
+	panic("ir: break or continue outside of a loop")
+}
+
+var irOperators = map[TokenKind]IrOp{
+	TokPlus:    IrAdd,
+	TokMinus:   IrSub,
+	TokStar:    IrMul,
+	TokDiv:     IrDiv,
+	TokPercent: IrMod,
+	TokEq:      IrEq,
+	TokNeq:     IrNe,
+	TokLt:      IrLt,
+	TokLte:     IrLe,
+	TokGt:      IrGt,
+	TokGte:     IrGe,
+}
+
+// expr lowers an expression, returning the operand holding its value.
+// That's nil for a call to a void function.
+func (g *irGen) expr(e AstExpr) IrValue {
+	switch n := e.(type) {
+	case *AstIntLitExpr:
+		return IntConst(n.Value)
+	case *AstBoolLitExpr:
+		return BoolConst(n.Value)
+	case *AstStringLitExpr:
+		return &IrConst{Type: TypString, Str: n.Value}
+	case *AstIdent:
+		return g.load(n)
+	case *AstFnCall:
+		return g.call(n, true)
+	case *AstUnaryExpr:
+		v := g.expr(n.Expr)
+		t := g.temp(g.info.TypeOf(n))
+		if n.Op == TokNot {
+			g.emit(IrNot, t, v)
+		} else {
+			g.emit(IrNeg, t, v)
+		}
+		return t
+	case *AstBinaryExpr:
+		if n.Op == TokAnd || n.Op == TokOr {
+			return g.logical(n)
+		}
+		l := g.expr(n.Left)
+		r := g.expr(n.Right)
+		t := g.temp(g.info.TypeOf(n))
+		g.emit(irOperators[n.Op], t, l, r)
+		return t
+	default:
+		panic(fmt.Sprintf("ir: unhandled expression %T", e))
+	}
+}
+
+// logical lowers && and ||, the right side is only evaluated if the left
+// doesn't decide the answer
+func (g *irGen) logical(n *AstBinaryExpr) IrValue {
+	l := g.label()
+	what := "and"
+	if n.Op == TokOr {
+		what = "or"
+	}
+	rhs, done := newBlock(what+".rhs", l), newBlock(what+".done", l)
+	left := g.expr(n.Left)
+	t := g.temp(TypBool)
+	g.assign(t, left)
+	if n.Op == TokAnd {
+		g.branch(t, rhs, done)
+	} else {
+		g.branch(t, done, rhs)
+	}
+	g.start(rhs)
+	g.assign(t, g.expr(n.Right))
+	g.jump(done)
+	g.start(done)
+	return t
+}
+
+// call lowers a call, keeping the result if it's wanted
+func (g *irGen) call(n *AstFnCall, want bool) IrValue {
+	in := &IrInstr{Op: IrBuiltin, Callee: n.Name.Name}
+	for _, arg := range n.Args {
+		in.Args = append(in.Args, g.expr(arg))
+	}
+	if sym := g.res.SymbolOf(n.Name); sym.Kind == SymFn {
+		in.Op = IrCall
+		in.Callee = g.funcs[sym.Decl.(*AstFnDecl)].Name
+	}
+	if t := g.info.TypeOf(n); want && t != TypVoid {
+		in.Dst = g.temp(t)
+	}
+	g.add(in)
+	if in.Dst == nil {
+		return nil
+	}
+	return in.Dst
+}
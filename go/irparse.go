@@ -0,0 +1,366 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ParseIR reads a module back from the listing WriteIR writes, so passes
+// can be tested on IR written by hand
+func ParseIR(src string) (*IrModule, error) {
+	p := &irParser{lines: strings.Split(src, "\n"), globals: map[string]*IrVar{}}
+	m := &IrModule{}
+	for p.n < len(p.lines) {
+		toks, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case len(toks) == 0:
+		case len(toks) == 2 && toks[0] == "module":
+			m.Name = toks[1]
+		case (toks[0] == "global" || toks[0] == "const") && len(toks) >= 4 && toks[2] == ":" && strings.HasPrefix(toks[1], "@"):
+			g, err := p.global(toks)
+			if err != nil {
+				return nil, err
+			}
+			p.globals[g.Name] = g
+			m.Globals = append(m.Globals, g)
+		case toks[0] == "func":
+			f, err := p.function(toks)
+			if err != nil {
+				return nil, err
+			}
+			if f.Name == "<init>" {
+				m.Init = f
+			} else {
+				m.Funcs = append(m.Funcs, f)
+			}
+		default:
+			return nil, p.errorf("expected module, global or func")
+		}
+	}
+	return m, nil
+}
+
+type irParser struct {
+	lines   []string
+	n       int
+	globals map[string]*IrVar
+	// The function being read
+	vars   map[string]*IrVar
+	blocks map[string]*IrBlock
+}
+
+func (p *irParser) errorf(format string, a ...any) error {
+	return fmt.Errorf("line %d: %s", p.n, fmt.Sprintf(format, a...))
+}
+
+// next splits the next line into tokens
+func (p *irParser) next() ([]string, error) {
+	line := p.lines[p.n]
+	p.n++
+	toks := []string{}
+	for i := 0; i < len(line); {
+		c := line[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case strings.IndexByte(":=,()[]{}", c) >= 0:
+			toks = append(toks, string(c))
+			i++
+		case c == '"':
+			j := i + 1
+			for j < len(line) && line[j] != '"' {
+				if line[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(line) {
+				return nil, p.errorf("unterminated string")
+			}
+			toks = append(toks, line[i:j+1])
+			i = j + 1
+		default:
+			j := i
+			for j < len(line) && !strings.ContainsRune(" \t\r:=,()[]{}\"", rune(line[j])) {
+				j++
+			}
+			toks = append(toks, line[i:j])
+			i = j
+		}
+	}
+	return toks, nil
+}
+
+// global reads a global, with the value it starts with if it's known
+func (p *irParser) global(toks []string) (*IrVar, error) {
+	if len(toks) != 4 && (len(toks) != 6 || toks[4] != "=") {
+		return nil, p.errorf("expected %s @name: type [= value]", toks[0])
+	}
+	t, err := p.typ(toks[3])
+	if err != nil {
+		return nil, err
+	}
+	v := &IrVar{Name: toks[1][1:], Type: t, Kind: IrGlobal, Const: toks[0] == "const"}
+	if len(toks) == 6 {
+		init, err := p.value(toks[5])
+		c, ok := init.(*IrConst)
+		if err != nil || !ok || c.Type != t {
+			return nil, p.errorf("expected a constant of type %s for %s", t, toks[1])
+		}
+		v.Init = c
+	}
+	return v, nil
+}
+
+func (p *irParser) typ(name string) (*Type, error) {
+	if t, ok := BuiltinTypes[name]; ok {
+		return t, nil
+	}
+	return nil, p.errorf("unknown type %s", name)
+}
+
+// function reads a function from its signature to the closing brace.
+// The variables and blocks are made first, because they can be used
+// before the places they're set.
+func (p *irParser) function(sig []string) (*IrFunc, error) {
+	bad := p.errorf("expected func name(param: type, ...): type {")
+	if len(sig) < 7 || sig[2] != "(" || sig[len(sig)-1] != "{" || sig[len(sig)-3] != ":" || sig[len(sig)-4] != ")" {
+		return nil, bad
+	}
+	result, err := p.typ(sig[len(sig)-2])
+	if err != nil {
+		return nil, err
+	}
+	f := &IrFunc{Name: sig[1], Result: result}
+	p.vars = map[string]*IrVar{}
+	p.blocks = map[string]*IrBlock{}
+	params := sig[3 : len(sig)-4]
+	for i := 0; i < len(params); i += 4 {
+		if i+3 > len(params) || params[i+1] != ":" || (i+3 < len(params) && params[i+3] != ",") {
+			return nil, bad
+		}
+		t, err := p.typ(params[i+2])
+		if err != nil {
+			return nil, err
+		}
+		v := &IrVar{Name: params[i], Type: t, Kind: IrParam}
+		p.vars[v.Name] = v
+		f.Params = append(f.Params, v)
+	}
+
+	start := p.n
+	body := [][]string{}
+	for {
+		if p.n == len(p.lines) {
+			return nil, p.errorf("expected } at the end of %s", f.Name)
+		}
+		toks, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		if len(toks) == 1 && toks[0] == "}" {
+			break
+		}
+		body = append(body, toks)
+		if len(toks) == 2 && toks[1] == ":" {
+			b := &IrBlock{Label: toks[0]}
+			p.blocks[b.Label] = b
+			f.Blocks = append(f.Blocks, b)
+		} else if len(toks) > 4 && toks[1] == ":" && toks[3] == "=" && !strings.HasPrefix(toks[0], "@") && p.vars[toks[0]] == nil {
+			t, err := p.typ(toks[2])
+			if err != nil {
+				return nil, err
+			}
+			v := &IrVar{Name: toks[0], Type: t, Kind: IrLocal}
+			if strings.HasPrefix(v.Name, "%") {
+				v.Name, v.Kind = v.Name[1:], IrTemp
+			}
+			p.vars[toks[0]] = v
+			f.Locals = append(f.Locals, v)
+		}
+	}
+
+	end := p.n
+	var b *IrBlock
+	for i, toks := range body {
+		p.n = start + i + 1
+		if len(toks) == 0 {
+			continue
+		}
+		if len(toks) == 2 && toks[1] == ":" {
+			b = p.blocks[toks[0]]
+			continue
+		}
+		if b == nil {
+			return nil, p.errorf("expected a label")
+		}
+		in, err := p.instr(toks)
+		if err != nil {
+			return nil, err
+		}
+		b.Instrs = append(b.Instrs, in)
+	}
+	p.n = end
+	if err := VerifyIR(f, false); err != nil {
+		return nil, p.errorf("%v", err)
+	}
+	return f, nil
+}
+
+func (p *irParser) instr(toks []string) (*IrInstr, error) {
+	in := &IrInstr{}
+	if len(toks) > 4 && toks[1] == ":" && toks[3] == "=" {
+		v, err := p.value(toks[0])
+		if err != nil {
+			return nil, err
+		}
+		dst, ok := v.(*IrVar)
+		if !ok {
+			return nil, p.errorf("can't assign to %s", v)
+		}
+		in.Dst = dst
+		toks = toks[4:]
+	}
+	op := slices.Index(irOpNames, toks[0])
+	if op < 0 {
+		return nil, p.errorf("unknown instruction %s", toks[0])
+	}
+	in.Op = IrOp(op)
+	toks = toks[1:]
+	bad := func(want string) error {
+		return p.errorf("expected %s %s", in.Op, want)
+	}
+
+	switch in.Op {
+	case IrCall, IrBuiltin:
+		if len(toks) < 3 || toks[1] != "(" || toks[len(toks)-1] != ")" {
+			return nil, bad("name(args, ...)")
+		}
+		in.Callee = toks[0]
+		toks = toks[2 : len(toks)-1]
+	case IrPhi:
+		for len(toks) > 0 {
+			if len(toks) < 5 || toks[0] != "[" || toks[2] != "," || toks[4] != "]" {
+				return nil, bad("[value, label], ...")
+			}
+			v, err := p.value(toks[1])
+			if err != nil {
+				return nil, err
+			}
+			from, err := p.block(toks[3])
+			if err != nil {
+				return nil, err
+			}
+			in.Args = append(in.Args, v)
+			in.Preds = append(in.Preds, from)
+			toks = toks[5:]
+			if len(toks) > 0 && toks[0] == "," {
+				toks = toks[1:]
+			}
+		}
+		return in, nil
+	}
+
+	args := []string{}
+	for i, t := range toks {
+		if (i%2 == 1) != (t == ",") {
+			return nil, p.errorf("expected , between %s args", in.Op)
+		}
+		if i%2 == 0 {
+			args = append(args, t)
+		}
+	}
+	labels := map[IrOp]int{IrJmp: 1, IrBr: 2}[in.Op]
+	if len(args) < labels {
+		return nil, bad("labels")
+	}
+	for _, a := range args[:len(args)-labels] {
+		v, err := p.value(a)
+		if err != nil {
+			return nil, err
+		}
+		in.Args = append(in.Args, v)
+	}
+	for _, l := range args[len(args)-labels:] {
+		b, err := p.block(l)
+		if err != nil {
+			return nil, err
+		}
+		in.Targets = append(in.Targets, b)
+	}
+	return in, nil
+}
+
+func (p *irParser) block(label string) (*IrBlock, error) {
+	if b, ok := p.blocks[label]; ok {
+		return b, nil
+	}
+	return nil, p.errorf("unknown label %s", label)
+}
+
+// value reads an operand: a constant, a variable, or a global with an @
+func (p *irParser) value(tok string) (IrValue, error) {
+	switch {
+	case tok == "true" || tok == "false":
+		return BoolConst(tok == "true"), nil
+	case strings.HasPrefix(tok, "\""):
+		s, err := unquoteC(tok[1 : len(tok)-1])
+		if err != nil {
+			return nil, p.errorf("%v", err)
+		}
+		return &IrConst{Type: TypString, Str: s}, nil
+	case strings.HasPrefix(tok, "@"):
+		if g, ok := p.globals[tok[1:]]; ok {
+			return g, nil
+		}
+		return nil, p.errorf("unknown global %s", tok)
+	}
+	if n, err := strconv.Atoi(tok); err == nil {
+		return IntConst(n), nil
+	}
+	if v, ok := p.vars[tok]; ok {
+		return v, nil
+	}
+	return nil, p.errorf("unknown variable %s", tok)
+}
+
+// unquoteC undoes the escapes cStringLiteral makes
+func unquoteC(s string) (string, error) {
+	b := strings.Builder{}
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		if i == len(s) {
+			return "", fmt.Errorf("string ends with \\")
+		}
+		switch c := s[i]; c {
+		case 'n':
+			b.WriteByte('\n')
+		case 't':
+			b.WriteByte('\t')
+		case 'r':
+			b.WriteByte('\r')
+		case '"', '\\', '?':
+			b.WriteByte(c)
+		default:
+			if i+3 > len(s) {
+				return "", fmt.Errorf("bad escape \\%c", c)
+			}
+			n, err := strconv.ParseUint(s[i:i+3], 8, 8)
+			if err != nil {
+				return "", fmt.Errorf("bad escape \\%s", s[i:i+3])
+			}
+			b.WriteByte(byte(n))
+			i += 2
+		}
+	}
+	return b.String(), nil
+}
@@ -3,7 +3,9 @@ package main
 import (
 	"fmt"
 	"io"
+	"strconv"
 	"strings"
+	"unicode/utf8"
 )
 
 type Lexer struct {
@@ -15,21 +17,57 @@ type Lexer struct {
 	// Where we are in the RuneReader
 	line uint
 	col  uint
+	// Byte offsets of the current character and the one after it
+	offset     int
+	nextOffset int
 	// Location of the token being currently parsed
-	startLine uint
-	startCol  uint
+	startLine   uint
+	startCol    uint
+	startOffset int
+	// Where the last character read ends
+	lastEnd Pos
+}
+
+// Pos is a position in the source. Line and Col count from 1, Offset is
+// in bytes from the start of the input.
+type Pos struct {
+	Line   uint
+	Col    uint
+	Offset int
+}
+
+func (p Pos) String() string {
+	return fmt.Sprintf("%d:%d", p.Line, p.Col)
+}
+
+// Span is a range of the source, End is the position just after the
+// last character in the range
+type Span struct {
+	Start Pos
+	End   Pos
+}
+
+func (s Span) String() string {
+	return s.Start.String() + "-" + s.End.String()
 }
 
-//go:generate stringer -type=TokenKind
 type TokenKind int
 type Token struct {
 	Kind TokenKind
-	// the raw text for the toke, unless kind == TokErr then its the error text
-	// TODO(wnh): keep those separate
-	Text  string
-	Error error
-	Line  uint
-	Col   uint
+	// The raw text for the token. For strings it is the value with the
+	// escapes replaced, and when kind == TokErr it is the offending source.
+	Text string
+	// Why the token couldn't be lexed, only set when kind == TokErr
+	Error  error
+	Line   uint
+	Col    uint
+	Offset int
+	// Just past the end of the token
+	End Pos
+}
+
+func (t Token) Pos() Pos {
+	return Pos{t.Line, t.Col, t.Offset}
 }
 
 const (
@@ -56,21 +94,125 @@ const (
 	TokIf
 	TokReturn
 	TokDiv
+	TokPlus
+	TokMinus
+	TokStar
+	TokPercent
+	TokLt
+	TokLte
+	TokEq
+	TokNeq
+	TokNot
+	TokAnd
+	TokOr
+	TokElse
+	TokWhile
+	TokFor
+	TokIn
+	TokBreak
+	TokContinue
+	TokDotDot
+	TokVar
+	TokPlusAssign
+	TokMinusAssign
+	TokStarAssign
+	TokDivAssign
+	TokPercentAssign
+	TokTrue
+	TokFalse
 )
 
+// tokenNames are how tokens are written in messages, the ones that are
+// always the same text are quoted like they're written in the source
+var tokenNames = map[TokenKind]string{
+	TokErr:           "invalid token",
+	TokEof:           "end of file",
+	TokInt:           "integer",
+	TokIdent:         "identifier",
+	TokString:        "string",
+	TokLpar:          "'('",
+	TokRpar:          "')'",
+	TokLbrace:        "'{'",
+	TokRbrace:        "'}'",
+	TokLsq:           "'['",
+	TokRsq:           "']'",
+	TokColon:         "':'",
+	TokAssign:        "'='",
+	TokSemi:          "';'",
+	TokComma:         "','",
+	TokGte:           "'>='",
+	TokGt:            "'>'",
+	TokDiv:           "'/'",
+	TokPlus:          "'+'",
+	TokMinus:         "'-'",
+	TokStar:          "'*'",
+	TokPercent:       "'%'",
+	TokLt:            "'<'",
+	TokLte:           "'<='",
+	TokEq:            "'=='",
+	TokNeq:           "'!='",
+	TokNot:           "'!'",
+	TokAnd:           "'&&'",
+	TokOr:            "'||'",
+	TokDotDot:        "'..'",
+	TokPlusAssign:    "'+='",
+	TokMinusAssign:   "'-='",
+	TokStarAssign:    "'*='",
+	TokDivAssign:     "'/='",
+	TokPercentAssign: "'%='",
+}
+
+func init() {
+	for text, kind := range keywords {
+		tokenNames[kind] = "'" + text + "'"
+	}
+}
+
+func (k TokenKind) String() string {
+	if name, ok := tokenNames[k]; ok {
+		return name
+	}
+	return fmt.Sprintf("TokenKind(%d)", int(k))
+}
+
 func (l *Lexer) MkToken(kind TokenKind, text string) Token {
-	return Token{kind, text, nil, l.startLine, l.startCol}
+	return Token{kind, text, nil, l.startLine, l.startCol, l.startOffset, l.lastEnd}
+}
+
+// suggestError is a lexer error for text that was probably meant to be
+// replacement
+type suggestError struct {
+	msg         string
+	replacement string
 }
+
+func (e suggestError) Error() string {
+	return fmt.Sprintf("%s, did you mean '%s'?", e.msg, e.replacement)
+}
+
+// MkTokenErr makes a TokErr token holding err, its text is all of the
+// source consumed since the start of the token
 func (l *Lexer) MkTokenErr(err error) Token {
-	return l.MkToken(TokErr, "")
+	tok := l.MkToken(TokErr, l.input[l.startOffset:l.offset])
+	tok.Error = err
+	return tok
 }
 
 var keywords = map[string]TokenKind{
-	"fn":     TokFn,
-	"let":    TokLet,
-	"module": TokModule,
-	"return": TokReturn,
-	"if":     TokIf,
+	"fn":       TokFn,
+	"let":      TokLet,
+	"module":   TokModule,
+	"return":   TokReturn,
+	"if":       TokIf,
+	"else":     TokElse,
+	"while":    TokWhile,
+	"for":      TokFor,
+	"in":       TokIn,
+	"break":    TokBreak,
+	"continue": TokContinue,
+	"var":      TokVar,
+	"true":     TokTrue,
+	"false":    TokFalse,
 }
 
 func NewLexer(input string) Lexer {
@@ -81,10 +223,11 @@ func NewLexer(input string) Lexer {
 
 func (l *Lexer) nextChar() rune {
 	r, runeLen, err := l.reader.ReadRune()
-	_ = runeLen
-	//fmt.Printf("nextChar(): %v %#v %#v %v \n", string(r), runeLen, err, err == io.EOF)
+	if !l.isEof {
+		l.lastEnd = Pos{l.line, l.col + 1, l.nextOffset}
+	}
+	l.offset = l.nextOffset
 	if err == io.EOF {
-		//fmt.Println("Im returning?")
 		l.isEof = true
 		l.current = 0
 		return 0
@@ -92,6 +235,7 @@ func (l *Lexer) nextChar() rune {
 	if err != nil {
 		panic("bad rune read")
 	}
+	l.nextOffset += runeLen
 	if r == '\n' {
 		l.line++
 		l.col = 0
@@ -108,16 +252,17 @@ func (l *Lexer) char() rune {
 
 func (l *Lexer) Next() Token {
 	c := l.char()
-	//fmt.Println("Next(): l.isEof", l.isEof)
 	if isWS(c) {
 		l.skipWS()
 		c = l.char()
 	}
+	l.startLine = l.line
+	l.startCol = l.col
+	l.startOffset = l.offset
 	if l.isEof {
+		l.lastEnd = Pos{l.line, l.col, l.offset}
 		return l.MkToken(TokEof, "")
 	}
-	l.startLine = l.line
-	l.startCol = l.col
 
 	switch {
 	case isAlpha(c) || c == '_':
@@ -126,6 +271,8 @@ func (l *Lexer) Next() Token {
 		return l.TokenizeInt()
 	case c == '"':
 		return l.TokenizeString()
+	case c == '`':
+		return l.TokenizeRawString()
 	case c == '(':
 		l.nextChar()
 		return l.MkToken(TokLpar, "(")
@@ -148,8 +295,12 @@ func (l *Lexer) Next() Token {
 		l.nextChar()
 		return l.MkToken(TokColon, "")
 	case c == '=':
-		l.nextChar()
-		return l.MkToken(TokAssign, "")
+		if l.nextChar() == '=' {
+			l.nextChar()
+			return l.MkToken(TokEq, "==")
+		} else {
+			return l.MkToken(TokAssign, "=")
+		}
 	case c == ';':
 		l.nextChar()
 		return l.MkToken(TokSemi, "")
@@ -159,54 +310,218 @@ func (l *Lexer) Next() Token {
 	case c == '>':
 		if l.nextChar() == '=' {
 			l.nextChar()
-			return l.MkToken(TokGte, "")
+			return l.MkToken(TokGte, ">=")
 		} else {
-			return l.MkToken(TokGt, "")
+			return l.MkToken(TokGt, ">")
 		}
+	case c == '<':
+		if l.nextChar() == '=' {
+			l.nextChar()
+			return l.MkToken(TokLte, "<=")
+		} else {
+			return l.MkToken(TokLt, "<")
+		}
+	case c == '!':
+		if l.nextChar() == '=' {
+			l.nextChar()
+			return l.MkToken(TokNeq, "!=")
+		} else {
+			return l.MkToken(TokNot, "!")
+		}
+	case c == '&':
+		if l.nextChar() == '&' {
+			l.nextChar()
+			return l.MkToken(TokAnd, "&&")
+		}
+		return l.MkTokenErr(suggestError{"unexpected character '&'", "&&"})
+	case c == '|':
+		if l.nextChar() == '|' {
+			l.nextChar()
+			return l.MkToken(TokOr, "||")
+		}
+		return l.MkTokenErr(suggestError{"unexpected character '|'", "||"})
+	case c == '.':
+		if l.nextChar() == '.' {
+			l.nextChar()
+			return l.MkToken(TokDotDot, "..")
+		}
+		return l.MkTokenErr(suggestError{"unexpected character '.'", ".."})
+	case c == '+':
+		if l.nextChar() == '=' {
+			l.nextChar()
+			return l.MkToken(TokPlusAssign, "+=")
+		}
+		return l.MkToken(TokPlus, "+")
+	case c == '-':
+		if l.nextChar() == '=' {
+			l.nextChar()
+			return l.MkToken(TokMinusAssign, "-=")
+		}
+		return l.MkToken(TokMinus, "-")
+	case c == '*':
+		if l.nextChar() == '=' {
+			l.nextChar()
+			return l.MkToken(TokStarAssign, "*=")
+		}
+		return l.MkToken(TokStar, "*")
+	case c == '%':
+		if l.nextChar() == '=' {
+			l.nextChar()
+			return l.MkToken(TokPercentAssign, "%=")
+		}
+		return l.MkToken(TokPercent, "%")
 	case c == '/':
 		if l.nextChar() == '/' {
 			l.nextChar()
 			l.skipComment()
 			return l.Next()
+		} else if l.char() == '=' {
+			l.nextChar()
+			return l.MkToken(TokDivAssign, "/=")
 		} else {
-			return l.MkToken(TokDiv, "")
+			return l.MkToken(TokDiv, "/")
 		}
 	default:
-		return l.MkTokenErr(fmt.Errorf("parse error: unknown character %#v", l.char()))
+		l.nextChar()
+		return l.MkTokenErr(fmt.Errorf("unexpected character %q", c))
 	}
 }
 func isNum(c rune) bool {
 	return c >= '0' && c <= '9'
 }
+func isHex(c rune) bool {
+	return isNum(c) || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
 func isAlpha(c rune) bool {
 	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
 }
 
 func isWS(c rune) bool {
-	//fmt.Println("isWS():", string(c))
 	return strings.ContainsAny(string(c), " \t\r\n")
 }
 
 func (l *Lexer) skipWS() {
-	//fmt.Println("skipWs()")
 	for isWS(l.char()) {
 		l.nextChar()
 	}
 }
 
 func (l *Lexer) skipComment() {
-	for l.nextChar() != '\n' {
+	for !l.isEof && l.nextChar() != '\n' {
 	}
 	l.nextChar() // Move over newline
 }
 
+// TokenizeString reads a double quoted string, the token's Text is the
+// string's value with all the escape sequences replaced.
 func (l *Lexer) TokenizeString() Token {
-	txt := ""
-	for l.nextChar() != '"' {
-		txt += string(l.char())
+	var val strings.Builder
+	var err error
+	c := l.nextChar()
+	for c != '"' {
+		if l.isEof || c == '\n' {
+			return l.MkTokenErr(fmt.Errorf("unterminated string literal"))
+		}
+		if c != '\\' {
+			val.WriteRune(c)
+			c = l.nextChar()
+			continue
+		}
+		if escErr := l.readEscape(&val); escErr != nil && err == nil {
+			// Keep going to the closing quote so the error is about
+			// this string, not whatever comes after it
+			err = escErr
+		}
+		c = l.char()
+	}
+	l.nextChar() // Move over closing quote
+	if err != nil {
+		return l.MkTokenErr(err)
+	}
+	return l.MkToken(TokString, val.String())
+}
+
+var simpleEscapes = map[rune]rune{
+	'n':  '\n',
+	't':  '\t',
+	'r':  '\r',
+	'\\': '\\',
+	'"':  '"',
+}
+
+// readEscape reads the escape sequence starting at the current backslash
+// and writes its value to val. It leaves the lexer on the character after
+// the escape, or on the first character that can't be part of it.
+func (l *Lexer) readEscape(val *strings.Builder) error {
+	c := l.nextChar()
+	if r, ok := simpleEscapes[c]; ok {
+		l.nextChar()
+		val.WriteRune(r)
+		return nil
+	}
+	switch c {
+	case 'x':
+		l.nextChar()
+		hex := l.readHex(2)
+		if len(hex) != 2 {
+			return fmt.Errorf("invalid escape sequence \\x%s, expected two hex digits", hex)
+		}
+		b, _ := strconv.ParseUint(hex, 16, 8)
+		if b == 0 {
+			return fmt.Errorf("strings can't contain NUL bytes")
+		}
+		val.WriteByte(byte(b))
+		return nil
+	case 'u':
+		if l.nextChar() != '{' {
+			return fmt.Errorf("invalid escape sequence, expected \\u{...}")
+		}
+		l.nextChar()
+		hex := l.readHex(6)
+		if l.char() != '}' || hex == "" {
+			return fmt.Errorf("invalid escape sequence \\u{%s, expected 1 to 6 hex digits and a }", hex)
+		}
+		l.nextChar()
+		r, _ := strconv.ParseUint(hex, 16, 32)
+		if !utf8.ValidRune(rune(r)) {
+			return fmt.Errorf("invalid unicode code point \\u{%s}", hex)
+		}
+		if r == 0 {
+			return fmt.Errorf("strings can't contain NUL bytes")
+		}
+		val.WriteRune(rune(r))
+		return nil
+	}
+	if l.isEof || c == '\n' {
+		// TokenizeString reports this as unterminated
+		return nil
+	}
+	l.nextChar()
+	return fmt.Errorf("unknown escape sequence \\%c", c)
+}
+
+// readHex reads up to max hex digits
+func (l *Lexer) readHex(max int) string {
+	hex := ""
+	for len(hex) < max && isHex(l.char()) {
+		hex += string(l.char())
+		l.nextChar()
+	}
+	return hex
+}
+
+// TokenizeRawString reads a back quoted string, there are no escapes
+// and it may span multiple lines.
+func (l *Lexer) TokenizeRawString() Token {
+	val := ""
+	for l.nextChar() != '`' {
+		if l.isEof {
+			return l.MkTokenErr(fmt.Errorf("unterminated raw string literal"))
+		}
+		val += string(l.char())
 	}
 	l.nextChar() // Move over closing quote
-	return l.MkToken(TokString, txt)
+	return l.MkToken(TokString, val)
 }
 
 func (l *Lexer) TokenizeIdent() Token {
@@ -222,11 +537,19 @@ func (l *Lexer) TokenizeIdent() Token {
 }
 
 func (l *Lexer) TokenizeInt() Token {
-	//fmt.Println("Token int", l.i)
 	val := ""
 	for isNum(l.char()) {
 		val = val + string(l.char())
 		l.nextChar()
 	}
+	if isAlpha(l.char()) || l.char() == '_' {
+		for isAlpha(l.char()) || isNum(l.char()) || l.char() == '_' {
+			l.nextChar()
+		}
+		return l.MkTokenErr(fmt.Errorf("invalid number literal %s", l.input[l.startOffset:l.offset]))
+	}
+	if _, err := strconv.ParseInt(val, 10, 64); err != nil {
+		return l.MkTokenErr(fmt.Errorf("integer literal %s is too large", val))
+	}
 	return l.MkToken(TokInt, val)
 }
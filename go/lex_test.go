@@ -22,6 +22,14 @@ func TestNextToken(t *testing.T) {
 		testcase{n: "keyword and Ident", input: "fn foo", tokens: []TokenKind{TokFn, TokIdent}},
 		testcase{n: "Fn", input: "fn foo(a : int)", tokens: []TokenKind{TokFn, TokIdent, TokLpar, TokIdent, TokColon, TokIdent, TokRpar}},
 		testcase{n: "Two char tokens", input: "> = >= >==", tokens: []TokenKind{TokGt, TokAssign, TokGte, TokGte, TokAssign}},
+		testcase{n: "Comparisons", input: "< <= == != ! >", tokens: []TokenKind{TokLt, TokLte, TokEq, TokNeq, TokNot, TokGt}},
+		testcase{n: "Arithmetic", input: "a+b-c*d/e%f", tokens: []TokenKind{TokIdent, TokPlus, TokIdent, TokMinus, TokIdent, TokStar, TokIdent, TokDiv, TokIdent, TokPercent, TokIdent}},
+		testcase{n: "If else", input: "if a {} else {}", tokens: []TokenKind{TokIf, TokIdent, TokLbrace, TokRbrace, TokElse, TokLbrace, TokRbrace}},
+		testcase{n: "Loop keywords", input: "while for in break continue", tokens: []TokenKind{TokWhile, TokFor, TokIn, TokBreak, TokContinue}},
+		testcase{n: "Range", input: "0..10", tokens: []TokenKind{TokInt, TokDotDot, TokInt}},
+		testcase{n: "Assignment ops", input: "= += -= *= /= %=", tokens: []TokenKind{TokAssign, TokPlusAssign, TokMinusAssign, TokStarAssign, TokDivAssign, TokPercentAssign}},
+		testcase{n: "Var", input: "var x", tokens: []TokenKind{TokVar, TokIdent}},
+		testcase{n: "Logical", input: "a && b || !c", tokens: []TokenKind{TokIdent, TokAnd, TokIdent, TokOr, TokNot, TokIdent}},
 	}
 
 	for _, tc := range tests {
@@ -40,3 +48,124 @@ func TestNextToken(t *testing.T) {
 		})
 	}
 }
+
+func TestStringLiterals(t *testing.T) {
+	cases := []struct{ n, input, value string }{
+		{"Plain", `"hello"`, "hello"},
+		{"Empty", `""`, ""},
+		{"Newline", `"a\nb"`, "a\nb"},
+		{"Tab", `"a\tb"`, "a\tb"},
+		{"Carriage return", `"a\rb"`, "a\rb"},
+		{"Backslash", `"a\\b"`, `a\b`},
+		{"Quote", `"say \"hi\""`, `say "hi"`},
+		{"Hex", `"\x41\x7a"`, "Az"},
+		{"High byte", `"\xff"`, "\xff"},
+		{"Unicode", `"\u{e9}\u{1F600}"`, "é😀"},
+		{"Literal unicode", `"é"`, "é"},
+		{"Raw", "`a\\nb`", `a\nb`},
+		{"Raw multiline", "`a\n\"b\"`", "a\n\"b\""},
+	}
+	for _, tc := range cases {
+		t.Run(tc.n, func(t *testing.T) {
+			l := NewLexer(tc.input + " x")
+			got := l.Next()
+			if got.Kind != TokString {
+				t.Fatalf("expected a string got %v", got)
+			}
+			if got.Text != tc.value {
+				t.Errorf("expected %q got %q", tc.value, got.Text)
+			}
+			if next := l.Next(); next.Kind != TokIdent {
+				t.Errorf("expected the ident after the string, got %v", next)
+			}
+		})
+	}
+}
+
+func TestStringLiteralErrors(t *testing.T) {
+	cases := []struct {
+		n, input string
+		// Whether the lexer should carry on with the next token
+		recovers bool
+	}{
+		{"Unterminated", `"abc`, false},
+		{"Unterminated at newline", "\"abc\nx", true},
+		{"Unterminated raw", "`abc", false},
+		{"Trailing backslash", `"abc\`, false},
+		{"Unknown escape", `"a\qb" x`, true},
+		{"Short hex", `"\x4" x`, true},
+		{"Bad hex", `"\xzz" x`, true},
+		{"Hex at end", `"\x" x`, true},
+		{"NUL", `"\x00" x`, true},
+		{"Unicode without braces", `"\u0041" x`, true},
+		{"Unicode unterminated", `"\u{41" x`, true},
+		{"Unicode too long", `"\u{1234567}" x`, true},
+		{"Unicode surrogate", `"\u{d800}" x`, true},
+		{"Unicode out of range", `"\u{110000}" x`, true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.n, func(t *testing.T) {
+			l := NewLexer(tc.input)
+			got := l.Next()
+			if got.Kind != TokErr {
+				t.Fatalf("expected an error got %v", got)
+			}
+			next := l.Next()
+			if tc.recovers && next.Kind != TokIdent {
+				t.Errorf("expected the ident after the string, got %v", next)
+			}
+			if !tc.recovers && next.Kind != TokEof {
+				t.Errorf("expected EOF, got %v", next)
+			}
+		})
+	}
+}
+
+func TestCommentAtEof(t *testing.T) {
+	l := NewLexer("x // no newline")
+	if tok := l.Next(); tok.Kind != TokIdent {
+		t.Errorf("expected ident got %v", tok)
+	}
+	if tok := l.Next(); tok.Kind != TokEof {
+		t.Errorf("expected EOF got %v", tok)
+	}
+}
+
+func TestErrorTokens(t *testing.T) {
+	cases := []struct{ n, input, text, msg string }{
+		{"Unknown character", "a # b", "#", `unexpected character '#'`},
+		{"Unknown unicode character", "a € b", "€", `unexpected character '€'`},
+		{"Single ampersand", "a & b", "&", "unexpected character '&', did you mean '&&'?"},
+		{"Single pipe", "a | b", "|", "unexpected character '|', did you mean '||'?"},
+		{"Single dot", "a . b", ".", "unexpected character '.', did you mean '..'?"},
+		{"Letters in number", "a 12ab b", "12ab", "invalid number literal 12ab"},
+		{"Underscore in number", "a 1_000 b", "1_000", "invalid number literal 1_000"},
+		{"Huge number", "a 99999999999999999999 b", "99999999999999999999", "integer literal 99999999999999999999 is too large"},
+		{"Unterminated string", "a \"abc\nb", "\"abc", "unterminated string literal"},
+		{"Bad escape", `a "x\qy" b`, `"x\qy"`, `unknown escape sequence \q`},
+	}
+	for _, tc := range cases {
+		t.Run(tc.n, func(t *testing.T) {
+			l := NewLexer(tc.input)
+			if tok := l.Next(); tok.Kind != TokIdent {
+				t.Fatalf("expected ident got %v", tok)
+			}
+			tok := l.Next()
+			if tok.Kind != TokErr {
+				t.Fatalf("expected an error token got %v", tok)
+			}
+			if tok.Text != tc.text {
+				t.Errorf("expected text %q got %q", tc.text, tok.Text)
+			}
+			if tok.Error == nil || tok.Error.Error() != tc.msg {
+				t.Errorf("expected error %q got %v", tc.msg, tok.Error)
+			}
+			if tok.Line != 1 || tok.Col != 3 {
+				t.Errorf("expected position 1:3 got %d:%d", tok.Line, tok.Col)
+			}
+			if next := l.Next(); next.Kind != TokIdent {
+				t.Errorf("expected the lexer to carry on after the error, got %v", next)
+			}
+		})
+	}
+}
@@ -1,80 +1,536 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
 	"io"
-	"log"
 	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
 	"strings"
+	"syscall"
 )
 
+type command struct {
+	name string
+	args string
+	help string
+	run  func(d *driver, args []string) error
+	// Adds any flags of the command's own
+	flags func(d *driver, fs *flag.FlagSet)
+}
+
+var commands = []command{
+	{name: "build", args: "<file.b>", help: "compile a program to an executable, object file or static library", run: cmdBuild, flags: addBuildFlags},
+	{name: "run", args: "<file.b|file.bc> [args...]", help: "compile and run a program, passing it args", run: cmdRun, flags: addRunFlags},
+	{name: "check", args: "<file.b>", help: "parse and type check a program without compiling it", run: cmdCheck},
+	{name: "repl", help: "evaluate declarations, statements and expressions as they're typed", run: cmdRepl},
+	{name: "emit", args: "c|asm|ir <file.b>", help: "write the generated C, assembly or IR to stdout", run: cmdEmit, flags: addOptFlags},
+	{name: "disasm", args: "<file.b|file.bc>", help: "compile a program to bytecode, or load compiled bytecode, and list it", run: cmdDisasm},
+	{name: "tokens", args: "<file.b>", help: "dump the tokens in a file", run: cmdTokens},
+	{name: "ast", args: "<file.b>", help: "dump the syntax tree of a file", run: cmdAst},
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "usage: compy <command> [flags] <file.b>")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "commands:")
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-8s %s\n", c.name, c.help)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "run 'compy <command> -h' for the flags a command takes")
+}
+
 func main() {
-	fmt.Printf("%#v\n", os.Args)
-	if len(os.Args) != 2 {
-		fmt.Println("usage: compy <filename>")
-		os.Exit(1)
+	os.Exit(runCommand(os.Args[1:]))
+}
+
+// runCommand runs the command named by args[0] and returns the exit status
+func runCommand(args []string) int {
+	if len(args) == 0 {
+		usage(os.Stderr)
+		return 2
 	}
-	filename := os.Args[1]
-	srcbase := path.Base(filename)
-	if !strings.HasSuffix(srcbase, ".b") {
-		fmt.Printf("Error: bad filename pattern '%s', need it to end in '.b'", filename)
-		os.Exit(1)
+	if args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		usage(os.Stdout)
+		return 0
+	}
+	var cmd *command
+	for i := range commands {
+		if commands[i].name == args[0] {
+			cmd = &commands[i]
+		}
+	}
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "compy: unknown command %q\n", args[0])
+		usage(os.Stderr)
+		return 2
 	}
-	basename, _ := strings.CutSuffix(srcbase, ".b")
 
-	file, err := os.OpenFile(filename, os.O_RDONLY, 0644)
-	if err != nil {
-		fmt.Printf("error: %v\n", err)
-		os.Exit(1)
+	fs := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: compy %s [flags] %s\n\n%s\n\nflags:\n", cmd.name, cmd.args, cmd.help)
+		fs.PrintDefaults()
+	}
+	d := &driver{}
+	d.addFlags(fs)
+	if cmd.flags != nil {
+		cmd.flags(d, fs)
+	}
+	if err := fs.Parse(optFlags(fs, args[1:])); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+	if err := d.setup(); err != nil {
+		fmt.Fprintf(os.Stderr, "compy: %v\n", err)
+		return 2
+	}
+
+	err := cmd.run(d, fs.Args())
+	var exit exitError
+	switch {
+	case err == nil:
+		d.diags.PrintSummary()
+		return 0
+	case errors.As(err, &exit):
+		return exit.code
+	case errors.Is(err, errUsage):
+		fs.Usage()
+		return 2
+	}
+	d.report(err)
+	d.diags.PrintSummary()
+	return 1
+}
+
+// errUsage is returned by commands given the wrong arguments
+var errUsage = errors.New("bad usage")
+
+// exitError makes compy exit with code without reporting anything, for
+// passing on the exit status of a program it ran
+type exitError struct {
+	code int
+}
+
+func (e exitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.code)
+}
+
+// driver holds what every command needs: the flags they share and
+// somewhere to report diagnostics
+type driver struct {
+	verbose    int
+	diagFormat string
+
+	diags DiagnosticOutput
+	// Only set for text diagnostics, which need the source
+	printer *DiagnosticPrinter
+
+	build buildOptions
+	// Run programs with the interpreter instead of compiling them
+	interp bool
+}
+
+func (d *driver) addFlags(fs *flag.FlagSet) {
+	fs.IntVar(&d.verbose, "v", 0, "verbosity, 1 logs each step and the commands run, 2 also dumps the source, AST and generated code")
+	fs.StringVar(&d.diagFormat, "diagnostics", "text", "how to report errors: text, or json for one JSON object per line on stderr")
+}
+
+func (d *driver) setup() error {
+	if err := d.build.validate(); err != nil {
+		return err
+	}
+	switch d.diagFormat {
+	case "text":
+		d.printer = NewDiagnosticPrinter(os.Stderr, isTerminal(os.Stderr))
+		d.diags = d.printer
+	case "json":
+		d.diags = NewJSONDiagnosticPrinter(os.Stderr)
+	default:
+		return fmt.Errorf("unknown diagnostics format %q, expected text or json", d.diagFormat)
+	}
+	return nil
+}
+
+// logf writes to stderr when the verbosity is at least level. JSON
+// diagnostics have stderr to themselves, so nothing is logged with them.
+func (d *driver) logf(level int, format string, a ...any) {
+	if d.verbose >= level && d.diagFormat != "json" {
+		fmt.Fprintf(os.Stderr, format, a...)
 	}
-	content, err := io.ReadAll(file)
+}
+
+func (d *driver) report(err error) {
+	for _, diag := range Diagnostics(err, SevError) {
+		d.diags.Print(diag)
+	}
+}
+
+func (d *driver) readSource(filename string) (string, error) {
+	content, err := os.ReadFile(filename)
 	if err != nil {
-		fmt.Printf("error reading file \"%s\": %v\n", filename, err)
-		os.Exit(1)
+		return "", err
 	}
-	fmt.Println("======= Src File content =======")
-	fmt.Println(string(content))
+	if d.printer != nil {
+		d.printer.Sources[filename] = string(content)
+	}
+	d.logf(2, "======= Src File content =======\n%s\n", content)
+	return string(content), nil
+}
 
-	parser := NewParser(string(content), filename)
+func (d *driver) parse(filename string) (*AstModule, error) {
+	src, err := d.readSource(filename)
+	if err != nil {
+		return nil, err
+	}
+	d.logf(1, "parsing %s\n", filename)
+	parser := NewParser(src, filename)
 	mod, err := parser.ParseModule()
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		return nil, err
 	}
-	fmt.Println("======= Ast =======")
-	fmt.Printf("%#v\n", mod)
+	d.logf(2, "======= Ast =======\n")
+	if d.verbose >= 2 && d.diagFormat != "json" {
+		DumpAst(os.Stderr, mod)
+	}
+	return mod, nil
+}
 
-	codeMod := &CodegenModule{}
-	mod.Codegen(codeMod)
-	fmt.Println("======= Module Output =======")
-	cCode := codeMod.Code.String()
-	fmt.Println(cCode)
+// check parses, resolves and type checks a file, reporting any warnings
+func (d *driver) check(filename string) (*AstModule, *Resolution, *TypeInfo, error) {
+	mod, err := d.parse(filename)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	d.logf(1, "checking %s\n", filename)
+	res, err := Resolve(mod)
+	for _, w := range res.Warnings {
+		d.diags.Print(w.Diagnostic(SevWarning))
+	}
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	info, err := Check(mod, res)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return mod, res, info, nil
+}
+
+// lower checks a file and lowers it to the IR
+func (d *driver) lower(filename string) (*IrModule, error) {
+	mod, res, info, err := d.check(filename)
+	if err != nil {
+		return nil, err
+	}
+	return BuildIR(mod, res, info)
+}
 
-	f, err := os.CreateTemp("", basename+"_*.c")
+// optimise lowers a file to the IR and runs the passes -O or --passes
+// chose over it
+func (d *driver) optimise(filename string) (*IrModule, error) {
+	ir, err := d.lower(filename)
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		return nil, err
 	}
-	fmt.Println("======= Output =======")
-	fmt.Printf("C source: %s\n", f.Name())
-	defer os.Remove(f.Name()) // clean up
+	passes := OptPasses(d.build.opt)
+	if d.build.passes != "" {
+		// validate has already checked them
+		passes, _ = LookupPasses(d.build.passes)
+	}
+	if len(passes) == 0 {
+		return ir, nil
+	}
+	err = Optimise(ir, passes, func(p *Pass) {
+		d.logf(1, "ran the %s pass\n", p.Name)
+		if d.verbose >= 2 && d.diagFormat != "json" {
+			fmt.Fprintf(os.Stderr, "======= IR after %s =======\n", p.Name)
+			WriteIR(os.Stderr, ir)
+		}
+	})
+	return ir, err
+}
+
+// generate checks a file and returns the code the backend makes for it
+func (d *driver) generate(filename string, backend Backend) (string, error) {
+	var code string
+	if b, ok := backend.(IRBackend); ok {
+		ir, err := d.optimise(filename)
+		if err != nil {
+			return "", err
+		}
+		if code, err = b.GenerateIR(ir); err != nil {
+			return "", err
+		}
+	} else {
+		mod, res, info, err := d.check(filename)
+		if err != nil {
+			return "", err
+		}
+		if code, err = backend.Generate(mod, res, info); err != nil {
+			return "", err
+		}
+	}
+	d.logf(2, "======= Module Output =======\n%s\n", code)
+	return code, nil
+}
+
+// baseName is the name of a source file without its directory or .b
+func baseName(filename string) string {
+	return strings.TrimSuffix(path.Base(filename), ".b")
+}
+
+// sourceArg checks that args starts with a .b file
+func sourceArg(args []string) (string, error) {
+	if len(args) == 0 {
+		return "", errUsage
+	}
+	if !strings.HasSuffix(args[0], ".b") {
+		return "", fmt.Errorf("bad filename pattern '%s', need it to end in '.b'", args[0])
+	}
+	return args[0], nil
+}
 
-	if _, err := f.Write([]byte(cCode)); err != nil {
-		log.Fatal(err)
+func cmdBuild(d *driver, args []string) error {
+	filename, err := sourceArg(args)
+	if err != nil {
+		return err
+	}
+	if len(args) > 1 {
+		return errUsage
+	}
+	return d.compile(filename)
+}
+
+func cmdRun(d *driver, args []string) error {
+	if len(args) > 0 && strings.HasSuffix(args[0], ".bc") {
+		prog, err := d.loadProgram(args[0])
+		if err != nil {
+			return err
+		}
+		return d.runProgram(prog)
+	}
+	filename, err := sourceArg(args)
+	if err != nil {
+		return err
+	}
+	if d.interp {
+		return d.interpret(filename)
+	}
+	if d.build.backend == "bc" {
+		prog, err := d.loadProgram(filename)
+		if err != nil {
+			return err
+		}
+		return d.runProgram(prog)
+	}
+	dir, err := os.MkdirTemp("", "compy")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	exe := filepath.Join(dir, baseName(filename))
+	d.build.output = exe
+	if err := d.compile(filename); err != nil {
+		return err
+	}
+	// Any warnings should be summed up before the program's output
+	d.diags.PrintSummary()
+
+	cmd := exec.Command(exe, args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	d.logf(1, "running %s\n", cmd)
+	err = cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		// A program killed by a signal has no exit status, so it's given
+		// the one a shell would
+		if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			fmt.Fprintf(os.Stderr, "compy: %s: %v\n", baseName(filename), ws.Signal())
+			return exitError{128 + int(ws.Signal())}
+		}
+		return exitError{exitErr.ExitCode()}
+	}
+	return err
+}
+
+// interpret runs a program with the interpreter, args aren't passed on
+// since programs have no way to see them
+func (d *driver) interpret(filename string) error {
+	mod, res, _, err := d.check(filename)
+	if err != nil {
+		return err
+	}
+	d.diags.PrintSummary()
+	d.logf(1, "interpreting %s\n", filename)
+	code, err := Interpret(mod, res, os.Stdout)
+	if err != nil {
+		return err
+	}
+	return exitStatus(code)
+}
+
+// loadProgram compiles a source file to bytecode, or loads a compiled .bc
+// file
+func (d *driver) loadProgram(filename string) (*Program, error) {
+	if strings.HasSuffix(filename, ".bc") {
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		prog := &Program{}
+		if err := prog.UnmarshalBinary(data); err != nil {
+			return nil, fmt.Errorf("loading %s: %w", filename, err)
+		}
+		return prog, nil
+	}
+	mod, res, info, err := d.check(filename)
+	if err != nil {
+		return nil, err
+	}
+	return CompileBytecode(mod, res, info)
+}
+
+// runProgram runs bytecode with the VM
+func (d *driver) runProgram(prog *Program) error {
+	d.diags.PrintSummary()
+	d.logf(1, "running %s with the VM\n", prog.Filename)
+	code, err := RunBytecode(prog, os.Stdout)
+	if err != nil {
+		return err
+	}
+	return exitStatus(code)
+}
+
+// exitStatus passes on the status a program exited with, like cmdRun does
+// for a compiled one
+func exitStatus(code int) error {
+	// Only the low byte of an exit status makes it to the parent
+	if code&0xff != 0 {
+		return exitError{code & 0xff}
+	}
+	return nil
+}
+
+func cmdCheck(d *driver, args []string) error {
+	filename, err := sourceArg(args)
+	if err != nil {
+		return err
+	}
+	if len(args) > 1 {
+		return errUsage
+	}
+	_, _, _, err = d.check(filename)
+	return err
+}
+
+func cmdEmit(d *driver, args []string) error {
+	if len(args) != 2 {
+		return errUsage
+	}
+	if args[0] == "ir" {
+		filename, err := sourceArg(args[1:])
+		if err != nil {
+			return err
+		}
+		ir, err := d.optimise(filename)
+		if err != nil {
+			return err
+		}
+		WriteIR(os.Stdout, ir)
+		return nil
+	}
+	backend, err := LookupBackend(args[0])
+	if err != nil {
+		return err
+	}
+	// The backend is an argument rather than a flag, so the flags that
+	// depend on it are checked here
+	d.build.backend = args[0]
+	if err := d.build.validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "compy: %v\n", err)
+		return exitError{2}
+	}
+	filename, err := sourceArg(args[1:])
+	if err != nil {
+		return err
+	}
+	code, err := d.generate(filename, backend)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.WriteString(code)
+	return err
+}
+
+func cmdRepl(d *driver, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	// The REPL reports problems as it goes, so it has its own printer
+	// rather than leaving a summary of them all for the end
+	var repl *Repl
+	if d.printer != nil {
+		printer := NewDiagnosticPrinter(os.Stderr, d.printer.Color)
+		repl = NewRepl(os.Stdout, printer, printer)
+	} else {
+		repl = NewRepl(os.Stdout, NewJSONDiagnosticPrinter(os.Stderr), nil)
+	}
+	repl.Prompt = isTerminal(os.Stdin)
+	return repl.Run(os.Stdin)
+}
+
+func cmdDisasm(d *driver, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	filename := args[0]
+	if !strings.HasSuffix(filename, ".bc") {
+		if _, err := sourceArg(args); err != nil {
+			return err
+		}
+	}
+	prog, err := d.loadProgram(filename)
+	if err != nil {
+		return err
+	}
+	prog.Disassemble(os.Stdout)
+	return nil
+}
+
+func cmdTokens(d *driver, args []string) error {
+	filename, err := sourceArg(args)
+	if err != nil {
+		return err
+	}
+	if len(args) > 1 {
+		return errUsage
+	}
+	src, err := d.readSource(filename)
+	if err != nil {
+		return err
+	}
+	DumpTokens(os.Stdout, src)
+	return nil
+}
+
+func cmdAst(d *driver, args []string) error {
+	filename, err := sourceArg(args)
+	if err != nil {
+		return err
 	}
-	if err := f.Close(); err != nil {
-		log.Fatal(err)
+	if len(args) > 1 {
+		return errUsage
 	}
-	compileCmd := exec.Command("cc", "-O0", "-g", "-o", basename, f.Name())
-	fmt.Println("Compile Command:", compileCmd)
-	ccOut, err := compileCmd.CombinedOutput()
-	fmt.Println("======= CC Output =======")
-	fmt.Println(string(ccOut))
+	mod, err := d.parse(filename)
 	if err != nil {
-		fmt.Printf("Error running CC: %s\n", err)
-		os.Exit(1)
+		return err
 	}
-	fmt.Println("======== DONE ========")
+	DumpAst(os.Stdout, mod)
+	return nil
 }
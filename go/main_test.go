@@ -0,0 +1,217 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func writeSource(t *testing.T, src string) string {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "test.b")
+	if err := os.WriteFile(filename, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestRunCommand(t *testing.T) {
+	good := writeSource(t, "module m;\nfn main(): int { return 0; }\n")
+	bad := writeSource(t, "module m;\nfn main(): int { return x; }\n")
+	cases := []struct {
+		args []string
+		code int
+	}{
+		{[]string{}, 2},
+		{[]string{"frobnicate"}, 2},
+		{[]string{"check"}, 2},
+		{[]string{"check", good}, 0},
+		{[]string{"check", bad}, 1},
+		{[]string{"check", "--diagnostics=xml", good}, 2},
+		{[]string{"check", "nope.txt"}, 1},
+		{[]string{"emit", "wasm", good}, 1},
+		{[]string{"emit", "ir", good}, 0},
+		{[]string{"emit", "ir", bad}, 1},
+		{[]string{"emit", "-O2", "ir", good}, 0},
+		{[]string{"emit", "--passes=cse,dce", "c", good}, 0},
+		{[]string{"emit", "--passes=dce", "asm", good}, 2},
+		{[]string{"emit", "--passes=dce", "bc", good}, 2},
+		{[]string{"emit", "-O2", "asm", good}, 0},
+		{[]string{"tokens", good, "extra"}, 2},
+	}
+	for _, tc := range cases {
+		if code := runCommand(tc.args); code != tc.code {
+			t.Errorf("running compy %q: expected exit status %d got %d", tc.args, tc.code, code)
+		}
+	}
+}
+
+// captureOutput runs f with *file writing somewhere else, and returns what
+// was written
+func captureOutput(t *testing.T, file **os.File, f func()) string {
+	t.Helper()
+	tmp, err := os.CreateTemp(t.TempDir(), "out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tmp.Close()
+	saved := *file
+	*file = tmp
+	defer func() { *file = saved }()
+	f()
+	out, err := os.ReadFile(tmp.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out)
+}
+
+func TestCheckOnlyWritesDiagnostics(t *testing.T) {
+	filename := writeSource(t, "module m;\nfn f(1): int { return 0; }\n")
+	code := 0
+	stdout := captureOutput(t, &os.Stdout, func() {
+		code = runCommand([]string{"check", "--diagnostics=json", filename})
+	})
+	if code != 1 || stdout != "" {
+		t.Errorf("expected status 1 and nothing on stdout, got %d and %q", code, stdout)
+	}
+}
+
+func TestRunCommandRun(t *testing.T) {
+	if _, err := exec.LookPath("cc"); err != nil {
+		t.Skip("no C compiler")
+	}
+	filename := writeSource(t, "module m;\nfn main(): int { return 42; }\n")
+	if code := runCommand([]string{"run", filename, "arg"}); code != 42 {
+		t.Errorf("expected the program's exit status 42, got %d", code)
+	}
+}
+
+func TestRunCommandSignal(t *testing.T) {
+	if _, err := exec.LookPath("cc"); err != nil {
+		t.Skip("no C compiler")
+	}
+	filename := writeSource(t, "module m;\nfn main(): int { var z = 0; return 7 / z; }\n")
+	for _, backend := range []string{"c", "asm"} {
+		code := 0
+		out := captureOutput(t, &os.Stderr, func() {
+			code = runCommand([]string{"run", "--backend=" + backend, filename})
+		})
+		// Dividing by zero raises SIGFPE
+		if code != 128+int(syscall.SIGFPE) || !strings.Contains(string(out), "compy: test: floating point exception") {
+			t.Errorf("with the %s backend: expected status %d and the signal reported, got %d and %q", backend, 128+int(syscall.SIGFPE), code, out)
+		}
+	}
+}
+
+func TestRunCommandInterp(t *testing.T) {
+	filename := writeSource(t, "module m;\nfn main(): int { return 300; }\n")
+	if code := runCommand([]string{"run", "--interp", filename}); code != 300&0xff {
+		t.Errorf("expected the program's exit status %d, got %d", 300&0xff, code)
+	}
+	bad := writeSource(t, "module m;\nfn main(): int { return 1 / 0; }\n")
+	if code := runCommand([]string{"run", "--interp", bad}); code != 1 {
+		t.Errorf("expected exit status 1 for a runtime error, got %d", code)
+	}
+}
+
+func TestRunCommandBytecode(t *testing.T) {
+	filename := writeSource(t, "module m;\nfn main(): int { return 300; }\n")
+	if code := runCommand([]string{"run", "--backend=bc", filename}); code != 300&0xff {
+		t.Errorf("expected the program's exit status %d, got %d", 300&0xff, code)
+	}
+	bc := filepath.Join(t.TempDir(), "m.bc")
+	if code := runCommand([]string{"build", "--backend=bc", "-o", bc, filename}); code != 0 {
+		t.Fatalf("expected exit status 0 building bytecode, got %d", code)
+	}
+	for _, args := range [][]string{{"run", bc}, {"disasm", bc}, {"disasm", filename}} {
+		want := 0
+		if args[0] == "run" {
+			want = 300 & 0xff
+		}
+		if code := runCommand(args); code != want {
+			t.Errorf("running compy %q: expected exit status %d got %d", args, want, code)
+		}
+	}
+	if code := runCommand([]string{"run", filename + ".bc"}); code != 1 {
+		t.Errorf("expected exit status 1 for a missing bytecode file, got %d", code)
+	}
+	if code := runCommand([]string{"build", "--backend=bc", "-c", filename}); code != 2 {
+		t.Errorf("expected exit status 2 for -c with bytecode, got %d", code)
+	}
+}
+
+func TestBuildOutputs(t *testing.T) {
+	if _, err := exec.LookPath("cc"); err != nil {
+		t.Skip("no C compiler")
+	}
+	filename := writeSource(t, "module m;\nfn main(): int { return 0; }\n")
+	dir := t.TempDir()
+	cases := []struct {
+		args  []string
+		files []string
+	}{
+		{[]string{"-o", filepath.Join(dir, "prog")}, []string{"prog"}},
+		{[]string{"-O2", "--keep-c", "-o", filepath.Join(dir, "kept")}, []string{"kept", "kept.c"}},
+		{[]string{"-c", "-o", filepath.Join(dir, "obj.o")}, []string{"obj.o"}},
+		{[]string{"-c", "-o", filepath.Join(dir, "libm.a")}, []string{"libm.a"}},
+		{[]string{"--cc", "cc -Wall", "--cflags=-DX=1 -g0", "--ldflags=-lm", "-o", filepath.Join(dir, "flags")}, []string{"flags"}},
+	}
+	for _, tc := range cases {
+		args := append([]string{"build"}, tc.args...)
+		if code := runCommand(append(args, filename)); code != 0 {
+			t.Errorf("running compy %q: expected exit status 0 got %d", args, code)
+			continue
+		}
+		for _, f := range tc.files {
+			if _, err := os.Stat(filepath.Join(dir, f)); err != nil {
+				t.Errorf("running compy %q: expected %s to be made: %v", args, f, err)
+			}
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "prog.c")); err == nil {
+		t.Errorf("expected the generated C to be removed without --keep-c")
+	}
+}
+
+func TestBuildFlagErrors(t *testing.T) {
+	filename := writeSource(t, "module m;\nfn main(): int { return 0; }\n")
+	out := filepath.Join(t.TempDir(), "out")
+	cases := []struct {
+		args []string
+		code int
+	}{
+		{[]string{"build", "-O9", filename}, 2},
+		{[]string{"build", "-c", "--ldflags=-lm", filename}, 2},
+		{[]string{"build", "--passes=dce,fast", filename}, 2},
+		{[]string{"build", "--backend=asm", "--passes=dce", filename}, 2},
+		{[]string{"build", "--cc", "/no/such/cc", "-o", out, filename}, 1},
+		{[]string{"run", "-o", out, filename}, 2},
+	}
+	for _, tc := range cases {
+		if code := runCommand(tc.args); code != tc.code {
+			t.Errorf("running compy %q: expected exit status %d got %d", tc.args, tc.code, code)
+		}
+	}
+}
+
+func TestOptFlags(t *testing.T) {
+	d := &driver{}
+	fs := flag.NewFlagSet("build", flag.ContinueOnError)
+	addBuildFlags(d, fs)
+	cases := []struct{ in, out string }{
+		{"-O2 x.b", "-O=2 x.b"},
+		{"-o -O2 --O3 -c x.b -O1", "-o -O2 -O=3 -c x.b -O1"},
+		{"-- -O2", "-- -O2"},
+	}
+	for _, tc := range cases {
+		got := strings.Join(optFlags(fs, strings.Fields(tc.in)), " ")
+		if got != tc.out {
+			t.Errorf("rewriting %q: expected %q got %q", tc.in, tc.out, got)
+		}
+	}
+}
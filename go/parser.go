@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"runtime/debug"
 	"strconv"
@@ -14,6 +15,14 @@ type Parser struct {
 	nextTok Token
 
 	filename string
+	// Labels of the loops enclosing the statement being parsed, innermost
+	// last. Unlabelled loops have an empty label.
+	loops []string
+	// Every error found so far, the parser recovers from errors in
+	// statements so it can report as many as possible in one go
+	errors []error
+	// The end of the last token consumed
+	prevEnd Pos
 }
 
 type ParseError struct {
@@ -21,6 +30,13 @@ type ParseError struct {
 	Filename string
 	Line     uint
 	Col      uint
+
+	// The rest is extra detail for diagnostics, see Diagnostic
+	Code   string
+	Span   Span
+	Labels []Label
+	Notes  []string
+	Fix    *Fix
 }
 
 func NewParser(input string, filename string) Parser {
@@ -32,12 +48,23 @@ func NewParser(input string, filename string) Parser {
 }
 
 func (p *Parser) nextToken() {
+	p.prevEnd = p.tok.End
 	p.tok = p.nextTok
 	p.nextTok = p.lexer.Next()
 }
 
+// pos is where the current token starts
+func (p *Parser) pos() Pos {
+	return p.tok.Pos()
+}
+
+// nodeAt makes the node for something that was parsed from start up to
+// the last token consumed
+func (p *Parser) nodeAt(start Pos) node {
+	return node{Span{start, p.prevEnd}}
+}
+
 func (p *Parser) expectv(expected TokenKind) (string, error) {
-	//fmt.Printf("expectv: %v, %v, %v\n", p, expected, p.tok.Kind)
 	if p.tok.Kind != expected {
 		return "", p.parseErrorExp(expected)
 	}
@@ -62,27 +89,74 @@ func (p *Parser) nextIs(expected TokenKind) bool {
 }
 
 func (p *Parser) parseError() error {
-	return p.parseErrorMsg(fmt.Sprintf("unexpected token: %v", p.tok.Kind))
+	return p.parseErrorMsg(fmt.Sprintf("unexpected %v", p.tok.Kind))
 }
 func (p *Parser) parseErrorExp(expect TokenKind) error {
-	return p.parseErrorMsg(fmt.Sprintf("expected token: %v got: %v", expect, p.tok.Kind))
+	return p.parseErrorMsg(fmt.Sprintf("expected %v, found %v", expect, p.tok.Kind))
 }
+
+// parseErrorMsg makes a ParseError at the current token. If the lexer
+// couldn't make sense of the token then its error is reported instead,
+// it is more useful than whatever the parser was expecting.
 func (p *Parser) parseErrorMsg(msg string) error {
 	if DEBUG {
 		debug.PrintStack()
 	}
-	return ParseError{
+	err := ParseError{
 		Msg:      msg,
 		Filename: p.filename,
 		Line:     p.tok.Line,
 		Col:      p.tok.Col,
+		Code:     CodeSyntax,
+		Span:     Span{p.tok.Pos(), p.tok.End},
+	}
+	if p.tok.Kind == TokErr && p.tok.Error != nil {
+		err.Msg = p.tok.Error.Error()
+		err.Code = CodeLex
+		var suggest suggestError
+		if errors.As(p.tok.Error, &suggest) {
+			err.Fix = &Fix{
+				Msg:         fmt.Sprintf("replace %q with %q", p.tok.Text, suggest.replacement),
+				Span:        err.Span,
+				Replacement: suggest.replacement,
+			}
+		}
+	}
+	return err
+}
+
+// nodeError makes an error pointing at the start of n
+func nodeError(filename string, n Node, format string, a ...any) ParseError {
+	return spanError(filename, n.Span(), format, a...)
+}
+
+// spanError makes an error pointing at the start of span, for when
+// there's no node
+func spanError(filename string, span Span, format string, a ...any) ParseError {
+	return ParseError{
+		Msg:      fmt.Sprintf(format, a...),
+		Filename: filename,
+		Line:     span.Start.Line,
+		Col:      span.Start.Col,
+		Span:     span,
 	}
 }
+
 func (e ParseError) Error() string {
+	if e.Line == 0 {
+		// Some runtime errors aren't anywhere in particular
+		return fmt.Sprintf("%s: %s", e.Filename, e.Msg)
+	}
 	return fmt.Sprintf("%s:%d:%d  %s", e.Filename, e.Line, e.Col, e.Msg)
 }
 
+// ParseModule parses a whole module. Errors in statements don't stop the
+// parse, the parser skips ahead to the next statement and carries on, so
+// the error returned holds every problem found (see Errors). Even when
+// there are errors a partial module is returned, unless the module header
+// itself is broken.
 func (p *Parser) ParseModule() (*AstModule, error) {
+	start := p.pos()
 	if err := p.expect(TokModule); err != nil {
 		return nil, err
 	}
@@ -93,45 +167,189 @@ func (p *Parser) ParseModule() (*AstModule, error) {
 	if err := p.expect(TokSemi); err != nil {
 		return nil, err
 	}
-	mod := AstModule{Name: modName}
+	mod := AstModule{Name: modName, Filename: p.filename}
 	for {
 		if p.peekIs(TokEof) {
 			break
 		}
+		start := p.tok
 		st, err := p.ParseStatement()
 		if err != nil {
-			return nil, err
+			p.recordError(err)
+			p.syncDecl(start)
+			continue
 		}
 		mod.Statements = append(mod.Statements, st)
-
-		// We only need to grab a semi colon after variable
-		// and constant declarations, function decls don't
-		// need a semicolon.
-		// Im sure there must be a better way to do this
-		switch st.(type) {
-		case *AstConstAssign:
+		if needsSemi(st) {
 			if err := p.expect(TokSemi); err != nil {
-				return nil, err
+				p.recordError(err)
+				p.syncDecl(start)
+			}
+		}
+	}
+
+	mod.node = p.nodeAt(start)
+	return &mod, errors.Join(p.errors...)
+}
+
+// Errors returns every error the parser has found so far
+func (p *Parser) Errors() []error {
+	return p.errors
+}
+
+func (p *Parser) recordError(err error) {
+	// Recovering can leave us reporting the same spot twice
+	if pe, ok := err.(ParseError); ok && len(p.errors) > 0 {
+		if last, ok := p.errors[len(p.errors)-1].(ParseError); ok && last.Line == pe.Line && last.Col == pe.Col {
+			return
+		}
+	}
+	p.errors = append(p.errors, err)
+}
+
+// skipUntil skips tokens until stop returns true for one that isn't
+// nested inside braces, the closing brace of the enclosing block or the
+// end of the file. A semicolon ends the skipping after it is consumed.
+// If the parser is still on start, the token the failed statement began
+// at, it is skipped anyway so the caller can't get stuck.
+func (p *Parser) skipUntil(start Token, stop func(TokenKind) bool) {
+	depth := 0
+loop:
+	for !p.peekIs(TokEof) {
+		switch kind := p.peek(); {
+		case depth == 0 && stop(kind):
+			break loop
+		case kind == TokLbrace:
+			depth++
+		case kind == TokRbrace:
+			if depth == 0 {
+				break loop
 			}
+			depth--
+		case kind == TokSemi && depth == 0:
+			p.nextToken()
+			return
 		}
+		p.nextToken()
 	}
+	if !p.peekIs(TokEof) && p.tok.Line == start.Line && p.tok.Col == start.Col {
+		p.nextToken()
+	}
+}
+
+// syncDecl recovers from an error at the top level by skipping to the
+// start of the next declaration
+func (p *Parser) syncDecl(start Token) {
+	p.skipUntil(start, func(kind TokenKind) bool {
+		return kind == TokFn || kind == TokLet || kind == TokVar
+	})
+}
 
-	return &mod, nil
+// Tokens that can only start a statement
+var statementStarts = map[TokenKind]bool{
+	TokLet:      true,
+	TokVar:      true,
+	TokFn:       true,
+	TokIf:       true,
+	TokWhile:    true,
+	TokFor:      true,
+	TokReturn:   true,
+	TokBreak:    true,
+	TokContinue: true,
+}
+
+// syncStatement recovers from an error in a block by skipping to the
+// start of the next statement or the end of the block
+func (p *Parser) syncStatement(start Token) {
+	p.skipUntil(start, func(kind TokenKind) bool { return statementStarts[kind] })
+}
+
+// needsSemi reports if a statement has to be terminated with a semicolon.
+// Statements that end in a block (function decls, if, ...) don't.
+func needsSemi(st AstStatement) bool {
+	switch st.(type) {
+	case *AstFnDecl, *AstIf, *AstBlock, *AstWhile, *AstFor, *AstRangeFor:
+		return false
+	}
+	return true
 }
 
 func (p *Parser) ParseStatement() (AstStatement, error) {
 	switch p.peek() {
 	case TokLet:
 		return p.ParseConstAssign()
+	case TokVar:
+		return p.ParseVarDecl()
 	case TokFn:
 		return p.ParseFnDecl()
+	case TokIf:
+		return p.ParseIf()
+	case TokReturn:
+		return p.ParseReturn()
+	case TokWhile, TokFor:
+		return p.ParseLoop(nil)
+	case TokBreak:
+		return p.ParseBreak()
+	case TokContinue:
+		return p.ParseContinue()
+	case TokIdent:
+		if p.nextIs(TokColon) {
+			return p.ParseLabelledLoop()
+		}
+		if assignOps[p.nextTok.Kind] {
+			return p.ParseAssign()
+		}
+		return p.ParseFnCall()
+	}
+	return nil, p.parseError()
+}
+
+// ParseSimpleStatement parses the statements allowed in the init and
+// step clauses of a for loop
+func (p *Parser) ParseSimpleStatement() (AstStatement, error) {
+	switch p.peek() {
+	case TokLet:
+		return p.ParseConstAssign()
+	case TokVar:
+		return p.ParseVarDecl()
 	case TokIdent:
+		if assignOps[p.nextTok.Kind] {
+			return p.ParseAssign()
+		}
 		return p.ParseFnCall()
 	}
 	return nil, p.parseError()
 }
 
+var assignOps = map[TokenKind]bool{
+	TokAssign:        true,
+	TokPlusAssign:    true,
+	TokMinusAssign:   true,
+	TokStarAssign:    true,
+	TokDivAssign:     true,
+	TokPercentAssign: true,
+}
+
+func (p *Parser) ParseAssign() (*AstAssign, error) {
+	start := p.pos()
+	target, err := p.ParseIdent()
+	if err != nil {
+		return nil, err
+	}
+	op := p.peek()
+	if !assignOps[op] {
+		return nil, p.parseError()
+	}
+	p.nextToken()
+	val, err := p.ParseExpr()
+	if err != nil {
+		return nil, err
+	}
+	return &AstAssign{node: p.nodeAt(start), Target: target, Op: op, Value: val}, nil
+}
+
 func (p *Parser) ParseFnCall() (*AstFnCall, error) {
+	start := p.pos()
 	fnName, err := p.ParseIdent()
 	if err != nil {
 		return nil, err
@@ -156,21 +374,52 @@ func (p *Parser) ParseFnCall() (*AstFnCall, error) {
 			}
 		}
 	}
-	return &AstFnCall{fnName, args}, nil
+	return &AstFnCall{p.nodeAt(start), fnName, args}, nil
 
 }
 func (p *Parser) ParseConstAssign() (*AstConstAssign, error) {
+	start := p.pos()
 	if err := p.expect(TokLet); err != nil {
 		return nil, err
 	}
-	constName, err := p.expectv(TokIdent)
+	constName, err := p.ParseIdent()
 	if err != nil {
 		return nil, err
 	}
-	if err := p.expect(TokColon); err != nil {
+	type_, err := p.parseTypeAnnotation()
+	if err != nil {
 		return nil, err
 	}
-	type_, err := p.ParseType()
+	if err := p.expect(TokAssign); err != nil {
+		return nil, err
+	}
+	valExpr, err := p.ParseExpr()
+	if err != nil {
+		return nil, err
+	}
+	return &AstConstAssign{node: p.nodeAt(start), Ident: constName, Type: type_, Value: valExpr}, nil
+}
+
+// parseTypeAnnotation parses the optional `: type` of a let or var, the
+// type is nil if there isn't one and has to be inferred by the checker
+func (p *Parser) parseTypeAnnotation() (*AstType, error) {
+	if !p.peekIs(TokColon) {
+		return nil, nil
+	}
+	p.nextToken()
+	return p.ParseType()
+}
+
+func (p *Parser) ParseVarDecl() (*AstVarDecl, error) {
+	start := p.pos()
+	if err := p.expect(TokVar); err != nil {
+		return nil, err
+	}
+	varName, err := p.ParseIdent()
+	if err != nil {
+		return nil, err
+	}
+	type_, err := p.parseTypeAnnotation()
 	if err != nil {
 		return nil, err
 	}
@@ -181,16 +430,91 @@ func (p *Parser) ParseConstAssign() (*AstConstAssign, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &AstConstAssign{Ident: constName, Type: type_, Value: valExpr}, nil
+	return &AstVarDecl{node: p.nodeAt(start), Ident: varName, Type: type_, Value: valExpr}, nil
 }
 
+// Binding powers for the infix operators, higher binds tighter.
+var binaryPrec = map[TokenKind]int{
+	TokOr:      1,
+	TokAnd:     2,
+	TokEq:      3,
+	TokNeq:     3,
+	TokLt:      4,
+	TokLte:     4,
+	TokGt:      4,
+	TokGte:     4,
+	TokPlus:    5,
+	TokMinus:   5,
+	TokStar:    6,
+	TokDiv:     6,
+	TokPercent: 6,
+}
+
+// Prefix operators bind tighter than any infix operator
+const unaryPrec = 7
+
 func (p *Parser) ParseExpr() (AstExpr, error) {
-	if p.peekIs(TokIdent) {
+	return p.parseExprPrec(0)
+}
+
+// parseExprPrec is a precedence climbing (Pratt) parser, it parses an
+// operand and then keeps folding in infix operators for as long as they
+// bind tighter than minPrec. All the binary operators are left associative.
+func (p *Parser) parseExprPrec(minPrec int) (AstExpr, error) {
+	left, err := p.ParseUnaryExpr()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek()
+		prec, ok := binaryPrec[op]
+		if !ok || prec <= minPrec {
+			return left, nil
+		}
+		p.nextToken()
+		right, err := p.parseExprPrec(prec)
+		if err != nil {
+			return nil, err
+		}
+		left = &AstBinaryExpr{node: node{Span{left.Span().Start, p.prevEnd}}, Op: op, Left: left, Right: right}
+	}
+}
+
+func (p *Parser) ParseUnaryExpr() (AstExpr, error) {
+	start := p.pos()
+	if p.peekIs(TokMinus) || p.peekIs(TokNot) {
+		op := p.peek()
+		p.nextToken()
+		expr, err := p.parseExprPrec(unaryPrec)
+		if err != nil {
+			return nil, err
+		}
+		return &AstUnaryExpr{node: p.nodeAt(start), Op: op, Expr: expr}, nil
+	}
+	return p.ParsePrimaryExpr()
+}
+
+func (p *Parser) ParsePrimaryExpr() (AstExpr, error) {
+	if p.peekIs(TokIdent) && p.nextIs(TokLpar) {
+		return p.ParseFnCall()
+	} else if p.peekIs(TokIdent) {
 		return p.ParseVarRef()
 	} else if p.peekIs(TokInt) {
 		return p.ParseIntLitExpr()
 	} else if p.peekIs(TokString) {
 		return p.ParseStringLitExpr()
+	} else if p.peekIs(TokTrue) || p.peekIs(TokFalse) {
+		return p.ParseBoolLitExpr()
+	} else if p.peekIs(TokLpar) {
+		p.nextToken()
+		expr, err := p.ParseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(TokRpar); err != nil {
+			return nil, err
+		}
+		return expr, nil
 	}
 	return nil, p.parseError()
 }
@@ -204,6 +528,7 @@ func (p *Parser) ParseVarRef() (*AstIdent, error) {
 }
 
 func (p *Parser) ParseIntLitExpr() (*AstIntLitExpr, error) {
+	start := p.pos()
 	intText, err := p.expectv(TokInt)
 	if err != nil {
 		return nil, err
@@ -212,26 +537,41 @@ func (p *Parser) ParseIntLitExpr() (*AstIntLitExpr, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &AstIntLitExpr{Value: intVal}, nil
+	return &AstIntLitExpr{node: p.nodeAt(start), Value: intVal}, nil
 }
 
 func (p *Parser) ParseStringLitExpr() (*AstStringLitExpr, error) {
+	start := p.pos()
 	text, err := p.expectv(TokString)
 	if err != nil {
 		return nil, err
 	}
-	return &AstStringLitExpr{Value: text}, nil
+	return &AstStringLitExpr{node: p.nodeAt(start), Value: text}, nil
+}
+
+func (p *Parser) ParseBoolLitExpr() (*AstBoolLitExpr, error) {
+	start := p.pos()
+	if p.peekIs(TokTrue) {
+		p.nextToken()
+		return &AstBoolLitExpr{node: p.nodeAt(start), Value: true}, nil
+	}
+	if err := p.expect(TokFalse); err != nil {
+		return nil, err
+	}
+	return &AstBoolLitExpr{node: p.nodeAt(start), Value: false}, nil
 }
 
 func (p *Parser) ParseType() (*AstType, error) {
+	start := p.pos()
 	text, err := p.ParseIdent()
 	if err != nil {
 		return nil, err
 	}
-	return &AstType{Name: text}, nil
+	return &AstType{node: p.nodeAt(start), Name: text}, nil
 }
 
 func (p *Parser) ParseFnDecl() (*AstFnDecl, error) {
+	start := p.pos()
 	if err := p.expect(TokFn); err != nil {
 		return nil, err
 	}
@@ -257,7 +597,6 @@ func (p *Parser) ParseFnDecl() (*AstFnDecl, error) {
 				p.nextToken()
 			}
 		} else {
-			fmt.Println(p.peek())
 			return nil, p.parseError()
 		}
 	}
@@ -271,11 +610,16 @@ func (p *Parser) ParseFnDecl() (*AstFnDecl, error) {
 	if err != nil {
 		return nil, err
 	}
+	// Loops don't extend into a function body
+	outerLoops := p.loops
+	p.loops = nil
 	block, err := p.ParseBlock()
+	p.loops = outerLoops
 	if err != nil {
 		return nil, err
 	}
 	ret := AstFnDecl{
+		node:       p.nodeAt(start),
 		Name:       fnName,
 		ReturnType: returnType,
 		Params:     params,
@@ -285,6 +629,7 @@ func (p *Parser) ParseFnDecl() (*AstFnDecl, error) {
 }
 
 func (p *Parser) ParseBlock() (*AstBlock, error) {
+	start := p.pos()
 	if err := p.expect(TokLbrace); err != nil {
 		return nil, err
 	}
@@ -294,19 +639,245 @@ func (p *Parser) ParseBlock() (*AstBlock, error) {
 			p.nextToken()
 			break
 		}
+		if p.peekIs(TokEof) {
+			return nil, p.parseErrorExp(TokRbrace)
+		}
+		start := p.tok
 		st, err := p.ParseStatement()
 		if err != nil {
-			return nil, err
+			p.recordError(err)
+			p.syncStatement(start)
+			continue
 		}
 		stmts = append(stmts, st)
-		if err := p.expect(TokSemi); err != nil {
+		if needsSemi(st) {
+			if err := p.expect(TokSemi); err != nil {
+				p.recordError(err)
+				p.syncStatement(start)
+			}
+		}
+	}
+	return &AstBlock{p.nodeAt(start), stmts}, nil
+}
+
+func (p *Parser) ParseIf() (*AstIf, error) {
+	start := p.pos()
+	if err := p.expect(TokIf); err != nil {
+		return nil, err
+	}
+	cond, err := p.ParseExpr()
+	if err != nil {
+		return nil, err
+	}
+	then, err := p.ParseBlock()
+	if err != nil {
+		return nil, err
+	}
+	ret := &AstIf{node: p.nodeAt(start), Cond: cond, Then: then}
+	if !p.peekIs(TokElse) {
+		return ret, nil
+	}
+	p.nextToken()
+	if p.peekIs(TokIf) {
+		ret.Else, err = p.ParseIf()
+	} else {
+		ret.Else, err = p.ParseBlock()
+	}
+	if err != nil {
+		return nil, err
+	}
+	ret.node = p.nodeAt(start)
+	return ret, nil
+}
+
+func (p *Parser) ParseLabelledLoop() (AstStatement, error) {
+	label, err := p.ParseIdent()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(TokColon); err != nil {
+		return nil, err
+	}
+	if !p.peekIs(TokWhile) && !p.peekIs(TokFor) {
+		return nil, p.parseErrorMsg(fmt.Sprintf("label %s must be followed by a loop", label.Name))
+	}
+	for _, l := range p.loops {
+		if l == label.Name {
+			return nil, p.parseErrorMsg(fmt.Sprintf("label %s is already in use by an enclosing loop", label.Name))
+		}
+	}
+	return p.ParseLoop(label)
+}
+
+// ParseLoop parses any of the while or for loop forms
+func (p *Parser) ParseLoop(label *AstIdent) (AstStatement, error) {
+	// The loop's span includes its label
+	start := p.pos()
+	if label != nil {
+		start = label.Span().Start
+	}
+	if p.peekIs(TokWhile) {
+		return p.ParseWhile(label, start)
+	}
+	if err := p.expect(TokFor); err != nil {
+		return nil, err
+	}
+	if p.peekIs(TokIdent) && p.nextIs(TokIn) {
+		return p.ParseRangeFor(label, start)
+	}
+	return p.ParseFor(label, start)
+}
+
+// parseLoopBody parses the body of a loop, making the loop available
+// to any break or continue statements inside it
+func (p *Parser) parseLoopBody(label *AstIdent) (*AstBlock, error) {
+	name := ""
+	if label != nil {
+		name = label.Name
+	}
+	p.loops = append(p.loops, name)
+	defer func() { p.loops = p.loops[:len(p.loops)-1] }()
+	return p.ParseBlock()
+}
+
+func (p *Parser) ParseWhile(label *AstIdent, start Pos) (*AstWhile, error) {
+	if err := p.expect(TokWhile); err != nil {
+		return nil, err
+	}
+	cond, err := p.ParseExpr()
+	if err != nil {
+		return nil, err
+	}
+	body, err := p.parseLoopBody(label)
+	if err != nil {
+		return nil, err
+	}
+	return &AstWhile{node: p.nodeAt(start), Label: label, Cond: cond, Body: body}, nil
+}
+
+// ParseFor parses `init; cond; step {}` after the `for` keyword.
+func (p *Parser) ParseFor(label *AstIdent, start Pos) (*AstFor, error) {
+	ret := &AstFor{Label: label}
+	var err error
+	if !p.peekIs(TokSemi) {
+		if ret.Init, err = p.ParseSimpleStatement(); err != nil {
 			return nil, err
 		}
 	}
-	return &AstBlock{stmts}, nil
+	if err := p.expect(TokSemi); err != nil {
+		return nil, err
+	}
+	if !p.peekIs(TokSemi) {
+		if ret.Cond, err = p.ParseExpr(); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.expect(TokSemi); err != nil {
+		return nil, err
+	}
+	if !p.peekIs(TokLbrace) {
+		if ret.Step, err = p.ParseSimpleStatement(); err != nil {
+			return nil, err
+		}
+	}
+	if ret.Body, err = p.parseLoopBody(label); err != nil {
+		return nil, err
+	}
+	ret.node = p.nodeAt(start)
+	return ret, nil
+}
+
+// ParseRangeFor parses `x in lo..hi {}` after the `for` keyword.
+func (p *Parser) ParseRangeFor(label *AstIdent, start Pos) (*AstRangeFor, error) {
+	loopVar, err := p.ParseIdent()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(TokIn); err != nil {
+		return nil, err
+	}
+	lo, err := p.ParseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(TokDotDot); err != nil {
+		return nil, err
+	}
+	hi, err := p.ParseExpr()
+	if err != nil {
+		return nil, err
+	}
+	body, err := p.parseLoopBody(label)
+	if err != nil {
+		return nil, err
+	}
+	return &AstRangeFor{node: p.nodeAt(start), Label: label, Var: loopVar, Lo: lo, Hi: hi, Body: body}, nil
+}
+
+// parseLoopTarget parses the optional label after break or continue and
+// makes sure there is a loop for it to refer to
+func (p *Parser) parseLoopTarget(keyword string) (*AstIdent, error) {
+	if len(p.loops) == 0 {
+		return nil, p.parseErrorMsg(fmt.Sprintf("%s outside of a loop", keyword))
+	}
+	if !p.peekIs(TokIdent) {
+		return nil, nil
+	}
+	label, err := p.ParseIdent()
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range p.loops {
+		if l == label.Name {
+			return label, nil
+		}
+	}
+	lerr := nodeError(p.filename, label, "%s to unknown loop label %s", keyword, label.Name)
+	lerr.Code = CodeSyntax
+	return nil, lerr
+}
+
+func (p *Parser) ParseBreak() (*AstBreak, error) {
+	start := p.pos()
+	if err := p.expect(TokBreak); err != nil {
+		return nil, err
+	}
+	label, err := p.parseLoopTarget("break")
+	if err != nil {
+		return nil, err
+	}
+	return &AstBreak{node: p.nodeAt(start), Label: label}, nil
+}
+
+func (p *Parser) ParseContinue() (*AstContinue, error) {
+	start := p.pos()
+	if err := p.expect(TokContinue); err != nil {
+		return nil, err
+	}
+	label, err := p.parseLoopTarget("continue")
+	if err != nil {
+		return nil, err
+	}
+	return &AstContinue{node: p.nodeAt(start), Label: label}, nil
+}
+
+func (p *Parser) ParseReturn() (*AstReturn, error) {
+	start := p.pos()
+	if err := p.expect(TokReturn); err != nil {
+		return nil, err
+	}
+	if p.peekIs(TokSemi) {
+		return &AstReturn{node: p.nodeAt(start)}, nil
+	}
+	val, err := p.ParseExpr()
+	if err != nil {
+		return nil, err
+	}
+	return &AstReturn{node: p.nodeAt(start), Value: val}, nil
 }
 
 func (p *Parser) ParseParam() (*AstParam, error) {
+	start := p.pos()
 	text, err := p.ParseIdent()
 	if err != nil {
 		return nil, err
@@ -318,13 +889,14 @@ func (p *Parser) ParseParam() (*AstParam, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &AstParam{Name: text, Type: type_}, nil
+	return &AstParam{node: p.nodeAt(start), Name: text, Type: type_}, nil
 }
 
 func (p *Parser) ParseIdent() (*AstIdent, error) {
+	start := p.pos()
 	text, err := p.expectv(TokIdent)
 	if err != nil {
 		return nil, err
 	}
-	return &AstIdent{Name: text}, nil
+	return &AstIdent{node: p.nodeAt(start), Name: text}, nil
 }
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"strings"
 	"testing"
 )
 
@@ -56,7 +59,7 @@ func TestParseModuleWithConsts(t *testing.T) {
 func TestParseFailures(t *testing.T) {
 	badCases := []string{
 		"",
-		"module foo; let a = 12;",
+		"module foo; let a: = 12;",
 		"module foo; let a: int = ",
 	}
 	var p Parser
@@ -151,3 +154,463 @@ func TestParseVarRefs(t *testing.T) {
 		t.Fatal("wrong number of statements")
 	}
 }
+
+// exprString renders an expression fully parenthesised so tests can
+// check the shape of the tree
+func exprString(e AstExpr) string {
+	switch n := e.(type) {
+	case *AstBinaryExpr:
+		return fmt.Sprintf("(%s %s %s)", exprString(n.Left), cOperators[n.Op], exprString(n.Right))
+	case *AstUnaryExpr:
+		return fmt.Sprintf("(%s%s)", cOperators[n.Op], exprString(n.Expr))
+	case *AstIdent:
+		return n.Name
+	case *AstIntLitExpr:
+		return fmt.Sprintf("%d", n.Value)
+	case *AstStringLitExpr:
+		return fmt.Sprintf("%q", n.Value)
+	case *AstFnCall:
+		args := []string{}
+		for _, a := range n.Args {
+			args = append(args, exprString(a))
+		}
+		return fmt.Sprintf("%s(%s)", n.Name.Name, strings.Join(args, ", "))
+	}
+	return fmt.Sprintf("<%T>", e)
+}
+
+func TestParseExpr(t *testing.T) {
+	cases := []struct{ in, out string }{
+		{"a + b * 2", "(a + (b * 2))"},
+		{"a * b + 2", "((a * b) + 2)"},
+		{"a - b - c", "((a - b) - c)"},
+		{"a / b % c", "((a / b) % c)"},
+		{"(a + b) * 2", "((a + b) * 2)"},
+		{"-a * b", "((-a) * b)"},
+		{"!a && b", "((!a) && b)"},
+		{"- -a", "(-(-a))"},
+		{"a < b == c >= d", "((a < b) == (c >= d))"},
+		{"a || b && c", "(a || (b && c))"},
+		{"a != b || c <= d && e > f", "((a != b) || ((c <= d) && (e > f)))"},
+		{"f(a + 1, g(b)) * 3", "(f((a + 1), g(b)) * 3)"},
+		{`"str"`, `"str"`},
+	}
+	for _, tc := range cases {
+		p := NewParser(tc.in, "<filename>")
+		expr, err := p.ParseExpr()
+		if err != nil {
+			t.Errorf("parsing %#v: %v", tc.in, err)
+			continue
+		}
+		if got := exprString(expr); got != tc.out {
+			t.Errorf("parsing %#v: expected %s got %s", tc.in, tc.out, got)
+		}
+		if !p.peekIs(TokEof) {
+			t.Errorf("parsing %#v: trailing tokens", tc.in)
+		}
+	}
+}
+
+func TestParseExprFailures(t *testing.T) {
+	badCases := []string{
+		"a +",
+		"(a + b",
+		"* a",
+		"a + & b",
+	}
+	for _, in := range badCases {
+		p := NewParser(in, "<filename>")
+		_, err := p.ParseExpr()
+		if err == nil {
+			t.Errorf("expected failure parsing: %#v", in)
+		}
+	}
+}
+
+func TestParseIf(t *testing.T) {
+	txt := `
+		module test;
+
+		fn main(): int {
+			if a > 1 {
+				println("one");
+			}
+			if a == 1 {
+				println("one");
+			} else if a == 2 {
+				println("two");
+			} else {
+				println("many");
+			}
+		}
+	`
+	p := NewParser(txt, "<filename>")
+	mod, err := p.ParseModule()
+	if err != nil || mod == nil {
+		t.Fatalf("ERR: %v", err)
+	}
+	body := mod.Statements[0].(*AstFnDecl).Body.Body
+	if len(body) != 2 {
+		t.Fatalf("wrong number of statements: %d", len(body))
+	}
+	first := body[0].(*AstIf)
+	if exprString(first.Cond) != "(a > 1)" || first.Else != nil {
+		t.Errorf("bad if: %+v", first)
+	}
+	second := body[1].(*AstIf)
+	elseIf, ok := second.Else.(*AstIf)
+	if !ok {
+		t.Fatalf("expected else if, got %T", second.Else)
+	}
+	if exprString(elseIf.Cond) != "(a == 2)" {
+		t.Errorf("bad else if condition: %s", exprString(elseIf.Cond))
+	}
+	if _, ok := elseIf.Else.(*AstBlock); !ok {
+		t.Errorf("expected else block, got %T", elseIf.Else)
+	}
+}
+
+func TestParseIfFailures(t *testing.T) {
+	badCases := []string{
+		"module foo; fn main(): int { if { } }",
+		"module foo; fn main(): int { if a println(a); }",
+		"module foo; fn main(): int { if a { } else }",
+		"module foo; fn main(): int { if a { } else println(a); }",
+	}
+	for _, mod := range badCases {
+		p := NewParser(mod, "<filename>")
+		_, err := p.ParseModule()
+		if err == nil {
+			t.Errorf("expected failure parsing: %#v", mod)
+		}
+	}
+}
+
+func TestParseReturn(t *testing.T) {
+	txt := `
+		module test;
+
+		fn main(): int {
+			return 1 + 2;
+		}
+		fn nothing(): void {
+			return;
+		}
+	`
+	p := NewParser(txt, "<filename>")
+	mod, err := p.ParseModule()
+	if err != nil || mod == nil {
+		t.Fatalf("ERR: %v", err)
+	}
+	ret := mod.Statements[0].(*AstFnDecl).Body.Body[0].(*AstReturn)
+	if exprString(ret.Value) != "(1 + 2)" {
+		t.Errorf("bad return value: %s", exprString(ret.Value))
+	}
+	ret = mod.Statements[1].(*AstFnDecl).Body.Body[0].(*AstReturn)
+	if ret.Value != nil {
+		t.Errorf("expected bare return, got %s", exprString(ret.Value))
+	}
+}
+
+func TestParseLoops(t *testing.T) {
+	txt := `
+		module test;
+
+		fn main(): int {
+			while a < 10 {
+				break;
+			}
+			for let i: int = 0; i < 10; step() {
+				continue;
+			}
+			for ;; {}
+			outer: for x in 0..n + 1 {
+				inner: while 1 {
+					break outer;
+					continue inner;
+				}
+			}
+		}
+	`
+	p := NewParser(txt, "<filename>")
+	mod, err := p.ParseModule()
+	if err != nil || mod == nil {
+		t.Fatalf("ERR: %v", err)
+	}
+	body := mod.Statements[0].(*AstFnDecl).Body.Body
+	if len(body) != 4 {
+		t.Fatalf("wrong number of statements: %d", len(body))
+	}
+	while := body[0].(*AstWhile)
+	if exprString(while.Cond) != "(a < 10)" || while.Label != nil {
+		t.Errorf("bad while: %+v", while)
+	}
+	if _, ok := while.Body.Body[0].(*AstBreak); !ok {
+		t.Errorf("expected break, got %T", while.Body.Body[0])
+	}
+	cfor := body[1].(*AstFor)
+	if cfor.Init == nil || cfor.Cond == nil || cfor.Step == nil {
+		t.Errorf("bad for: %+v", cfor)
+	}
+	empty := body[2].(*AstFor)
+	if empty.Init != nil || empty.Cond != nil || empty.Step != nil {
+		t.Errorf("expected empty for clauses: %+v", empty)
+	}
+	rfor := body[3].(*AstRangeFor)
+	if rfor.Label.Name != "outer" || rfor.Var.Name != "x" || exprString(rfor.Lo) != "0" || exprString(rfor.Hi) != "(n + 1)" {
+		t.Errorf("bad range for: %+v", rfor)
+	}
+	inner := rfor.Body.Body[0].(*AstWhile)
+	if inner.Label.Name != "inner" {
+		t.Errorf("bad inner label: %+v", inner.Label)
+	}
+	if brk := inner.Body.Body[0].(*AstBreak); brk.Label.Name != "outer" {
+		t.Errorf("bad break label: %+v", brk.Label)
+	}
+	if cont := inner.Body.Body[1].(*AstContinue); cont.Label.Name != "inner" {
+		t.Errorf("bad continue label: %+v", cont.Label)
+	}
+}
+
+func TestParseLoopFailures(t *testing.T) {
+	badCases := []string{
+		"module foo; fn main(): int { break; }",
+		"module foo; fn main(): int { continue; }",
+		"module foo; fn main(): int { while 1 { break nope; } }",
+		"module foo; fn main(): int { a: while 1 { a: while 1 {} } }",
+		"module foo; fn main(): int { a: println(1); }",
+		"module foo; fn main(): int { while 1 { fn f(): void { break; } } }",
+		"module foo; fn main(): int { for x in 0 { } }",
+		"module foo; fn main(): int { for x; 1 { } }",
+	}
+	for _, mod := range badCases {
+		p := NewParser(mod, "<filename>")
+		_, err := p.ParseModule()
+		if err == nil {
+			t.Errorf("expected failure parsing: %#v", mod)
+		}
+	}
+}
+
+func TestParseAssign(t *testing.T) {
+	txt := `
+		module test;
+
+		var counter: int = 0;
+
+		fn main(): int {
+			var x: int = 1;
+			x = x + 1;
+			x += 2;
+			x -= 3;
+			x *= 4;
+			x /= 5;
+			x %= 6;
+			counter += x;
+			for var i: int = 0; i < 10; i += 1 {}
+		}
+	`
+	p := NewParser(txt, "<filename>")
+	mod, err := p.ParseModule()
+	if err != nil || mod == nil {
+		t.Fatalf("ERR: %v", err)
+	}
+	if _, ok := mod.Statements[0].(*AstVarDecl); !ok {
+		t.Errorf("expected var decl, got %T", mod.Statements[0])
+	}
+	body := mod.Statements[1].(*AstFnDecl).Body.Body
+	ops := []TokenKind{TokAssign, TokPlusAssign, TokMinusAssign, TokStarAssign, TokDivAssign, TokPercentAssign}
+	for i, op := range ops {
+		assign := body[i+1].(*AstAssign)
+		if assign.Target.Name != "x" || assign.Op != op {
+			t.Errorf("bad assignment %d: %+v", i, assign)
+		}
+	}
+	loop := body[8].(*AstFor)
+	if _, ok := loop.Init.(*AstVarDecl); !ok {
+		t.Errorf("expected var decl in for init, got %T", loop.Init)
+	}
+	if _, ok := loop.Step.(*AstAssign); !ok {
+		t.Errorf("expected assignment in for step, got %T", loop.Step)
+	}
+}
+
+func TestParseInferredDecls(t *testing.T) {
+	txt := `
+		module test;
+
+		let a = 12;
+		var b = "str";
+		let c: int = 1;
+	`
+	p := NewParser(txt, "<filename>")
+	mod, err := p.ParseModule()
+	if err != nil || mod == nil {
+		t.Fatalf("ERR: %v", err)
+	}
+	if a := mod.Statements[0].(*AstConstAssign); a.Type != nil {
+		t.Errorf("expected no type for a, got %+v", a.Type)
+	}
+	if b := mod.Statements[1].(*AstVarDecl); b.Type != nil {
+		t.Errorf("expected no type for b, got %+v", b.Type)
+	}
+	if c := mod.Statements[2].(*AstConstAssign); c.Type == nil || c.Type.Name.Name != "int" {
+		t.Errorf("expected int type for c, got %+v", c.Type)
+	}
+}
+
+func TestParseLexerErrors(t *testing.T) {
+	cases := []struct{ src, msg string }{
+		{"module foo; let a: int = 1 # 2;", "<filename>:1:28  unexpected character '#'"},
+		{"module foo; let a: int = 12ab;", "<filename>:1:26  invalid number literal 12ab"},
+		{"module foo;\nlet a: string = \"abc;\n", "<filename>:2:17  unterminated string literal"},
+		{"module foo; let a: bool = b & c;", "<filename>:1:29  unexpected character '&', did you mean '&&'?"},
+	}
+	for _, tc := range cases {
+		p := NewParser(tc.src, "<filename>")
+		_, err := p.ParseModule()
+		if err == nil {
+			t.Errorf("expected failure parsing: %#v", tc.src)
+		} else if err.Error() != tc.msg {
+			t.Errorf("parsing %#v: expected %q got %q", tc.src, tc.msg, err.Error())
+		}
+	}
+}
+
+func TestParseLexerErrorWording(t *testing.T) {
+	// The lexer's message is used whatever the parser was expecting
+	cases := []struct{ src, msg string }{
+		{"module foo $", "unexpected character '$'"},
+		{"module foo; fn f(a: int | b: int): void {}", "unexpected character '|', did you mean '||'?"},
+		{"module foo; let a = 1;\n\"abc", "unterminated string literal"},
+	}
+	for _, tc := range cases {
+		p := NewParser(tc.src, "<filename>")
+		_, err := p.ParseModule()
+		var perr ParseError
+		if !errors.As(err, &perr) || perr.Msg != tc.msg || perr.Code != CodeLex {
+			t.Errorf("parsing %#v: expected %s %q, got %v", tc.src, CodeLex, tc.msg, err)
+		}
+	}
+	if s := TokErr.String(); s != "invalid token" {
+		t.Errorf("expected TokErr to be an invalid token, got %q", s)
+	}
+}
+
+func TestParseRecovery(t *testing.T) {
+	txt := `module test;
+let a: int = ;
+let b: int = 2
+let c: int = 3;
+fn main(): int {
+	let x: int = 1 +;
+	println(x);
+	if x > { println(x); }
+	while x { break }
+	return x;
+}
+}
+fn other(): void {
+	let y: = 1;
+}
+let d: int = 4;
+`
+	p := NewParser(txt, "<filename>")
+	mod, err := p.ParseModule()
+	if err == nil {
+		t.Fatal("expected errors")
+	}
+	want := []string{
+		"<filename>:2:14  unexpected ';'",
+		"<filename>:4:1  expected ';', found 'let'",
+		"<filename>:6:18  unexpected ';'",
+		"<filename>:8:9  unexpected '{'",
+		"<filename>:9:18  expected ';', found '}'",
+		"<filename>:12:1  unexpected '}'",
+		"<filename>:14:9  expected identifier, found '='",
+	}
+	got := []string{}
+	for _, e := range p.Errors() {
+		got = append(got, e.Error())
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("expected errors:\n%s\ngot:\n%s", strings.Join(want, "\n"), strings.Join(got, "\n"))
+	}
+	if err.Error() != strings.Join(got, "\n") {
+		t.Errorf("expected the returned error to hold every error, got %q", err)
+	}
+
+	if mod == nil {
+		t.Fatal("expected a partial module")
+	}
+	names := []string{}
+	for _, st := range mod.Statements {
+		switch n := st.(type) {
+		case *AstConstAssign:
+			names = append(names, n.Ident.Name)
+		case *AstFnDecl:
+			names = append(names, n.Name.Name)
+		}
+	}
+	if got, want := strings.Join(names, " "), "b c main other d"; got != want {
+		t.Errorf("expected statements %q got %q", want, got)
+	}
+	main := mod.Statements[2].(*AstFnDecl)
+	if len(main.Body.Body) != 3 {
+		t.Errorf("expected the 3 good statements in main, got %d", len(main.Body.Body))
+	}
+}
+
+func TestParseSpans(t *testing.T) {
+	txt := `module test;
+let a: int = 1 + f(2, 3);
+fn main(): int {
+	outer: while a < 3 {
+		break outer;
+	}
+	if a > 1 { return 1; } else { return 2; }
+	return 0;
+}
+`
+	p := NewParser(txt, "<filename>")
+	mod, err := p.ParseModule()
+	if err != nil {
+		t.Fatalf("ERR: %v", err)
+	}
+	decl := mod.Statements[0].(*AstConstAssign)
+	fn := mod.Statements[1].(*AstFnDecl)
+	loop := fn.Body.Body[0].(*AstWhile)
+	ifst := fn.Body.Body[1].(*AstIf)
+	sum := decl.Value.(*AstBinaryExpr)
+	cases := []struct {
+		n    Node
+		text string
+	}{
+		{mod.Name, "test"},
+		{decl, "let a: int = 1 + f(2, 3)"},
+		{decl.Ident, "a"},
+		{decl.Type, "int"},
+		{sum, "1 + f(2, 3)"},
+		{sum.Right, "f(2, 3)"},
+		{sum.Right.(*AstFnCall).Args[1], "3"},
+		{fn.Name, "main"},
+		{fn.ReturnType, "int"},
+		{loop, "outer: while a < 3 {\n\t\tbreak outer;\n\t}"},
+		{loop.Cond, "a < 3"},
+		{loop.Body.Body[0], "break outer"},
+		{ifst, "if a > 1 { return 1; } else { return 2; }"},
+		{ifst.Else, "{ return 2; }"},
+		{fn.Body.Body[2], "return 0"},
+	}
+	for _, tc := range cases {
+		if got := SourceText(txt, tc.n); got != tc.text {
+			t.Errorf("expected %T to span %q got %q", tc.n, tc.text, got)
+		}
+	}
+
+	span := fn.Name.Span()
+	want := Span{Pos{3, 4, 42}, Pos{3, 8, 46}}
+	if span != want {
+		t.Errorf("expected span %#v for main, got %#v", want, span)
+	}
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"math"
+	"slices"
+	"strings"
+)
+
+// Pass is an optimisation of the IR, they all work on functions in SSA
+// form and leave them in it
+type Pass struct {
+	Name string
+	Help string
+	Run  func(m *IrModule)
+}
+
+// Passes are all the passes that can be chosen with --passes
+var Passes = []*Pass{
+	{Name: "inline", Help: "copy small functions into the places they're called", Run: inlineCalls},
+	{Name: "constprop", Help: "work out operations on constants, and use the values copies copy", Run: eachFunc(constProp)},
+	{Name: "cse", Help: "reuse values that have already been worked out", Run: eachFunc(commonSubexprs)},
+	{Name: "dce", Help: "remove code whose results aren't used and blocks that are never run", Run: eachFunc(deadCode)},
+}
+
+// optPasses are the passes each -O level runs, the C compiler is given the
+// same level. -Os doesn't inline, which makes code bigger.
+var optPasses = map[string][]string{
+	"0": nil,
+	"1": {"constprop", "dce"},
+	"2": {"inline", "constprop", "cse", "dce"},
+	"3": {"inline", "constprop", "cse", "dce"},
+	"s": {"constprop", "cse", "dce"},
+}
+
+// LookupPasses finds the passes in a comma separated list of names
+func LookupPasses(list string) ([]*Pass, error) {
+	passes := []*Pass{}
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		i := slices.IndexFunc(Passes, func(p *Pass) bool { return p.Name == name })
+		if i < 0 {
+			names := []string{}
+			for _, p := range Passes {
+				names = append(names, p.Name)
+			}
+			return nil, fmt.Errorf("unknown pass %q, expected one of %s", name, strings.Join(names, ", "))
+		}
+		passes = append(passes, Passes[i])
+	}
+	return passes, nil
+}
+
+// OptPasses are the passes for an -O level
+func OptPasses(level string) []*Pass {
+	passes, _ := LookupPasses(strings.Join(optPasses[level], ","))
+	return passes
+}
+
+// funcs are all the functions in a module, init included
+func (m *IrModule) funcs() []*IrFunc {
+	if m.Init != nil {
+		return append(slices.Clone(m.Funcs), m.Init)
+	}
+	return m.Funcs
+}
+
+func eachFunc(run func(f *IrFunc)) func(m *IrModule) {
+	return func(m *IrModule) {
+		for _, f := range m.funcs() {
+			run(f)
+		}
+	}
+}
+
+// Optimise puts every function in the module into SSA form and runs the
+// passes over it in order. after is called after each pass, if it isn't
+// nil. It's an error for a pass to leave a function badly formed.
+func Optimise(m *IrModule, passes []*Pass, after func(p *Pass)) error {
+	for _, f := range m.funcs() {
+		ToSSA(f)
+	}
+	for _, p := range passes {
+		p.Run(m)
+		for _, f := range m.funcs() {
+			tidy(f)
+			if err := VerifyIR(f, true); err != nil {
+				return fmt.Errorf("internal error after the %s pass: %v", p.Name, err)
+			}
+		}
+		if after != nil {
+			after(p)
+		}
+	}
+	return nil
+}
+
+// pure reports if an instruction only works out its result, so it can be
+// removed when that isn't used. Division can fail, so it only counts when
+// dividing by a constant that can't make it.
+func pure(in *IrInstr) bool {
+	switch in.Op {
+	case IrCopy, IrPhi, IrNeg, IrNot, IrAdd, IrSub, IrMul, IrEq, IrNe, IrLt, IrLe, IrGt, IrGe:
+		return true
+	case IrDiv, IrMod:
+		c, ok := in.Args[1].(*IrConst)
+		return ok && c.Int != 0 && c.Int != -1
+	}
+	return false
+}
+
+// foldConst works out an operation on constants. It isn't done for
+// division by 0, or of the smallest int by -1, which fail when they're
+// run.
+func foldConst(op IrOp, args []*IrConst) (*IrConst, bool) {
+	for _, a := range args {
+		if a.Type == TypString {
+			return nil, false
+		}
+	}
+	wrap := func(n int) *IrConst {
+		return IntConst(int(int32(n)))
+	}
+	if op == IrNeg {
+		return wrap(-args[0].Int), true
+	}
+	if op == IrNot {
+		return BoolConst(args[0].Int == 0), true
+	}
+	a, b := args[0].Int, args[1].Int
+	switch op {
+	case IrAdd:
+		return wrap(a + b), true
+	case IrSub:
+		return wrap(a - b), true
+	case IrMul:
+		return wrap(a * b), true
+	case IrDiv, IrMod:
+		if b == 0 || (a == math.MinInt32 && b == -1) {
+			return nil, false
+		}
+		if op == IrDiv {
+			return wrap(a / b), true
+		}
+		return wrap(a % b), true
+	case IrEq:
+		return BoolConst(a == b), true
+	case IrNe:
+		return BoolConst(a != b), true
+	case IrLt:
+		return BoolConst(a < b), true
+	case IrLe:
+		return BoolConst(a <= b), true
+	case IrGt:
+		return BoolConst(a > b), true
+	case IrGe:
+		return BoolConst(a >= b), true
+	}
+	return nil, false
+}
+
+// constProp replaces variables with the constants they hold, and copies
+// and phis that don't choose between anything with what they copy. It
+// keeps going until there's nothing more to work out, then branches on
+// constants become jumps and any blocks that can't be reached go.
+func constProp(f *IrFunc) {
+	for {
+		repl := map[*IrVar]IrValue{}
+		for _, b := range f.Blocks {
+			for _, in := range b.Instrs {
+				dst, ok := renamed(in.Dst)
+				if !ok {
+					continue
+				}
+				if v := knownValue(in); v != nil {
+					repl[dst] = v
+				}
+			}
+		}
+		if len(repl) == 0 {
+			break
+		}
+		replaceUses(f, repl)
+		for _, b := range f.Blocks {
+			b.Instrs = slices.DeleteFunc(b.Instrs, func(in *IrInstr) bool {
+				v, ok := renamed(in.Dst)
+				return ok && repl[v] != nil
+			})
+		}
+	}
+
+	folded := false
+	for _, b := range f.Blocks {
+		br := b.Terminator()
+		if br.Op != IrBr {
+			continue
+		}
+		c, ok := br.Args[0].(*IrConst)
+		if !ok {
+			continue
+		}
+		to, skip := br.Targets[0], br.Targets[1]
+		if c.Int == 0 {
+			to, skip = skip, to
+		}
+		b.Instrs[len(b.Instrs)-1] = &IrInstr{Op: IrJmp, Targets: []*IrBlock{to}}
+		if to != skip {
+			removeEdge(b, skip)
+		}
+		folded = true
+	}
+	if folded {
+		removeUnreachable(f)
+		// Phis may have been left with one value, or only constants
+		constProp(f)
+	}
+}
+
+// knownValue is the value an instruction always gives without being run,
+// nil if it has to be run
+func knownValue(in *IrInstr) IrValue {
+	switch in.Op {
+	case IrCopy:
+		if _, ok := in.Args[0].(*IrConst); ok {
+			return in.Args[0]
+		}
+		if v, ok := renamed(in.Args[0]); ok {
+			return v
+		}
+	case IrPhi:
+		// A phi that only has one value apart from itself is that value
+		var only IrValue
+		for _, a := range in.Args {
+			if a == IrValue(in.Dst) || sameValue(a, only) {
+				continue
+			}
+			if only != nil {
+				return nil
+			}
+			only = a
+		}
+		return only
+	case IrNeg, IrNot, IrAdd, IrSub, IrMul, IrDiv, IrMod, IrEq, IrNe, IrLt, IrLe, IrGt, IrGe:
+		consts := []*IrConst{}
+		for _, a := range in.Args {
+			c, ok := a.(*IrConst)
+			if !ok {
+				return nil
+			}
+			consts = append(consts, c)
+		}
+		if c, ok := foldConst(in.Op, consts); ok {
+			return c
+		}
+	}
+	return nil
+}
+
+// sameValue reports if a and b are the same variable or equal constants
+func sameValue(a, b IrValue) bool {
+	if a == b {
+		return true
+	}
+	ca, ok1 := a.(*IrConst)
+	cb, ok2 := b.(*IrConst)
+	return ok1 && ok2 && *ca == *cb
+}
+
+// deadCode removes pure instructions whose results aren't needed by
+// anything that has to be run: calls, stores to globals and terminators.
+// Calls to void functions or builtins keep running, but their results
+// are dropped when they aren't used. Blocks that only jump on to a block
+// that nothing else goes to are joined to it.
+func deadCode(f *IrFunc) {
+	removeUnreachable(f)
+	def := map[*IrVar]*IrInstr{}
+	for _, b := range f.Blocks {
+		for _, in := range b.Instrs {
+			if v, ok := renamed(in.Dst); ok {
+				def[v] = in
+			}
+		}
+	}
+	live := map[*IrInstr]bool{}
+	work := []*IrInstr{}
+	for _, b := range f.Blocks {
+		for _, in := range b.Instrs {
+			if _, local := renamed(in.Dst); !pure(in) || (in.Dst != nil && !local) {
+				live[in] = true
+				work = append(work, in)
+			}
+		}
+	}
+	for len(work) > 0 {
+		in := work[len(work)-1]
+		work = work[:len(work)-1]
+		for _, a := range in.Args {
+			if v, ok := renamed(a); ok && def[v] != nil && !live[def[v]] {
+				live[def[v]] = true
+				work = append(work, def[v])
+			}
+		}
+	}
+	used := map[*IrVar]bool{}
+	for _, b := range f.Blocks {
+		b.Instrs = slices.DeleteFunc(b.Instrs, func(in *IrInstr) bool { return !live[in] })
+		for _, in := range b.Instrs {
+			for _, a := range in.Args {
+				if v, ok := a.(*IrVar); ok {
+					used[v] = true
+				}
+			}
+		}
+	}
+	for _, b := range f.Blocks {
+		for _, in := range b.Instrs {
+			if (in.Op == IrCall || in.Op == IrBuiltin) && in.Dst != nil && in.Dst.Kind != IrGlobal && !used[in.Dst] {
+				in.Dst = nil
+			}
+		}
+	}
+	mergeBlocks(f)
+}
+
+// mergeBlocks joins a block that ends by jumping to another onto the
+// front of it, when nothing else goes there
+func mergeBlocks(f *IrFunc) {
+	preds := predecessors(f)
+	for i := 0; i < len(f.Blocks); i++ {
+		b := f.Blocks[i]
+		for {
+			jmp := b.Terminator()
+			if jmp.Op != IrJmp {
+				break
+			}
+			next := jmp.Targets[0]
+			if next == b || next == f.Blocks[0] || len(preds[next]) != 1 {
+				break
+			}
+			// With one way in, phis have one value
+			repl := map[*IrVar]IrValue{}
+			for _, phi := range phis(next) {
+				repl[phi.Dst] = phi.Args[0]
+			}
+			rest := next.Instrs[len(phis(next)):]
+			b.Instrs = append(b.Instrs[:len(b.Instrs)-1], rest...)
+			for _, s := range next.Succs() {
+				preds[s] = slices.Replace(preds[s], slices.Index(preds[s], next), slices.Index(preds[s], next)+1, b)
+				for _, phi := range phis(s) {
+					for j, p := range phi.Preds {
+						if p == next {
+							phi.Preds[j] = b
+						}
+					}
+				}
+			}
+			f.Blocks = slices.DeleteFunc(f.Blocks, func(x *IrBlock) bool { return x == next })
+			replaceUses(f, repl)
+		}
+		i = slices.Index(f.Blocks, b)
+	}
+}
+
+// commonSubexprs finds pure operations that are worked out again with the
+// same arguments in a block the first one dominates, and reuses the first
+// result instead
+func commonSubexprs(f *IrFunc) {
+	preds := predecessors(f)
+	dom := dominators(f, preds)
+	repl := map[*IrVar]IrValue{}
+	var walk func(b *IrBlock, avail map[string]*IrVar)
+	walk = func(b *IrBlock, avail map[string]*IrVar) {
+		avail = maps.Clone(avail)
+		b.Instrs = slices.DeleteFunc(b.Instrs, func(in *IrInstr) bool {
+			for i, a := range in.Args {
+				if v, ok := a.(*IrVar); ok && repl[v] != nil {
+					in.Args[i] = repl[v]
+				}
+			}
+			// Copies don't work anything out, and phis depend on where
+			// they are as well as their args
+			dst, ok := renamed(in.Dst)
+			if !ok || !pure(in) || in.Op == IrPhi || in.Op == IrCopy {
+				return false
+			}
+			key := exprKey(in)
+			if prev, ok := avail[key]; ok {
+				repl[dst] = prev
+				return true
+			}
+			avail[key] = dst
+			return false
+		})
+		for _, c := range dom.children[b] {
+			walk(c, avail)
+		}
+	}
+	walk(f.Blocks[0], map[string]*IrVar{})
+	// Phis can use values from blocks that come after them
+	replaceUses(f, repl)
+}
+
+// exprKey is the same for instructions that work out the same value, the
+// arguments of commutative operations are sorted
+func exprKey(in *IrInstr) string {
+	args := []string{}
+	for _, a := range in.Args {
+		// Constants of different types can look the same
+		args = append(args, a.String()+":"+a.ValueType().String())
+	}
+	switch in.Op {
+	case IrAdd, IrMul, IrEq, IrNe:
+		slices.Sort(args)
+	}
+	return in.Op.String() + " " + strings.Join(args, ", ")
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files with what the tests get")
+
+// TestPasses runs each pass over the IR in testdata/passes/<pass>/*.ir
+// and compares the result with the .golden file next to it. The IR is
+// put into SSA form first, and the ssa directory tests only that.
+func TestPasses(t *testing.T) {
+	files, err := filepath.Glob("testdata/passes/*/*.ir")
+	if err != nil || len(files) == 0 {
+		t.Fatalf("no test files: %v", err)
+	}
+	for _, file := range files {
+		src, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := ParseIR(string(src))
+		if err != nil {
+			t.Errorf("%s: %v", file, err)
+			continue
+		}
+		name := filepath.Base(filepath.Dir(file))
+		if name == "ssa" {
+			for _, f := range m.funcs() {
+				ToSSA(f)
+				if err := VerifyIR(f, true); err != nil {
+					t.Errorf("%s: %v", file, err)
+				}
+			}
+		} else {
+			passes, err := LookupPasses(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := Optimise(m, passes, nil); err != nil {
+				t.Errorf("%s: %v", file, err)
+				continue
+			}
+		}
+		got := strings.Builder{}
+		WriteIR(&got, m)
+		golden := strings.TrimSuffix(file, ".ir") + ".golden"
+		if *update {
+			if err := os.WriteFile(golden, []byte(got.String()), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		want, err := os.ReadFile(golden)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.String() != string(want) {
+			t.Errorf("%s: expected\n%s\ngot\n%s", file, want, got.String())
+		}
+	}
+}
+
+func TestParseIR(t *testing.T) {
+	src := `module m
+
+global @g: string
+global @n: int = -3
+const @greeting: string = "hi there"
+
+func f(a: int, s: string): int {
+entry:
+  %0: int = add a, -1
+  @g: string = copy "a \"quoted\"\tstring\n\001"
+  br true, loop, done
+loop:
+  x: int = phi [%0, entry], [x.1, loop]
+  x.1: int = call f(x, s)
+  builtin printf("%d\n", x.1)
+  jmp loop
+done:
+  ret %0
+}
+`
+	m, err := ParseIR(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Builder{}
+	WriteIR(&got, m)
+	if got.String() != src {
+		t.Errorf("expected\n%s\ngot\n%s", src, got.String())
+	}
+}
+
+func TestParseIRErrors(t *testing.T) {
+	tests := []struct {
+		src string
+		err string
+	}{
+		{"module m\nfoo", "line 2: expected module, global or func"},
+		{"global @n: int = 1 2", "line 1: expected global @name: type [= value]"},
+		{"const @n: int = \"one\"", "line 1: expected a constant of type int for @n"},
+		{"func f(): int {\nentry:\n  ret 0\n", "line 4: expected } at the end of f"},
+		{"func f(): number {\n}", "line 1: unknown type number"},
+		{"func f(): int {\n  ret 0\n}", "line 2: expected a label"},
+		{"func f(): int {\nentry:\n  ret x\n}", "line 3: unknown variable x"},
+		{"func f(): int {\nentry:\n  jmp nowhere\n}", "line 3: unknown label nowhere"},
+		{"func f(): int {\nentry:\n  %0: int = frob 1\n  ret %0\n}", "line 3: unknown instruction frob"},
+		{"func f(): int {\nentry:\n  %0: int = add 1, 2\n}", "line 4: f entry: %0: int = add 1, 2 isn't where a block ends"},
+		{"func f(): int {\nentry:\n}", "line 3: f entry: empty block"},
+		{"func f(): int {\nentry:\n  br true, if.then.1, if.done.1\nif.then.1:\n  x: bool = br if.then.1, if.done.1\nif.done.1:\n  ret 0\n}", "line 8: f if.then.1: x: bool = br if.then.1, if.done.1 has the wrong number of values"},
+		{"func f(): int {\nentry:\n  %0: int = add 1\n  ret %0\n}", "line 5: f entry: %0: int = add 1 has the wrong number of values"},
+		{"func f(): int {\nentry:\n  neg 1\n  ret 0\n}", "line 5: f entry: neg 1 should set a variable"},
+		{"func f(): int {\nentry:\n  ret 0, 1\n}", "line 4: f entry: ret 0, 1 has the wrong number of values"},
+		{"func f(): int {\nentry:\n  %0: int = ret 0\n}", "line 4: f entry: %0: int = ret 0 can't set a variable"},
+		{"func f(): int {\nentry:\n  jmp\n}", "line 3: expected jmp labels"},
+		{"func f(): int {\nentry:\n  builtin puts(\"hi)\n  ret 0\n}", "line 3: unterminated string"},
+	}
+	for _, tc := range tests {
+		_, err := ParseIR(tc.src)
+		if err == nil || err.Error() != tc.err {
+			t.Errorf("parsing %q: expected error %q, got %v", tc.src, tc.err, err)
+		}
+	}
+}
+
+func TestLookupPasses(t *testing.T) {
+	passes, err := LookupPasses("constprop, dce,,cse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, p := range passes {
+		names = append(names, p.Name)
+	}
+	if got := strings.Join(names, ","); got != "constprop,dce,cse" {
+		t.Errorf("expected constprop,dce,cse, got %s", got)
+	}
+	_, err = LookupPasses("dce,fast")
+	if err == nil || err.Error() != `unknown pass "fast", expected one of inline, constprop, cse, dce` {
+		t.Errorf("expected an unknown pass error, got %v", err)
+	}
+	for level := range optLevels {
+		if _, ok := optPasses[level]; !ok {
+			t.Errorf("-O%s has no passes", level)
+		}
+	}
+}
+
+// TestOptimisedBackendCases checks that optimising doesn't change what
+// programs do
+func TestOptimisedBackendCases(t *testing.T) {
+	if _, err := exec.LookPath("cc"); err != nil {
+		t.Skip("no cc")
+	}
+	for _, tc := range backendCases {
+		src := backendPrelude + "fn main(): int {\n" + tc.body + "\n}\n"
+		for _, flags := range [][]string{{"-O1"}, {"-O2"}, {"--passes=inline,inline,cse,constprop,dce"}} {
+			out, code := buildAndRun(t, src, "c", flags...)
+			if out != tc.out || code != tc.code {
+				t.Errorf("running %q with %v: expected %q and status %d, got %q and %d", tc.body, flags, tc.out, tc.code, out, code)
+			}
+		}
+	}
+}
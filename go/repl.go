@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"strings"
+)
+
+// replFilename is what errors in REPL entries are reported against, the
+// positions in them are relative to the entry
+const replFilename = "<repl>"
+
+// Repl evaluates declarations, statements and expressions one entry at a
+// time. Declarations go into a module that lasts for the whole session, so
+// later entries can use them. Each entry is resolved, checked and then run
+// by the interpreter before the next is read.
+type Repl struct {
+	out   io.Writer
+	diags DiagnosticOutput
+	// Only set for text diagnostics, which need the source of the entry
+	printer *DiagnosticPrinter
+	// Whether to prompt for input, there's no point when it isn't a terminal
+	Prompt bool
+
+	// The declarations so far, and the source of each for :defs
+	mod  *AstModule
+	defs map[AstStatement]string
+
+	res *resolver
+	chk *checker
+	in  *interpreter
+}
+
+// NewRepl makes a REPL that writes results to out and reports problems
+// to diags. printer should be diags if it is a DiagnosticPrinter.
+func NewRepl(out io.Writer, diags DiagnosticOutput, printer *DiagnosticPrinter) *Repl {
+	mod := &AstModule{Name: &AstIdent{Name: "repl"}, Filename: replFilename}
+	res := newResolver(mod)
+	return &Repl{
+		out:     out,
+		diags:   diags,
+		printer: printer,
+		mod:     mod,
+		defs:    map[AstStatement]string{},
+		res:     res,
+		chk:     newChecker(mod, res.res),
+		in:      newInterpreter(mod, res.res, out),
+	}
+}
+
+const replHelp = `Enter declarations, statements or expressions, the value of an
+expression is printed. Entries carry on over more lines until their
+braces are balanced. Declaring a name again replaces it.
+
+  :defs   list the declarations so far
+  :help   show this help
+  :quit   leave, as does end of file
+`
+
+// Run reads and evaluates entries from r until it runs out or :quit is
+// entered. Problems with an entry are reported and the session carries on.
+func (repl *Repl) Run(r io.Reader) error {
+	sc := bufio.NewScanner(r)
+	entry := ""
+	repl.prompt("> ")
+	for sc.Scan() {
+		line := sc.Text()
+		if entry == "" {
+			switch strings.TrimSpace(line) {
+			case ":quit", ":q":
+				return nil
+			case ":help":
+				fmt.Fprint(repl.out, replHelp)
+				repl.prompt("> ")
+				continue
+			case ":defs":
+				repl.printDefs()
+				repl.prompt("> ")
+				continue
+			}
+		}
+		entry += line + "\n"
+		if braceDepth(entry) > 0 {
+			repl.prompt("... ")
+			continue
+		}
+		if err := repl.Eval(entry); err != nil {
+			for _, diag := range Diagnostics(err, SevError) {
+				repl.diags.Print(diag)
+			}
+		}
+		entry = ""
+		repl.prompt("> ")
+	}
+	return sc.Err()
+}
+
+func (repl *Repl) prompt(s string) {
+	if repl.Prompt {
+		fmt.Fprint(repl.out, s)
+	}
+}
+
+func (repl *Repl) printDefs() {
+	for _, st := range repl.mod.Statements {
+		fmt.Fprintln(repl.out, repl.defs[st])
+	}
+}
+
+// braceDepth is how many of the braces in src are still open, it's more
+// than zero while an entry is unfinished
+func braceDepth(src string) int {
+	depth := 0
+	lex := NewLexer(src)
+	for tok := lex.Next(); tok.Kind != TokEof; tok = lex.Next() {
+		switch tok.Kind {
+		case TokLbrace:
+			depth++
+		case TokRbrace:
+			depth--
+		}
+	}
+	return depth
+}
+
+// Eval evaluates one entry: statements, which are run in order, and then
+// optionally an expression whose value is printed. The trailing semicolon
+// can be left off.
+func (repl *Repl) Eval(src string) error {
+	if repl.printer != nil {
+		repl.printer.Sources[replFilename] = src
+	}
+	p := NewParser(src, replFilename)
+	stmts := []AstStatement{}
+	var expr AstExpr
+	for !p.peekIs(TokEof) {
+		if isExprEntry(&p) {
+			e, err := p.ParseExpr()
+			if err != nil {
+				return err
+			}
+			// A call with more after it is a statement after all
+			if call, ok := e.(*AstFnCall); ok && p.peekIs(TokSemi) && !p.nextIs(TokEof) {
+				p.nextToken()
+				stmts = append(stmts, call)
+				continue
+			}
+			if err := endEntry(&p); err != nil {
+				return err
+			}
+			expr = e
+			break
+		}
+		st, err := p.ParseStatement()
+		if err != nil {
+			return err
+		}
+		// Errors in blocks are recovered from, so the rest of the block
+		// can be parsed
+		if errs := p.Errors(); len(errs) > 0 {
+			return errors.Join(errs...)
+		}
+		// Only the last statement can leave off its semicolon
+		if needsSemi(st) && !p.peekIs(TokEof) {
+			if err := p.expect(TokSemi); err != nil {
+				return err
+			}
+		}
+		stmts = append(stmts, st)
+	}
+	for _, st := range stmts {
+		if err := repl.exec(src, st); err != nil {
+			return err
+		}
+	}
+	if expr != nil {
+		return repl.evalExpr(expr)
+	}
+	return nil
+}
+
+// isExprEntry reports if the rest of an entry is an expression rather
+// than statements. A function call could be either, it's taken as an
+// expression so the result is shown.
+func isExprEntry(p *Parser) bool {
+	switch {
+	case statementStarts[p.peek()]:
+		return false
+	case p.peekIs(TokIdent):
+		return !p.nextIs(TokColon) && !assignOps[p.nextTok.Kind]
+	}
+	return true
+}
+
+// endEntry checks that an expression is the end of the entry, apart from
+// an optional semicolon
+func endEntry(p *Parser) error {
+	if p.peekIs(TokSemi) && p.nextIs(TokEof) {
+		p.nextToken()
+	}
+	if !p.peekIs(TokEof) {
+		return p.parseErrorExp(TokSemi)
+	}
+	return nil
+}
+
+func (repl *Repl) evalExpr(e AstExpr) error {
+	repl.res.errs = nil
+	repl.res.expr(e)
+	if err := errors.Join(repl.res.errs...); err != nil {
+		return err
+	}
+	repl.chk.errs = nil
+	t := repl.chk.expr(e)
+	e = repl.chk.fold(e)
+	if err := errors.Join(repl.chk.errs...); err != nil {
+		return err
+	}
+	v, err := repl.in.expr(repl.in.globals, e)
+	defer repl.in.out.Flush()
+	if err != nil {
+		return err
+	}
+	switch t {
+	case TypVoid:
+	case TypString:
+		fmt.Fprintf(repl.in.out, "%q\n", v)
+	default:
+		fmt.Fprintf(repl.in.out, "%v\n", v)
+	}
+	return nil
+}
+
+// exec resolves, checks and runs a statement at the module level. If any
+// of that fails the module is left as it was before.
+func (repl *Repl) exec(src string, st AstStatement) error {
+	scope := repl.res.res.Module
+	saved := maps.Clone(scope.Symbols)
+	fail := func(err error) error {
+		scope.Symbols = saved
+		return err
+	}
+
+	name := declName(st)
+	if name != "" {
+		// A new declaration replaces any old one with the same name
+		delete(scope.Symbols, name)
+	}
+
+	repl.res.errs = nil
+	warnings := len(repl.res.res.Warnings)
+	if fn, ok := st.(*AstFnDecl); ok {
+		// Declared first so it can call itself
+		repl.res.declare(fn.Name, SymFn, fn)
+	}
+	repl.res.stmt(st)
+	for _, w := range repl.res.res.Warnings[warnings:] {
+		repl.diags.Print(w.Diagnostic(SevWarning))
+	}
+	if err := errors.Join(repl.res.errs...); err != nil {
+		return fail(err)
+	}
+	repl.chk.errs = nil
+	repl.chk.stmt(st)
+	repl.chk.fold(st)
+	if err := errors.Join(repl.chk.errs...); err != nil {
+		return fail(err)
+	}
+
+	if fn, ok := st.(*AstFnDecl); ok {
+		repl.in.defineFn(fn)
+	}
+	_, err := repl.in.stmt(repl.in.globals, st)
+	repl.in.out.Flush()
+	if err != nil {
+		return fail(err)
+	}
+
+	if name != "" {
+		def := SourceText(src, st)
+		if needsSemi(st) {
+			def += ";"
+		}
+		repl.define(name, st, def)
+	}
+	return nil
+}
+
+// define adds a declaration to the module, replacing any earlier one of
+// the same name
+func (repl *Repl) define(name string, st AstStatement, src string) {
+	stmts := repl.mod.Statements[:0]
+	for _, old := range repl.mod.Statements {
+		if declName(old) == name {
+			delete(repl.defs, old)
+			continue
+		}
+		stmts = append(stmts, old)
+	}
+	repl.mod.Statements = append(stmts, st)
+	repl.defs[st] = src
+}
+
+// declName is the name a statement declares, empty if it isn't a
+// declaration
+func declName(st AstStatement) string {
+	switch n := st.(type) {
+	case *AstConstAssign:
+		return n.Ident.Name
+	case *AstVarDecl:
+		return n.Ident.Name
+	case *AstFnDecl:
+		return n.Name.Name
+	}
+	return ""
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRepl(t *testing.T) {
+	cases := []struct {
+		name  string
+		input string
+		out   string
+		diags []string
+	}{
+		{
+			name:  "expressions",
+			input: "1 + 2 * 3\n\"hi\"\n1 < 2;\n",
+			out:   "7\n\"hi\"\ntrue\n",
+		},
+		{
+			name:  "declarations persist",
+			input: "let a = 20\nvar b = a + 1;\nb += a; b\n",
+			out:   "41\n",
+		},
+		{
+			name:  "multi-line function",
+			input: "fn fact(n: int): int {\n\tif n <= 1 {\n\t\treturn 1;\n\t}\n\treturn n * fact(n - 1);\n}\nfact(5)\n",
+			out:   "120\n",
+		},
+		{
+			name:  "statements run",
+			input: "var n = 0\nfor i in 0..5 {\n\tn += i;\n}\nprintf(\"%d\\n\", n);\n",
+			out:   "10\n3\n",
+		},
+		{
+			name:  "void calls print nothing",
+			input: "fn hi(): void { puts(\"hi\"); }\nhi()\nhi(); hi();\n",
+			out:   "hi\nhi\nhi\n",
+		},
+		{
+			name:  "redeclaring replaces",
+			input: "let a = 1\nlet a = \"one\"\na\n:defs\n",
+			out:   "\"one\"\nlet a = \"one\";\n",
+		},
+		{
+			name:  "errors don't end the session",
+			input: "x\nlet y: int = true;\ny\n1 +\n2\n",
+			out:   "2\n",
+			diags: []string{"undefined: x", "cannot use bool value as int", "undefined: y", "expected"},
+		},
+		{
+			name:  "a failed declaration leaves nothing behind",
+			input: "var c = 1 / 0\nc\n",
+			diags: []string{"integer division by zero", "undefined: c"},
+		},
+		{
+			name:  "constants are worked out when they're declared",
+			input: "let d = 1 / 0\nlet s = \"a\" + \"b\"\ns + s\n",
+			out:   "\"abab\"\n",
+			diags: []string{"division by zero in 1 / 0"},
+		},
+		{
+			name:  "syntax errors in blocks are reported",
+			input: "fn f(): void { x x; puts(\"in f\"); }\nf()\nvar a = 1\nif a == 1 { a = @; }\na\n",
+			out:   "1\n",
+			diags: []string{"<repl>:1:18", "undefined: f", "unexpected character '@'"},
+		},
+		{
+			name:  "quit",
+			input: "1\n:quit\n2\n",
+			out:   "1\n",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			out, errs := bytes.Buffer{}, bytes.Buffer{}
+			printer := NewDiagnosticPrinter(&errs, false)
+			repl := NewRepl(&out, printer, printer)
+			if err := repl.Run(strings.NewReader(tc.input)); err != nil {
+				t.Fatal(err)
+			}
+			if out.String() != tc.out {
+				t.Errorf("expected output %q got %q", tc.out, out.String())
+			}
+			for _, want := range tc.diags {
+				if !strings.Contains(errs.String(), want) {
+					t.Errorf("expected a diagnostic containing %q, got\n%s", want, errs.String())
+				}
+			}
+			if len(tc.diags) == 0 && errs.Len() != 0 {
+				t.Errorf("unexpected diagnostics:\n%s", errs.String())
+			}
+		})
+	}
+}
+
+func TestBraceDepth(t *testing.T) {
+	cases := []struct {
+		src   string
+		depth int
+	}{
+		{"1 + 2", 0},
+		{"fn f(): void {", 1},
+		{"if a { while b {", 2},
+		{"fn f(): void { }", 0},
+		{`puts("{")`, 0},
+		{"// {\n", 0},
+	}
+	for _, tc := range cases {
+		if got := braceDepth(tc.src); got != tc.depth {
+			t.Errorf("braceDepth(%q): expected %d got %d", tc.src, tc.depth, got)
+		}
+	}
+}
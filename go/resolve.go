@@ -0,0 +1,324 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+type SymbolKind int
+
+const (
+	SymBuiltin SymbolKind = iota
+	SymFn
+	SymConst
+	SymVar
+	SymParam
+	SymLoopVar
+)
+
+func (k SymbolKind) String() string {
+	switch k {
+	case SymBuiltin:
+		return "builtin"
+	case SymFn:
+		return "function"
+	case SymConst:
+		return "constant"
+	case SymVar:
+		return "variable"
+	case SymParam:
+		return "parameter"
+	case SymLoopVar:
+		return "loop variable"
+	}
+	return fmt.Sprintf("SymbolKind(%d)", int(k))
+}
+
+// Symbol is a declared name. Decl is the node that declared it: an
+// *AstFnDecl, *AstConstAssign, *AstVarDecl, *AstParam or *AstRangeFor,
+// or nil for builtins.
+type Symbol struct {
+	Name  string
+	Kind  SymbolKind
+	Decl  Node
+	Ident *AstIdent
+}
+
+type Scope struct {
+	Parent  *Scope
+	Symbols map[string]*Symbol
+}
+
+func NewScope(parent *Scope) *Scope {
+	return &Scope{Parent: parent, Symbols: map[string]*Symbol{}}
+}
+
+// Lookup finds name in this scope or any enclosing one, nil if it is
+// not declared
+func (s *Scope) Lookup(name string) *Symbol {
+	for ; s != nil; s = s.Parent {
+		if sym, ok := s.Symbols[name]; ok {
+			return sym
+		}
+	}
+	return nil
+}
+
+// LookupLocal only looks in this scope, not any enclosing ones
+func (s *Scope) LookupLocal(name string) *Symbol {
+	return s.Symbols[name]
+}
+
+// Builtins are the C functions the runtime makes available to every module
+var Builtins = []string{
+	"printf",
+	"puts",
+	"putchar",
+}
+
+// Universe returns a new scope holding the builtins, it is the parent
+// of every module scope.
+func Universe() *Scope {
+	s := NewScope(nil)
+	for _, name := range Builtins {
+		s.Symbols[name] = &Symbol{Name: name, Kind: SymBuiltin}
+	}
+	return s
+}
+
+// Resolution is the result of resolving a module, it maps every
+// identifier to the symbol it refers to.
+type Resolution struct {
+	Module *Scope
+	// The symbol every identifier use and declaration refers to
+	Uses map[*AstIdent]*Symbol
+	// The scope introduced by a function, block or loop
+	Scopes map[Node]*Scope
+	// Problems that don't stop compilation, like shadowing
+	Warnings []ParseError
+}
+
+// SymbolOf returns the symbol an identifier refers to, or nil if it
+// wasn't resolved.
+func (r *Resolution) SymbolOf(id *AstIdent) *Symbol {
+	return r.Uses[id]
+}
+
+// ScopeOf returns the scope introduced by n, nil if it doesn't introduce one
+func (r *Resolution) ScopeOf(n Node) *Scope {
+	return r.Scopes[n]
+}
+
+type resolver struct {
+	filename string
+	res      *Resolution
+	scope    *Scope
+	errs     []error
+	// The function being resolved, nil at the module level, and the
+	// function each local is declared in
+	fn     *AstFnDecl
+	owners map[*Symbol]*AstFnDecl
+}
+
+// Resolve binds every identifier in mod to its declaration. Functions are
+// visible throughout the module, everything else from the point it is
+// declared until the end of the enclosing block. Undefined names,
+// duplicate declarations, assignments to anything but a var and nested
+// functions using the locals of the function they're in are errors,
+// shadowing an outer declaration is a warning.
+func Resolve(mod *AstModule) (*Resolution, error) {
+	r := newResolver(mod)
+
+	// Functions can be called before they are declared
+	for _, st := range mod.Statements {
+		if fn, ok := st.(*AstFnDecl); ok {
+			r.declare(fn.Name, SymFn, fn)
+		}
+	}
+	for _, st := range mod.Statements {
+		r.stmt(st)
+	}
+	return r.res, errors.Join(r.errs...)
+}
+
+// newResolver makes a resolver with an empty module scope for mod
+func newResolver(mod *AstModule) *resolver {
+	r := &resolver{
+		filename: mod.Filename,
+		res: &Resolution{
+			Uses:   map[*AstIdent]*Symbol{},
+			Scopes: map[Node]*Scope{},
+		},
+		owners: map[*Symbol]*AstFnDecl{},
+	}
+	r.scope = NewScope(Universe())
+	r.res.Module = r.scope
+	r.res.Scopes[mod] = r.scope
+	return r
+}
+
+func (r *resolver) errorAt(n Node, code string, format string, a ...any) ParseError {
+	err := nodeError(r.filename, n, format, a...)
+	err.Code = code
+	return err
+}
+
+func (r *resolver) pushScope(n Node) {
+	r.scope = NewScope(r.scope)
+	r.res.Scopes[n] = r.scope
+}
+
+func (r *resolver) popScope() {
+	r.scope = r.scope.Parent
+}
+
+func (r *resolver) declare(id *AstIdent, kind SymbolKind, decl Node) {
+	if prev := r.scope.LookupLocal(id.Name); prev != nil {
+		if prev.Decl != decl {
+			err := r.errorAt(id, CodeRedeclared, "%s redeclared in this scope, previous declaration at %v", id.Name, prev.Ident.Span().Start)
+			err.Labels = []Label{{prev.Ident.Span(), "previous declaration of " + id.Name}}
+			r.errs = append(r.errs, err)
+		}
+		r.res.Uses[id] = prev
+		return
+	}
+	if prev := r.scope.Parent.Lookup(id.Name); prev != nil && prev.Kind != SymBuiltin {
+		warning := r.errorAt(id, CodeShadow, "%s shadows the %s declared at %v", id.Name, prev.Kind, prev.Ident.Span().Start)
+		warning.Labels = []Label{{prev.Ident.Span(), fmt.Sprintf("%s %s declared here", prev.Kind, id.Name)}}
+		r.res.Warnings = append(r.res.Warnings, warning)
+	}
+	sym := &Symbol{Name: id.Name, Kind: kind, Decl: decl, Ident: id}
+	r.scope.Symbols[id.Name] = sym
+	r.res.Uses[id] = sym
+	if kind != SymFn {
+		r.owners[sym] = r.fn
+	}
+}
+
+func (r *resolver) use(id *AstIdent) *Symbol {
+	sym := r.scope.Lookup(id.Name)
+	if sym == nil {
+		r.errs = append(r.errs, r.errorAt(id, CodeUndefined, "undefined: %s", id.Name))
+		return nil
+	}
+	r.res.Uses[id] = sym
+	// Functions don't keep the frame of the one they're in, so they can
+	// only use its functions
+	if owner := r.owners[sym]; owner != nil && owner != r.fn {
+		err := r.errorAt(id, CodeCapture, "%s can't be used here, functions can't use the locals of the function they're in", id.Name)
+		err.Labels = []Label{{sym.Ident.Span(), fmt.Sprintf("%s %s declared in %s", sym.Kind, sym.Name, owner.Name.Name)}}
+		r.errs = append(r.errs, err)
+	}
+	return sym
+}
+
+func (r *resolver) block(b *AstBlock) {
+	r.pushScope(b)
+	for _, st := range b.Body {
+		r.stmt(st)
+	}
+	r.popScope()
+}
+
+func (r *resolver) stmt(st AstStatement) {
+	switch n := st.(type) {
+	case *AstConstAssign:
+		r.expr(n.Value)
+		r.declare(n.Ident, SymConst, n)
+	case *AstVarDecl:
+		r.expr(n.Value)
+		r.declare(n.Ident, SymVar, n)
+	case *AstAssign:
+		r.expr(n.Value)
+		sym := r.use(n.Target)
+		if sym != nil && sym.Kind != SymVar {
+			if sym.Ident != nil {
+				err := r.errorAt(n.Target, CodeAssign, "cannot assign to %s, it is a %s declared at %v", n.Target.Name, sym.Kind, sym.Ident.Span().Start)
+				err.Labels = []Label{{sym.Ident.Span(), fmt.Sprintf("%s %s declared here", sym.Kind, sym.Name)}}
+				if sym.Kind == SymConst {
+					err.Notes = []string{"declare it with var to make it assignable"}
+				}
+				r.errs = append(r.errs, err)
+			} else {
+				r.errs = append(r.errs, r.errorAt(n.Target, CodeAssign, "cannot assign to %s, it is a %s", n.Target.Name, sym.Kind))
+			}
+		}
+	case *AstFnDecl:
+		// Nested functions are only visible in their enclosing block,
+		// top level ones were declared up front
+		if r.scope != r.res.Module {
+			r.declare(n.Name, SymFn, n)
+		}
+		outer := r.fn
+		r.fn = n
+		r.pushScope(n)
+		for _, param := range n.Params {
+			r.declare(param.Name, SymParam, param)
+		}
+		r.block(n.Body)
+		r.popScope()
+		r.fn = outer
+	case *AstFnCall:
+		r.expr(n)
+	case *AstBlock:
+		r.block(n)
+	case *AstIf:
+		r.expr(n.Cond)
+		r.block(n.Then)
+		if n.Else != nil {
+			r.stmt(n.Else)
+		}
+	case *AstWhile:
+		r.expr(n.Cond)
+		r.block(n.Body)
+	case *AstFor:
+		// Anything declared by init is only visible in the loop
+		r.pushScope(n)
+		if n.Init != nil {
+			r.stmt(n.Init)
+		}
+		if n.Cond != nil {
+			r.expr(n.Cond)
+		}
+		if n.Step != nil {
+			r.stmt(n.Step)
+		}
+		r.block(n.Body)
+		r.popScope()
+	case *AstRangeFor:
+		r.expr(n.Lo)
+		r.expr(n.Hi)
+		r.pushScope(n)
+		r.declare(n.Var, SymLoopVar, n)
+		r.block(n.Body)
+		r.popScope()
+	case *AstReturn:
+		if n.Value != nil {
+			r.expr(n.Value)
+		}
+	case *AstBreak, *AstContinue:
+		// Loop labels are checked by the parser
+	default:
+		panic(fmt.Sprintf("resolve: unhandled statement %T", st))
+	}
+}
+
+func (r *resolver) expr(e AstExpr) {
+	switch n := e.(type) {
+	case *AstIdent:
+		r.use(n)
+	case *AstFnCall:
+		r.use(n.Name)
+		for _, arg := range n.Args {
+			r.expr(arg)
+		}
+	case *AstBinaryExpr:
+		r.expr(n.Left)
+		r.expr(n.Right)
+	case *AstUnaryExpr:
+		r.expr(n.Expr)
+	case *AstIntLitExpr, *AstStringLitExpr, *AstBoolLitExpr:
+	default:
+		panic(fmt.Sprintf("resolve: unhandled expression %T", e))
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func resolveSrc(t *testing.T, src string) (*AstModule, *Resolution, error) {
+	t.Helper()
+	p := NewParser(src, "<filename>")
+	mod, err := p.ParseModule()
+	if err != nil {
+		t.Fatalf("parsing %#v: %v", src, err)
+	}
+	res, err := Resolve(mod)
+	return mod, res, err
+}
+
+func TestResolve(t *testing.T) {
+	src := `
+		module test;
+
+		let limit: int = 10;
+
+		fn main(): int {
+			var total: int = 0;
+			for i in 0..limit {
+				total += helper(i);
+			}
+			printf("%d\n", total);
+			return total;
+		}
+
+		fn helper(n: int): int {
+			return n * 2;
+		}
+	`
+	mod, res, err := resolveSrc(t, src)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(res.Warnings) != 0 {
+		t.Errorf("unexpected warnings: %v", res.Warnings)
+	}
+	limit := mod.Statements[0].(*AstConstAssign)
+	main := mod.Statements[1].(*AstFnDecl)
+	helper := mod.Statements[2].(*AstFnDecl)
+
+	loop := main.Body.Body[1].(*AstRangeFor)
+	if sym := res.SymbolOf(loop.Hi.(*AstIdent)); sym == nil || sym.Decl != limit || sym.Kind != SymConst {
+		t.Errorf("limit resolved to %+v", sym)
+	}
+	assign := loop.Body.Body[0].(*AstAssign)
+	if sym := res.SymbolOf(assign.Target); sym == nil || sym.Decl != main.Body.Body[0] || sym.Kind != SymVar {
+		t.Errorf("total resolved to %+v", sym)
+	}
+	call := assign.Value.(*AstFnCall)
+	if sym := res.SymbolOf(call.Name); sym == nil || sym.Decl != helper {
+		t.Errorf("helper resolved to %+v", sym)
+	}
+	if sym := res.SymbolOf(call.Args[0].(*AstIdent)); sym == nil || sym.Decl != loop || sym.Kind != SymLoopVar {
+		t.Errorf("i resolved to %+v", sym)
+	}
+	printf := main.Body.Body[2].(*AstFnCall)
+	if sym := res.SymbolOf(printf.Name); sym == nil || sym.Kind != SymBuiltin {
+		t.Errorf("printf resolved to %+v", sym)
+	}
+	ret := helper.Body.Body[0].(*AstReturn).Value.(*AstBinaryExpr)
+	if sym := res.SymbolOf(ret.Left.(*AstIdent)); sym == nil || sym.Decl != helper.Params[0] {
+		t.Errorf("n resolved to %+v", sym)
+	}
+	if scope := res.ScopeOf(helper); scope == nil || scope.LookupLocal("n") == nil {
+		t.Errorf("expected helper's scope to hold its parameter")
+	}
+}
+
+func TestResolveErrors(t *testing.T) {
+	badCases := []struct{ src, msg string }{
+		{"module foo; fn main(): int { return nope; }", "<filename>:1:37  undefined: nope"},
+		{"module foo; fn main(): int { nope(1); }", "<filename>:1:30  undefined: nope"},
+		{"module foo; fn main(): int { let a: int = b; let b: int = 1; }", "<filename>:1:43  undefined: b"},
+		{"module foo; fn main(): int { for i in 0..1 {} return i; }", "<filename>:1:54  undefined: i"},
+		{"module foo; fn main(): int { if 1 { var x: int = 1; } x = 2; }", "<filename>:1:55  undefined: x"},
+		{"module foo; let a: int = 1; let a: int = 2;", "<filename>:1:33  a redeclared in this scope, previous declaration at 1:17"},
+		{"module foo; fn f(): void {} fn f(): void {}", "<filename>:1:32  f redeclared in this scope, previous declaration at 1:16"},
+		{"module foo; fn f(a: int, a: int): void {}", "<filename>:1:26  a redeclared in this scope, previous declaration at 1:18"},
+		{"module foo; let a: int = 1; fn main(): int { a = 2; }", "<filename>:1:46  cannot assign to a, it is a constant declared at 1:17"},
+		{"module foo; fn main(): int { let a: int = 1; a += 2; }", "<filename>:1:46  cannot assign to a, it is a constant declared at 1:34"},
+		{"module foo; fn f(a: int): int { a = 2; }", "<filename>:1:33  cannot assign to a, it is a parameter declared at 1:18"},
+		{"module foo; fn f(): int { for i in 0..2 { i = 2; } }", "<filename>:1:43  cannot assign to i, it is a loop variable declared at 1:31"},
+		{"module foo; fn f(): int { f = 2; }", "<filename>:1:27  cannot assign to f, it is a function declared at 1:16"},
+		{"module foo; fn f(): int { printf = 2; }", "<filename>:1:27  cannot assign to printf, it is a builtin"},
+		{"module foo; fn f(): int { let x = 1; fn g(): int { return x; } return g(); }", "<filename>:1:59  x can't be used here, functions can't use the locals of the function they're in"},
+		{"module foo; fn f(a: int): void { fn g(): void { for i in 0..a {} } }", "<filename>:1:61  a can't be used here, functions can't use the locals of the function they're in"},
+		{"module foo; fn f(): void { var acc = 0; fn g(y: int): void { acc += y; } }", "<filename>:1:62  acc can't be used here, functions can't use the locals of the function they're in"},
+	}
+	for _, tc := range badCases {
+		_, _, err := resolveSrc(t, tc.src)
+		if err == nil {
+			t.Errorf("expected failure resolving: %#v", tc.src)
+		} else if err.Error() != tc.msg {
+			t.Errorf("resolving %#v: expected %q got %q", tc.src, tc.msg, err.Error())
+		}
+	}
+}
+
+func TestResolveReportsAllErrors(t *testing.T) {
+	_, _, err := resolveSrc(t, "module foo; fn main(): int { a(); b = c; }")
+	var pe ParseError
+	if !errors.As(err, &pe) {
+		t.Fatalf("expected a ParseError, got %v", err)
+	}
+	if lines := strings.Split(err.Error(), "\n"); len(lines) != 3 {
+		t.Errorf("expected 3 errors, got %q", lines)
+	}
+}
+
+func TestResolveShadowing(t *testing.T) {
+	src := `module foo;
+let a: int = 1;
+fn main(): int {
+	var a: int = 2;
+	a = 3;
+	return a;
+}`
+	mod, res, err := resolveSrc(t, src)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(res.Warnings) != 1 {
+		t.Fatalf("expected one warning, got %v", res.Warnings)
+	}
+	if got, want := res.Warnings[0].Error(), "<filename>:4:6  a shadows the constant declared at 2:5"; got != want {
+		t.Errorf("expected %q got %q", want, got)
+	}
+	// The assignment is to the shadowing variable, not the constant
+	body := mod.Statements[1].(*AstFnDecl).Body.Body
+	if sym := res.SymbolOf(body[1].(*AstAssign).Target); sym == nil || sym.Decl != body[0] {
+		t.Errorf("a resolved to %+v", sym)
+	}
+}
@@ -0,0 +1,549 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+)
+
+// In SSA form every variable apart from the globals is assigned exactly
+// once, and where control flow joins a phi picks the value that arrived.
+// The optimisations all work on functions in SSA form, which makes a
+// variable's value the same everywhere it's used.
+
+// predecessors finds the blocks that can go to each block
+func predecessors(f *IrFunc) map[*IrBlock][]*IrBlock {
+	preds := map[*IrBlock][]*IrBlock{}
+	for _, b := range f.Blocks {
+		for _, s := range b.Succs() {
+			if !slices.Contains(preds[s], b) {
+				preds[s] = append(preds[s], b)
+			}
+		}
+	}
+	return preds
+}
+
+// removeUnreachable drops the blocks that can't be reached from the
+// start of the function, and any phi args coming from them
+func removeUnreachable(f *IrFunc) {
+	seen := map[*IrBlock]bool{}
+	var visit func(b *IrBlock)
+	visit = func(b *IrBlock) {
+		if seen[b] {
+			return
+		}
+		seen[b] = true
+		for _, s := range b.Succs() {
+			visit(s)
+		}
+	}
+	visit(f.Blocks[0])
+	blocks := f.Blocks[:0]
+	for _, b := range f.Blocks {
+		if seen[b] {
+			blocks = append(blocks, b)
+		}
+	}
+	f.Blocks = blocks
+	for _, b := range f.Blocks {
+		for _, phi := range phis(b) {
+			for i := len(phi.Preds) - 1; i >= 0; i-- {
+				if !seen[phi.Preds[i]] {
+					removePhiArg(phi, i)
+				}
+			}
+		}
+	}
+}
+
+// phis are the phi instructions at the start of b
+func phis(b *IrBlock) []*IrInstr {
+	n := 0
+	for n < len(b.Instrs) && b.Instrs[n].Op == IrPhi {
+		n++
+	}
+	return b.Instrs[:n]
+}
+
+func removePhiArg(phi *IrInstr, i int) {
+	phi.Args = slices.Delete(phi.Args, i, i+1)
+	phi.Preds = slices.Delete(phi.Preds, i, i+1)
+}
+
+// removeEdge is for when from stops going to to, the phis in to lose the
+// values that came from it
+func removeEdge(from, to *IrBlock) {
+	for _, phi := range phis(to) {
+		if i := slices.Index(phi.Preds, from); i >= 0 {
+			removePhiArg(phi, i)
+		}
+	}
+}
+
+// domTree is the dominator tree of a function: a block dominates another
+// if every path to the other goes through it. The immediate dominator of
+// a block is the closest one that does.
+type domTree struct {
+	idom     map[*IrBlock]*IrBlock
+	children map[*IrBlock][]*IrBlock
+	// The blocks in reverse postorder, each comes after its dominators
+	order []*IrBlock
+}
+
+// dominators works out the dominator tree, using "A Simple, Fast
+// Dominance Algorithm" by Cooper, Harvey and Kennedy
+func dominators(f *IrFunc, preds map[*IrBlock][]*IrBlock) *domTree {
+	post := []*IrBlock{}
+	seen := map[*IrBlock]bool{}
+	var visit func(b *IrBlock)
+	visit = func(b *IrBlock) {
+		seen[b] = true
+		for _, s := range b.Succs() {
+			if !seen[s] {
+				visit(s)
+			}
+		}
+		post = append(post, b)
+	}
+	entry := f.Blocks[0]
+	visit(entry)
+	index := map[*IrBlock]int{}
+	for i, b := range post {
+		index[b] = i
+	}
+
+	idom := map[*IrBlock]*IrBlock{entry: entry}
+	intersect := func(a, b *IrBlock) *IrBlock {
+		for a != b {
+			for index[a] < index[b] {
+				a = idom[a]
+			}
+			for index[b] < index[a] {
+				b = idom[b]
+			}
+		}
+		return a
+	}
+	for changed := true; changed; {
+		changed = false
+		for i := len(post) - 2; i >= 0; i-- {
+			b := post[i]
+			var dom *IrBlock
+			for _, p := range preds[b] {
+				if idom[p] == nil {
+					continue
+				}
+				if dom == nil {
+					dom = p
+				} else {
+					dom = intersect(p, dom)
+				}
+			}
+			if idom[b] != dom {
+				idom[b] = dom
+				changed = true
+			}
+		}
+	}
+
+	t := &domTree{idom: idom, children: map[*IrBlock][]*IrBlock{}}
+	for i := len(post) - 1; i >= 0; i-- {
+		t.order = append(t.order, post[i])
+	}
+	// Children are in the order the blocks are listed, so they're
+	// visited in the order they're written
+	for _, b := range f.Blocks {
+		if b != entry && seen[b] {
+			t.children[idom[b]] = append(t.children[idom[b]], b)
+		}
+	}
+	return t
+}
+
+// dominates reports if every path to b goes through a
+func (t *domTree) dominates(a, b *IrBlock) bool {
+	for b != a {
+		up := t.idom[b]
+		if up == nil || up == b {
+			return false
+		}
+		b = up
+	}
+	return true
+}
+
+// frontiers finds the dominance frontier of each block: the blocks where
+// its dominance stops, which is where the values it sets meet others
+func (t *domTree) frontiers(preds map[*IrBlock][]*IrBlock) map[*IrBlock][]*IrBlock {
+	df := map[*IrBlock][]*IrBlock{}
+	for _, b := range t.order {
+		if len(preds[b]) < 2 {
+			continue
+		}
+		for _, p := range preds[b] {
+			for runner := p; runner != t.idom[b]; runner = t.idom[runner] {
+				if !slices.Contains(df[runner], b) {
+					df[runner] = append(df[runner], b)
+				}
+			}
+		}
+	}
+	return df
+}
+
+// renamed reports if a variable is given versions in SSA form, globals
+// are kept in memory and aren't
+func renamed(v IrValue) (*IrVar, bool) {
+	vr, ok := v.(*IrVar)
+	return vr, ok && vr != nil && vr.Kind != IrGlobal
+}
+
+// liveIn finds the variables that are used in or after each block before
+// being set. A phi's args are used at the end of the block they come from.
+func liveIn(f *IrFunc, preds map[*IrBlock][]*IrBlock) map[*IrBlock]map[*IrVar]bool {
+	uses := map[*IrBlock]map[*IrVar]bool{}
+	defs := map[*IrBlock]map[*IrVar]bool{}
+	for _, b := range f.Blocks {
+		uses[b], defs[b] = map[*IrVar]bool{}, map[*IrVar]bool{}
+		for _, in := range b.Instrs {
+			if in.Op != IrPhi {
+				for _, a := range in.Args {
+					if v, ok := renamed(a); ok && !defs[b][v] {
+						uses[b][v] = true
+					}
+				}
+			}
+			if in.Dst != nil {
+				defs[b][in.Dst] = true
+			}
+		}
+	}
+	live := map[*IrBlock]map[*IrVar]bool{}
+	for _, b := range f.Blocks {
+		live[b] = map[*IrVar]bool{}
+	}
+	for changed := true; changed; {
+		changed = false
+		for i := len(f.Blocks) - 1; i >= 0; i-- {
+			b := f.Blocks[i]
+			out := map[*IrVar]bool{}
+			for _, s := range b.Succs() {
+				for v := range live[s] {
+					out[v] = true
+				}
+				for _, phi := range phis(s) {
+					for j, a := range phi.Args {
+						if v, ok := renamed(a); ok && phi.Preds[j] == b {
+							out[v] = true
+						}
+					}
+				}
+			}
+			for v := range uses[b] {
+				out[v] = true
+			}
+			for v := range out {
+				if !live[b][v] && (uses[b][v] || !defs[b][v]) {
+					live[b][v] = true
+					changed = true
+				}
+			}
+		}
+	}
+	return live
+}
+
+// ToSSA puts a function into SSA form. Phis are only added where the
+// variable is still needed, so it's pruned SSA. A function that's already
+// in SSA form is left as it is.
+func ToSSA(f *IrFunc) {
+	removeUnreachable(f)
+	preds := predecessors(f)
+	dom := dominators(f, preds)
+	df := dom.frontiers(preds)
+	live := liveIn(f, preds)
+
+	// Put phis where the values set in different blocks meet
+	defsites := map[*IrVar][]*IrBlock{}
+	vars := []*IrVar{}
+	for _, b := range f.Blocks {
+		for _, in := range b.Instrs {
+			if v, ok := renamed(in.Dst); ok {
+				if defsites[v] == nil {
+					vars = append(vars, v)
+				}
+				defsites[v] = append(defsites[v], b)
+			}
+		}
+	}
+	phiVar := map[*IrInstr]*IrVar{}
+	for _, v := range vars {
+		has := map[*IrBlock]bool{}
+		for _, b := range f.Blocks {
+			for _, phi := range phis(b) {
+				if phi.Dst == v {
+					has[b] = true
+				}
+			}
+		}
+		work := slices.Clone(defsites[v])
+		for len(work) > 0 {
+			b := work[len(work)-1]
+			work = work[:len(work)-1]
+			for _, d := range df[b] {
+				if has[d] || !live[d][v] {
+					continue
+				}
+				has[d] = true
+				phi := &IrInstr{Op: IrPhi, Dst: v, Args: make([]IrValue, len(preds[d])), Preds: slices.Clone(preds[d])}
+				phiVar[phi] = v
+				d.Instrs = slices.Insert(d.Instrs, 0, phi)
+				if !slices.Contains(defsites[v], d) {
+					work = append(work, d)
+				}
+			}
+		}
+	}
+
+	// Give every assignment its own variable. The first assignment of a
+	// local keeps its variable, the others get new ones named after it.
+	used := map[string]bool{}
+	for _, v := range f.Params {
+		used[v.Name] = true
+	}
+	for _, v := range f.Locals {
+		used[v.Name] = true
+	}
+	defined := map[*IrVar]bool{}
+	version := func(v *IrVar) *IrVar {
+		if v.Kind == IrTemp {
+			if !defined[v] {
+				defined[v] = true
+				return v
+			}
+			return &IrVar{Type: v.Type, Kind: IrTemp}
+		}
+		if !defined[v] && v.Kind != IrParam {
+			defined[v] = true
+			return v
+		}
+		name := v.Name
+		for i := 1; used[name]; i++ {
+			name = fmt.Sprintf("%s.%d", v.Name, i)
+		}
+		used[name] = true
+		return &IrVar{Name: name, Type: v.Type, Kind: IrLocal}
+	}
+	stacks := map[*IrVar][]*IrVar{}
+	for _, p := range f.Params {
+		stacks[p] = []*IrVar{p}
+	}
+	current := func(v *IrVar) IrValue {
+		if s := stacks[v]; len(s) > 0 {
+			return s[len(s)-1]
+		}
+		// It isn't set on the way here, which the checker doesn't allow
+		return zeroValue(v.Type)
+	}
+	var rename func(b *IrBlock)
+	rename = func(b *IrBlock) {
+		pushed := []*IrVar{}
+		for _, in := range b.Instrs {
+			if in.Op != IrPhi {
+				for i, a := range in.Args {
+					if v, ok := renamed(a); ok {
+						in.Args[i] = current(v)
+					}
+				}
+			}
+			if v, ok := renamed(in.Dst); ok {
+				in.Dst = version(v)
+				stacks[v] = append(stacks[v], in.Dst)
+				pushed = append(pushed, v)
+			}
+		}
+		for _, s := range b.Succs() {
+			for _, phi := range phis(s) {
+				for i, p := range phi.Preds {
+					if p != b {
+						continue
+					}
+					// The phis added above are for their own variable,
+					// any that were already there have args to rename
+					if v, ok := phiVar[phi]; ok {
+						phi.Args[i] = current(v)
+					} else if v, ok := renamed(phi.Args[i]); ok {
+						phi.Args[i] = current(v)
+					}
+				}
+			}
+		}
+		for _, c := range dom.children[b] {
+			rename(c)
+		}
+		for _, v := range pushed {
+			stacks[v] = stacks[v][:len(stacks[v])-1]
+		}
+	}
+	rename(f.Blocks[0])
+	tidy(f)
+}
+
+// LeaveSSA turns the phis in a function into copies. Each phi gets a new
+// temporary, which is set at the end of the blocks the values come from.
+// That way no phi can overwrite a value another one still needs.
+func LeaveSSA(f *IrFunc) {
+	for _, b := range f.Blocks {
+		for i := range phis(b) {
+			// The copies go before the terminators, so the phi stays at i
+			// even when b comes to itself
+			phi := b.Instrs[i]
+			t := &IrVar{Type: phi.Dst.Type, Kind: IrTemp}
+			for j, p := range phi.Preds {
+				n := len(p.Instrs) - 1
+				p.Instrs = slices.Insert(p.Instrs, n, &IrInstr{Op: IrCopy, Dst: t, Args: []IrValue{phi.Args[j]}})
+			}
+			b.Instrs[i] = &IrInstr{Op: IrCopy, Dst: phi.Dst, Args: []IrValue{t}}
+		}
+	}
+	tidy(f)
+}
+
+// tidy lists a function's variables again after they've been changed, in
+// the order they're set, and numbers the temporaries from 0
+func tidy(f *IrFunc) {
+	seen := map[*IrVar]bool{}
+	for _, p := range f.Params {
+		seen[p] = true
+	}
+	f.Locals = f.Locals[:0]
+	n := 0
+	for _, b := range f.Blocks {
+		for _, in := range b.Instrs {
+			if v := in.Dst; v != nil && v.Kind != IrGlobal && !seen[v] {
+				seen[v] = true
+				f.Locals = append(f.Locals, v)
+				if v.Kind == IrTemp {
+					v.Name = fmt.Sprint(n)
+					n++
+				}
+			}
+		}
+	}
+}
+
+// replaceUses changes every use of a variable in repl to its replacement,
+// following chains of replacements
+func replaceUses(f *IrFunc, repl map[*IrVar]IrValue) {
+	if len(repl) == 0 {
+		return
+	}
+	resolve := func(v IrValue) IrValue {
+		for {
+			vr, ok := v.(*IrVar)
+			if !ok {
+				return v
+			}
+			r, ok := repl[vr]
+			if !ok {
+				return v
+			}
+			v = r
+		}
+	}
+	for _, b := range f.Blocks {
+		for _, in := range b.Instrs {
+			for i, a := range in.Args {
+				in.Args[i] = resolve(a)
+			}
+		}
+	}
+}
+
+// VerifyIR checks that a function is well formed: blocks end in their
+// only terminator, phis are at the start of blocks with an arg for each
+// predecessor, and in SSA form nothing is assigned twice
+func VerifyIR(f *IrFunc, ssa bool) error {
+	if len(f.Blocks) == 0 {
+		return fmt.Errorf("%s has no blocks", f.Name)
+	}
+	in := map[*IrBlock]bool{}
+	for _, b := range f.Blocks {
+		// Finding the predecessors needs each block's terminator
+		if len(b.Instrs) == 0 {
+			return fmt.Errorf("%s %s: empty block", f.Name, b.Label)
+		}
+		in[b] = true
+	}
+	preds := predecessors(f)
+	defs := map[*IrVar]bool{}
+	for _, b := range f.Blocks {
+		bad := func(format string, a ...any) error {
+			return fmt.Errorf("%s %s: %s", f.Name, b.Label, fmt.Sprintf(format, a...))
+		}
+		for i, ins := range b.Instrs {
+			if msg := operands(ins); msg != "" {
+				return bad("%s %s", ins, msg)
+			}
+			if ins.Op.IsTerminator() != (i == len(b.Instrs)-1) {
+				return bad("%s isn't where a block ends", ins)
+			}
+			if ins.Op == IrPhi {
+				if i >= len(phis(b)) {
+					return bad("%s isn't at the start of the block", ins)
+				}
+				if len(ins.Preds) != len(preds[b]) || len(ins.Args) != len(ins.Preds) {
+					return bad("%s doesn't have a value for each of the %d predecessors", ins, len(preds[b]))
+				}
+				for _, p := range ins.Preds {
+					if !slices.Contains(preds[b], p) {
+						return bad("%s has a value from %s, which doesn't come here", ins, p.Label)
+					}
+				}
+			}
+			for _, t := range ins.Targets {
+				if !in[t] {
+					return bad("%s goes to a block that isn't in the function", ins)
+				}
+			}
+			if v, ok := renamed(ins.Dst); ok && ssa {
+				if defs[v] {
+					return bad("%s is assigned more than once", v)
+				}
+				defs[v] = true
+			}
+		}
+	}
+	return nil
+}
+
+// operands checks an instruction has the values, blocks and destination
+// its op needs, returning what's wrong if it doesn't
+func operands(in *IrInstr) string {
+	args, targets, dst := 2, 0, true
+	switch in.Op {
+	case IrCopy, IrNeg, IrNot:
+		args = 1
+	case IrCall, IrBuiltin:
+		args, dst = len(in.Args), in.Dst != nil
+	case IrJmp:
+		args, targets, dst = 0, 1, false
+	case IrBr:
+		args, targets, dst = 1, 2, false
+	case IrRet:
+		args, dst = min(len(in.Args), 1), false
+	case IrPhi:
+		args = len(in.Args)
+	}
+	switch {
+	case len(in.Args) != args:
+		return "has the wrong number of values"
+	case len(in.Targets) != targets:
+		return "goes to the wrong number of blocks"
+	case dst && in.Dst == nil:
+		return "should set a variable"
+	case !dst && in.Dst != nil:
+		return "can't set a variable"
+	}
+	return ""
+}
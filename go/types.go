@@ -0,0 +1,96 @@
+package main
+
+import (
+	"strings"
+)
+
+type TypeKind int
+
+const (
+	TypeInvalid TypeKind = iota
+	TypeVoid
+	TypeInt
+	TypeBool
+	TypeString
+	TypeFn
+)
+
+// Type is the type of an expression or declaration. The basic types are
+// singletons so they can be compared with ==, function types need
+// Identical.
+type Type struct {
+	Kind TypeKind
+	Name string
+
+	// Only set for TypeFn
+	Params   []*Type
+	Result   *Type
+	Variadic bool
+}
+
+var (
+	// TypInvalid is given to expressions that already failed to check,
+	// it is compatible with everything to avoid cascading errors
+	TypInvalid = &Type{Kind: TypeInvalid, Name: "invalid"}
+	TypVoid    = &Type{Kind: TypeVoid, Name: "void"}
+	TypInt     = &Type{Kind: TypeInt, Name: "int"}
+	TypBool    = &Type{Kind: TypeBool, Name: "bool"}
+	TypString  = &Type{Kind: TypeString, Name: "string"}
+)
+
+// BuiltinTypes are the types that can be named in a program
+var BuiltinTypes = map[string]*Type{
+	"void":   TypVoid,
+	"int":    TypInt,
+	"bool":   TypBool,
+	"string": TypString,
+}
+
+// BuiltinFns are the signatures of the Builtins
+var BuiltinFns = map[string]*Type{
+	"printf":  NewFnType([]*Type{TypString}, TypInt, true),
+	"puts":    NewFnType([]*Type{TypString}, TypInt, false),
+	"putchar": NewFnType([]*Type{TypInt}, TypInt, false),
+}
+
+func NewFnType(params []*Type, result *Type, variadic bool) *Type {
+	return &Type{Kind: TypeFn, Params: params, Result: result, Variadic: variadic}
+}
+
+func (t *Type) String() string {
+	if t.Kind != TypeFn {
+		return t.Name
+	}
+	params := []string{}
+	for _, p := range t.Params {
+		params = append(params, p.String())
+	}
+	if t.Variadic {
+		params = append(params, "...")
+	}
+	return "fn(" + strings.Join(params, ", ") + "): " + t.Result.String()
+}
+
+// Identical reports if a and b are the same type
+func Identical(a, b *Type) bool {
+	if a.Kind != TypeFn || b.Kind != TypeFn {
+		return a == b
+	}
+	if len(a.Params) != len(b.Params) || a.Variadic != b.Variadic || !Identical(a.Result, b.Result) {
+		return false
+	}
+	for i := range a.Params {
+		if !Identical(a.Params[i], b.Params[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// AssignableTo reports if a value of type v can be stored somewhere of type t
+func AssignableTo(v, t *Type) bool {
+	if v == TypInvalid || t == TypInvalid {
+		return true
+	}
+	return Identical(v, t)
+}
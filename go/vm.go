@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"runtime"
+)
+
+// maxFrames is how deep calls can go before the VM gives up, like a
+// compiled program would with a segfault
+const maxFrames = 1 << 20
+
+type vmFrame struct {
+	fn *BcFunc
+	pc int
+	// Where the function's locals start on the stack
+	base int
+}
+
+// VM runs bytecode programs
+type VM struct {
+	prog    *Program
+	out     *bufio.Writer
+	globals []int64
+	stack   []int64
+}
+
+// RunBytecode runs prog's init function and then main, returning the exit
+// status main returns. Output from the builtins goes to out.
+func RunBytecode(prog *Program, out io.Writer) (int, error) {
+	vm := &VM{
+		prog:    prog,
+		out:     bufio.NewWriter(out),
+		globals: make([]int64, len(prog.Globals)),
+	}
+	defer vm.out.Flush()
+	if prog.Init >= 0 {
+		if _, err := vm.run(prog.Init); err != nil {
+			return 0, err
+		}
+	}
+	if prog.Main < 0 {
+		return 0, ParseError{Msg: fmt.Sprintf("module %s has no main function to run", prog.Module), Filename: prog.Filename, Code: CodeRuntime}
+	}
+	code, err := vm.run(prog.Main)
+	return int(code), err
+}
+
+func (vm *VM) push(v int64) {
+	vm.stack = append(vm.stack, v)
+}
+
+func (vm *VM) pop() int64 {
+	v := vm.stack[len(vm.stack)-1]
+	vm.stack = vm.stack[:len(vm.stack)-1]
+	return v
+}
+
+func b2i(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// errorAt makes a runtime error pointing at the source of the code at pc
+// in f, like the interpreter's
+func (vm *VM) errorAt(f *BcFunc, pc int, format string, a ...any) error {
+	err := spanError(vm.prog.Filename, f.Span(pc), format, a...)
+	err.Code = CodeRuntime
+	return err
+}
+
+// run calls function f with no arguments and runs until it returns, a
+// void function returns 0
+func (vm *VM) run(f int) (result int64, err error) {
+	// Loading checks a program's references but not how it uses the
+	// stack, a bad file could still try to take more off it than is there
+	defer func() {
+		if r := recover(); r != nil {
+			if rerr, ok := r.(runtime.Error); ok {
+				err = fmt.Errorf("%w: %v", errBadBytecode, rerr)
+				return
+			}
+			panic(r)
+		}
+	}()
+	frames := []vmFrame{}
+	enter := func(f, args int) error {
+		if len(frames) == maxFrames {
+			caller := frames[len(frames)-1]
+			return vm.errorAt(caller.fn, caller.pc, "stack overflow, calls are nested more than %d deep", maxFrames)
+		}
+		fn := vm.prog.Funcs[f]
+		base := len(vm.stack) - args
+		for i := args; i < fn.Locals; i++ {
+			vm.push(0)
+		}
+		frames = append(frames, vmFrame{fn, 0, base})
+		return nil
+	}
+	// leave returns from the current function, reporting if it was the
+	// first one
+	leave := func() bool {
+		vm.stack = vm.stack[:frames[len(frames)-1].base]
+		frames = frames[:len(frames)-1]
+		return len(frames) == 0
+	}
+	enter(f, 0)
+
+	for {
+		fr := &frames[len(frames)-1]
+		code := fr.fn.Code
+		op := Opcode(code[fr.pc])
+		arg := func(i int) int {
+			return int(int32(binary.LittleEndian.Uint32(code[fr.pc+1+4*i:])))
+		}
+		next := fr.pc + 1 + 4*op.Operands()
+		switch op {
+		case OpConst, OpString:
+			vm.push(int64(arg(0)))
+		case OpLoad:
+			vm.push(vm.stack[fr.base+arg(0)])
+		case OpStore:
+			vm.stack[fr.base+arg(0)] = vm.pop()
+		case OpGLoad:
+			vm.push(vm.globals[arg(0)])
+		case OpGStore:
+			vm.globals[arg(0)] = vm.pop()
+		case OpPop:
+			vm.pop()
+		case OpDup:
+			vm.push(vm.stack[len(vm.stack)-1])
+		case OpSwap:
+			n := len(vm.stack)
+			vm.stack[n-1], vm.stack[n-2] = vm.stack[n-2], vm.stack[n-1]
+		case OpAdd, OpSub, OpMul, OpDiv, OpMod:
+			r, l := vm.pop(), vm.pop()
+			var v int64
+			switch op {
+			case OpAdd:
+				v = l + r
+			case OpSub:
+				v = l - r
+			case OpMul:
+				v = l * r
+			default:
+				if r == 0 {
+					return 0, vm.errorAt(fr.fn, fr.pc, "integer division by zero")
+				}
+				if op == OpDiv {
+					v = l / r
+				} else {
+					v = l % r
+				}
+			}
+			// Wrap around like a 32 bit int
+			vm.push(int64(int32(v)))
+		case OpEq, OpNe, OpLt, OpLe, OpGt, OpGe:
+			r, l := vm.pop(), vm.pop()
+			var v bool
+			switch op {
+			case OpEq:
+				v = l == r
+			case OpNe:
+				v = l != r
+			case OpLt:
+				v = l < r
+			case OpLe:
+				v = l <= r
+			case OpGt:
+				v = l > r
+			case OpGe:
+				v = l >= r
+			}
+			vm.push(b2i(v))
+		case OpNeg:
+			vm.push(int64(int32(-vm.pop())))
+		case OpNot:
+			vm.push(1 - vm.pop())
+		case OpJmp:
+			next = arg(0)
+		case OpJmpFalse:
+			if vm.pop() == 0 {
+				next = arg(0)
+			}
+		case OpJmpTrue:
+			if vm.pop() != 0 {
+				next = arg(0)
+			}
+		case OpCall:
+			f, n := arg(0), arg(1)
+			fr.pc = next
+			if err := enter(f, n); err != nil {
+				return 0, err
+			}
+			continue
+		case OpBuiltin:
+			n, strs := arg(1), uint32(arg(2))
+			args := make([]any, n)
+			for i := n - 1; i >= 0; i-- {
+				v := vm.pop()
+				if strs&(1<<i) != 0 {
+					args[i] = vm.prog.Strings[v]
+				} else {
+					args[i] = int(v)
+				}
+			}
+			vm.push(int64(callBuiltin(vm.out, Builtins[arg(0)], args)))
+		case OpRet:
+			v := vm.pop()
+			if leave() {
+				return v, nil
+			}
+			vm.push(v)
+			continue
+		case OpRetVoid:
+			if leave() {
+				return 0, nil
+			}
+			continue
+		default:
+			panic(fmt.Sprintf("vm: unhandled opcode %v", op))
+		}
+		fr.pc = next
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import "fmt"
+
+// Walk traverses the tree rooted at n in source order. pre is called on
+// each node before its children, and if it returns false the children
+// (and post) are skipped. post is called after the children. Either may
+// be nil.
+func Walk(n Node, pre func(Node) bool, post func(Node)) {
+	if n == nil {
+		return
+	}
+	if pre != nil && !pre(n) {
+		return
+	}
+	walk := func(child Node) { Walk(child, pre, post) }
+	switch n := n.(type) {
+	case *AstModule:
+		walkIdent(n.Name, walk)
+		for _, st := range n.Statements {
+			walk(st)
+		}
+	case *AstConstAssign:
+		walkIdent(n.Ident, walk)
+		walkType(n.Type, walk)
+		walk(n.Value)
+	case *AstVarDecl:
+		walkIdent(n.Ident, walk)
+		walkType(n.Type, walk)
+		walk(n.Value)
+	case *AstAssign:
+		walkIdent(n.Target, walk)
+		walk(n.Value)
+	case *AstType:
+		walkIdent(n.Name, walk)
+	case *AstBinaryExpr:
+		walk(n.Left)
+		walk(n.Right)
+	case *AstUnaryExpr:
+		walk(n.Expr)
+	case *AstFnDecl:
+		walkIdent(n.Name, walk)
+		for _, p := range n.Params {
+			walk(p)
+		}
+		walkType(n.ReturnType, walk)
+		walkBlock(n.Body, walk)
+	case *AstParam:
+		walkIdent(n.Name, walk)
+		walkType(n.Type, walk)
+	case *AstBlock:
+		for _, st := range n.Body {
+			walk(st)
+		}
+	case *AstIf:
+		walk(n.Cond)
+		walkBlock(n.Then, walk)
+		walk(n.Else)
+	case *AstReturn:
+		walk(n.Value)
+	case *AstWhile:
+		walkIdent(n.Label, walk)
+		walk(n.Cond)
+		walkBlock(n.Body, walk)
+	case *AstFor:
+		walkIdent(n.Label, walk)
+		walk(n.Init)
+		walk(n.Cond)
+		walk(n.Step)
+		walkBlock(n.Body, walk)
+	case *AstRangeFor:
+		walkIdent(n.Label, walk)
+		walkIdent(n.Var, walk)
+		walk(n.Lo)
+		walk(n.Hi)
+		walkBlock(n.Body, walk)
+	case *AstBreak:
+		walkIdent(n.Label, walk)
+	case *AstContinue:
+		walkIdent(n.Label, walk)
+	case *AstFnCall:
+		walkIdent(n.Name, walk)
+		for _, arg := range n.Args {
+			walk(arg)
+		}
+	case *AstIdent, *AstIntLitExpr, *AstStringLitExpr, *AstBoolLitExpr:
+		// Leaves
+	default:
+		panic(fmt.Sprintf("Walk: unexpected node %T", n))
+	}
+	if post != nil {
+		post(n)
+	}
+}
+
+// The optional fields are typed pointers, which would make non-nil
+// interfaces if passed to walk as they are
+
+func walkIdent(id *AstIdent, walk func(Node)) {
+	if id != nil {
+		walk(id)
+	}
+}
+
+func walkType(t *AstType, walk func(Node)) {
+	if t != nil {
+		walk(t)
+	}
+}
+
+func walkBlock(b *AstBlock, walk func(Node)) {
+	if b != nil {
+		walk(b)
+	}
+}
+
+// Inspect calls f on each node of the tree rooted at n in pre-order,
+// skipping the children of any node f returns false for
+func Inspect(n Node, f func(Node) bool) {
+	Walk(n, f, nil)
+}
+
+// Rewrite traverses the tree rooted at n like Walk, replacing each node
+// with what post returns for it. post is called after the node's children
+// have been rewritten, so it sees the new children. Returning nil removes
+// a statement from its block or module, or clears an optional field like
+// AstIf.Else. pre can skip subtrees like it does for Walk, in which case
+// the node is kept as it is. Either may be nil.
+//
+// Nodes are changed in place, and the new root is returned. It panics if
+// a node is replaced by one that can't go where it was, like an
+// expression where an identifier is needed.
+func Rewrite(n Node, pre func(Node) bool, post func(Node) Node) Node {
+	r := &rewriter{pre: pre, post: post}
+	return r.node(n)
+}
+
+type rewriter struct {
+	pre  func(Node) bool
+	post func(Node) Node
+}
+
+func (r *rewriter) node(n Node) Node {
+	if n == nil {
+		return nil
+	}
+	if r.pre != nil && !r.pre(n) {
+		return n
+	}
+	switch n := n.(type) {
+	case *AstModule:
+		n.Name = rewriteAs(r, n.Name)
+		n.Statements = rewriteList(r, n.Statements)
+	case *AstConstAssign:
+		n.Ident = rewriteAs(r, n.Ident)
+		n.Type = rewriteAs(r, n.Type)
+		n.Value = rewriteAs(r, n.Value)
+	case *AstVarDecl:
+		n.Ident = rewriteAs(r, n.Ident)
+		n.Type = rewriteAs(r, n.Type)
+		n.Value = rewriteAs(r, n.Value)
+	case *AstAssign:
+		n.Target = rewriteAs(r, n.Target)
+		n.Value = rewriteAs(r, n.Value)
+	case *AstType:
+		n.Name = rewriteAs(r, n.Name)
+	case *AstBinaryExpr:
+		n.Left = rewriteAs(r, n.Left)
+		n.Right = rewriteAs(r, n.Right)
+	case *AstUnaryExpr:
+		n.Expr = rewriteAs(r, n.Expr)
+	case *AstFnDecl:
+		n.Name = rewriteAs(r, n.Name)
+		n.Params = rewriteList(r, n.Params)
+		n.ReturnType = rewriteAs(r, n.ReturnType)
+		n.Body = rewriteAs(r, n.Body)
+	case *AstParam:
+		n.Name = rewriteAs(r, n.Name)
+		n.Type = rewriteAs(r, n.Type)
+	case *AstBlock:
+		n.Body = rewriteList(r, n.Body)
+	case *AstIf:
+		n.Cond = rewriteAs(r, n.Cond)
+		n.Then = rewriteAs(r, n.Then)
+		n.Else = rewriteAs(r, n.Else)
+	case *AstReturn:
+		n.Value = rewriteAs(r, n.Value)
+	case *AstWhile:
+		n.Label = rewriteAs(r, n.Label)
+		n.Cond = rewriteAs(r, n.Cond)
+		n.Body = rewriteAs(r, n.Body)
+	case *AstFor:
+		n.Label = rewriteAs(r, n.Label)
+		n.Init = rewriteAs(r, n.Init)
+		n.Cond = rewriteAs(r, n.Cond)
+		n.Step = rewriteAs(r, n.Step)
+		n.Body = rewriteAs(r, n.Body)
+	case *AstRangeFor:
+		n.Label = rewriteAs(r, n.Label)
+		n.Var = rewriteAs(r, n.Var)
+		n.Lo = rewriteAs(r, n.Lo)
+		n.Hi = rewriteAs(r, n.Hi)
+		n.Body = rewriteAs(r, n.Body)
+	case *AstBreak:
+		n.Label = rewriteAs(r, n.Label)
+	case *AstContinue:
+		n.Label = rewriteAs(r, n.Label)
+	case *AstFnCall:
+		n.Name = rewriteAs(r, n.Name)
+		n.Args = rewriteList(r, n.Args)
+	case *AstIdent, *AstIntLitExpr, *AstStringLitExpr, *AstBoolLitExpr:
+		// Leaves
+	default:
+		panic(fmt.Sprintf("Rewrite: unexpected node %T", n))
+	}
+	if r.post == nil {
+		return n
+	}
+	return r.post(n)
+}
+
+// rewriteAs rewrites a field of type T, checking the replacement fits
+func rewriteAs[T Node](r *rewriter, n T) T {
+	var zero T
+	if isNilNode(n) {
+		return zero
+	}
+	out := r.node(n)
+	if out == nil {
+		return zero
+	}
+	t, ok := out.(T)
+	if !ok {
+		panic(fmt.Sprintf("Rewrite: can't replace %T with %T", n, out))
+	}
+	return t
+}
+
+// rewriteList rewrites each node in a list, dropping any replaced by nil
+func rewriteList[T Node](r *rewriter, list []T) []T {
+	out := list[:0]
+	for _, n := range list {
+		n = rewriteAs(r, n)
+		if !isNilNode(n) {
+			out = append(out, n)
+		}
+	}
+	return out
+}
+
+// isNilNode is true for both a nil interface and a nil pointer in one
+func isNilNode(n Node) bool {
+	if n == nil {
+		return true
+	}
+	switch n := n.(type) {
+	case *AstIdent:
+		return n == nil
+	case *AstType:
+		return n == nil
+	case *AstBlock:
+		return n == nil
+	}
+	return false
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// walkSrc uses every kind of node
+const walkSrc = `module walk;
+let a: int = 1 + 2;
+var b = "b";
+fn f(x: int, y: bool): int {
+	b = "c";
+	outer: while y { break outer; }
+	for var i = 0; i < x; i += 1 { continue; }
+	for j in 0..-x {}
+	if !y { return x; } else if y { f(x, false); } else {}
+	return a;
+}
+`
+
+func parseWalkSrc(t *testing.T) *AstModule {
+	t.Helper()
+	p := NewParser(walkSrc, "<filename>")
+	mod, err := p.ParseModule()
+	if err != nil {
+		t.Fatalf("parsing: %v", err)
+	}
+	return mod
+}
+
+func TestWalkVisitsEveryNode(t *testing.T) {
+	mod := parseWalkSrc(t)
+	seen := map[string]bool{}
+	Inspect(mod, func(n Node) bool {
+		seen[reflect.TypeOf(n).Elem().Name()] = true
+		return true
+	})
+	all := []Node{
+		&AstModule{}, &AstConstAssign{}, &AstVarDecl{}, &AstAssign{}, &AstIdent{}, &AstType{},
+		&AstIntLitExpr{}, &AstStringLitExpr{}, &AstBoolLitExpr{}, &AstBinaryExpr{}, &AstUnaryExpr{},
+		&AstFnDecl{}, &AstParam{}, &AstBlock{}, &AstIf{}, &AstReturn{}, &AstWhile{}, &AstFor{},
+		&AstRangeFor{}, &AstBreak{}, &AstContinue{}, &AstFnCall{},
+	}
+	for _, n := range all {
+		name := reflect.TypeOf(n).Elem().Name()
+		if !seen[name] {
+			t.Errorf("%s was never visited", name)
+		}
+	}
+}
+
+func TestWalkOrder(t *testing.T) {
+	p := NewParser("module m; let a = -(1 + b);", "<filename>")
+	mod, err := p.ParseModule()
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := func(n Node) string {
+		s := strings.TrimPrefix(reflect.TypeOf(n).Elem().Name(), "Ast")
+		if id, ok := n.(*AstIdent); ok {
+			s += ":" + id.Name
+		}
+		return s
+	}
+	pre, post := []string{}, []string{}
+	Walk(mod, func(n Node) bool {
+		pre = append(pre, name(n))
+		return true
+	}, func(n Node) {
+		post = append(post, name(n))
+	})
+	wantPre := "Module Ident:m ConstAssign Ident:a UnaryExpr BinaryExpr IntLitExpr Ident:b"
+	wantPost := "Ident:m Ident:a IntLitExpr Ident:b BinaryExpr UnaryExpr ConstAssign Module"
+	if got := strings.Join(pre, " "); got != wantPre {
+		t.Errorf("pre-order got\n  %s\nwant\n  %s", got, wantPre)
+	}
+	if got := strings.Join(post, " "); got != wantPost {
+		t.Errorf("post-order got\n  %s\nwant\n  %s", got, wantPost)
+	}
+}
+
+func TestInspectSkip(t *testing.T) {
+	mod := parseWalkSrc(t)
+	idents := []string{}
+	Inspect(mod, func(n Node) bool {
+		if id, ok := n.(*AstIdent); ok {
+			idents = append(idents, id.Name)
+		}
+		// Don't look inside functions
+		_, fn := n.(*AstFnDecl)
+		return !fn
+	})
+	if got, want := strings.Join(idents, " "), "walk a int b"; got != want {
+		t.Errorf("got identifiers %q, want %q", got, want)
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		pre  func(Node) bool
+		post func(Node) Node
+		want string
+	}{
+		{
+			name: "replace literals",
+			src:  "module m; fn f(): int { return 1 + 2; }",
+			post: func(n Node) Node {
+				if lit, ok := n.(*AstIntLitExpr); ok {
+					return &AstIntLitExpr{node: lit.node, Value: lit.Value * 10}
+				}
+				return n
+			},
+			want: "return 10 + 20",
+		},
+		{
+			name: "fold after children",
+			src:  "module m; let a = 1 + 2 * 3;",
+			post: func(n Node) Node {
+				bin, ok := n.(*AstBinaryExpr)
+				if !ok {
+					return n
+				}
+				l, lok := bin.Left.(*AstIntLitExpr)
+				r, rok := bin.Right.(*AstIntLitExpr)
+				if !lok || !rok {
+					return n
+				}
+				if bin.Op == TokPlus {
+					return &AstIntLitExpr{node: bin.node, Value: l.Value + r.Value}
+				}
+				return &AstIntLitExpr{node: bin.node, Value: l.Value * r.Value}
+			},
+			want: "let a = 7",
+		},
+		{
+			name: "remove statements",
+			src:  "module m; fn f(): void { g(); h(); g(); }",
+			post: func(n Node) Node {
+				if call, ok := n.(*AstFnCall); ok && call.Name.Name == "g" {
+					return nil
+				}
+				return n
+			},
+			want: "fn f(): void { h(); }",
+		},
+		{
+			name: "clear else",
+			src:  "module m; fn f(): void { if true {} else { g(); } }",
+			post: func(n Node) Node {
+				// Only the else block starts with a call
+				if b, ok := n.(*AstBlock); ok && len(b.Body) > 0 {
+					if _, call := b.Body[0].(*AstFnCall); call {
+						return nil
+					}
+				}
+				return n
+			},
+			want: "{ if true {} }",
+		},
+		{
+			name: "skip subtrees",
+			src:  "module m; let a = 1; fn f(): int { return 1; }",
+			pre: func(n Node) bool {
+				_, fn := n.(*AstFnDecl)
+				return !fn
+			},
+			post: func(n Node) Node {
+				if lit, ok := n.(*AstIntLitExpr); ok {
+					return &AstIntLitExpr{node: lit.node, Value: 2}
+				}
+				return n
+			},
+			want: "let a = 2; fn f(): int { return 1; }",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := NewParser(test.src, "<filename>")
+			mod, err := p.ParseModule()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := Rewrite(mod, test.pre, test.post)
+			if got != Node(mod) {
+				t.Errorf("Rewrite returned a new root %T", got)
+			}
+			if out := printNode(mod); !strings.Contains(out, test.want) {
+				t.Errorf("got\n  %s\nwant it to contain\n  %s", out, test.want)
+			}
+		})
+	}
+}
+
+func TestRewriteBadReplacement(t *testing.T) {
+	p := NewParser("module m; let a = 1;", "<filename>")
+	mod, err := p.ParseModule()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		r := recover()
+		want := "Rewrite: can't replace *main.AstIdent with *main.AstIntLitExpr"
+		if fmt.Sprint(r) != want {
+			t.Errorf("got panic %v, want %s", r, want)
+		}
+	}()
+	Rewrite(mod, nil, func(n Node) Node {
+		if _, ok := n.(*AstIdent); ok {
+			return &AstIntLitExpr{}
+		}
+		return n
+	})
+}
+
+// printNode writes enough of a tree back out as source to check what a
+// rewrite did to it
+func printNode(n Node) string {
+	switch n := n.(type) {
+	case *AstModule:
+		parts := []string{}
+		for _, st := range n.Statements {
+			parts = append(parts, printNode(st))
+		}
+		return strings.Join(parts, " ")
+	case *AstConstAssign:
+		return fmt.Sprintf("let %s = %s;", n.Ident.Name, printNode(n.Value))
+	case *AstFnDecl:
+		return fmt.Sprintf("fn %s(): %s %s", n.Name.Name, n.ReturnType.Name.Name, printNode(n.Body))
+	case *AstBlock:
+		if len(n.Body) == 0 {
+			return "{}"
+		}
+		parts := []string{}
+		for _, st := range n.Body {
+			parts = append(parts, printNode(st))
+		}
+		return "{ " + strings.Join(parts, " ") + " }"
+	case *AstIf:
+		s := fmt.Sprintf("if %s %s", printNode(n.Cond), printNode(n.Then))
+		if n.Else != nil {
+			s += " else " + printNode(n.Else)
+		}
+		return s
+	case *AstReturn:
+		return fmt.Sprintf("return %s;", printNode(n.Value))
+	case *AstFnCall:
+		return n.Name.Name + "();"
+	case *AstBinaryExpr:
+		op := "+"
+		if n.Op == TokStar {
+			op = "*"
+		}
+		return fmt.Sprintf("%s %s %s", printNode(n.Left), op, printNode(n.Right))
+	case *AstIntLitExpr:
+		return fmt.Sprint(n.Value)
+	case *AstBoolLitExpr:
+		return fmt.Sprint(n.Value)
+	}
+	return fmt.Sprintf("<%T>", n)
+}